@@ -0,0 +1,165 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"time"
+
+	"github.com/edgard/iperf3_exporter/internal/host"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// admissionRetryInterval is the interval between two admission checks of
+	// a deferred test.
+	admissionRetryInterval = time.Second
+
+	// nicSampleInterval is the interval over which the interface utilization
+	// is measured.
+	nicSampleInterval = 500 * time.Millisecond
+)
+
+var (
+	admissionDecisions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prometheus.BuildFQName(namespace, "exporter", "admission_decisions_total"),
+			Help: "Admission decisions for the tests of the exporter host.",
+		},
+		[]string{"decision"},
+	)
+	admissionOverloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prometheus.BuildFQName(namespace, "exporter", "admission_overloads_total"),
+			Help: "Admission checks that found the exporter host overloaded, by exceeded threshold.",
+		},
+		[]string{"reason"},
+	)
+)
+
+// admissionEnabled reports whether any admission threshold is set.
+func admissionEnabled() bool {
+	return *admissionMaxLoad > 0 || *admissionMinMemory > 0 || *admissionMaxNIC > 0
+}
+
+// overload returns why the exporter host is too busy to run a test of o that
+// yields meaningful numbers, or an empty string if it is not. Thresholds that
+// cannot be checked are ignored.
+func overload(ctx context.Context, o iperfOptions) string {
+	if *admissionMaxLoad > 0 {
+		if load, err := host.LoadAverage(); err != nil {
+			slog.Debug("Failed to read the load average", "err", err)
+		} else if load/float64(runtime.NumCPU()) > *admissionMaxLoad {
+			return "load"
+		}
+	}
+	if *admissionMinMemory > 0 {
+		if mem, err := host.AvailableMemory(); err != nil {
+			slog.Debug("Failed to read the available memory", "err", err)
+		} else if mem < float64(*admissionMinMemory) {
+			return "memory"
+		}
+	}
+	// The interface is only known when the client runs in the network
+	// namespace of the exporter.
+	if *admissionMaxNIC > 0 && hostNetwork(o.runner) {
+		if u, err := nicUtilization(ctx, o); err != nil {
+			slog.Debug("Failed to measure the utilization of the interface to the target", "target", o.target, "err", err)
+		} else if u > *admissionMaxNIC {
+			return "nic"
+		}
+	}
+	return ""
+}
+
+// nicUtilization returns the utilization of the interface used to reach the
+// target of o, between 0 and 1, over nicSampleInterval.
+func nicUtilization(ctx context.Context, o iperfOptions) (float64, error) {
+	iface, err := host.EgressInterface(o.target, o.port)
+	if err != nil {
+		return 0, err
+	}
+	speed, err := host.InterfaceSpeed(iface)
+	if err != nil {
+		return 0, err
+	}
+	before, err := host.InterfaceBytes(iface)
+	if err != nil {
+		return 0, err
+	}
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-time.After(nicSampleInterval):
+	}
+	after, err := host.InterfaceBytes(iface)
+	if err != nil {
+		return 0, err
+	}
+	return (after - before) * 8 / nicSampleInterval.Seconds() / speed, nil
+}
+
+// admit checks whether a test of o can run on the exporter host, and returns
+// the options to run it with. An overloaded host either defers the test until
+// it is not overloaded anymore, for at most admission.max-delay and as long as
+// the test still fits in ctx, or shortens it to iperf3.min-period, depending
+// on admission.action. A test that is still not admitted is skipped.
+func admit(ctx context.Context, o iperfOptions) (iperfOptions, error) {
+	// Remote and replayed tests do not load the exporter host.
+	if !admissionEnabled() || *replayDirectory != "" {
+		return o, nil
+	}
+	if _, ok := o.runner.(sshRunner); ok {
+		return o, nil
+	}
+
+	reason := overload(ctx, o)
+	if reason == "" {
+		admissionDecisions.WithLabelValues("admit").Inc()
+		return o, nil
+	}
+	admissionOverloads.WithLabelValues(reason).Inc()
+
+	if *admissionAction == "shorten" {
+		admissionDecisions.WithLabelValues("shorten").Inc()
+		slog.Info("Shortening the iperf3 test, the exporter host is overloaded", "target", o.target, "period", *minPeriod, "reason", reason)
+		if o.period > *minPeriod {
+			o.period = *minPeriod
+		}
+		return o, nil
+	}
+
+	deadline := time.Now().Add(*admissionMaxDelay)
+	if d, ok := ctx.Deadline(); ok && d.Add(-o.period-periodMargin).Before(deadline) {
+		deadline = d.Add(-o.period - periodMargin)
+	}
+	admissionDecisions.WithLabelValues("defer").Inc()
+	for time.Now().Add(admissionRetryInterval).Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return o, ctx.Err()
+		case <-time.After(admissionRetryInterval):
+		}
+		if reason = overload(ctx, o); reason == "" {
+			admissionDecisions.WithLabelValues("admit").Inc()
+			return o, nil
+		}
+		admissionOverloads.WithLabelValues(reason).Inc()
+	}
+	admissionDecisions.WithLabelValues("reject").Inc()
+	return o, fmt.Errorf("the exporter host is overloaded (%s)", reason)
+}
@@ -0,0 +1,451 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/edgard/iperf3_exporter/internal/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// The agent protocol is a single client-streaming gRPC method. Messages are
+// encoded as JSON so that no generated code is needed on either side.
+const (
+	agentCodecName  = "json"
+	agentMethodName = "/iperf3_exporter.Agent/Report"
+)
+
+// Results are dropped once their agent missed agentExpiryRounds refreshes, the
+// refresh of agents not announcing it being agentDefaultRefresh.
+const (
+	agentExpiryRounds   = 3
+	agentDefaultRefresh = 5 * time.Minute
+)
+
+var agentAuthFailures = prometheus.NewCounter(prometheus.CounterOpts{Name: prometheus.BuildFQName(namespace, "exporter", "agent_auth_failures_total"), Help: "Agent streams refused because they were not authenticated."})
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                               { return agentCodecName }
+
+// agentResult is the outcome of a test run by an agent.
+type agentResult struct {
+	Agent           string  `json:"agent"`
+	Target          string  `json:"target"`
+	Port            int     `json:"port"`
+	Success         bool    `json:"success"`
+	Timestamp       float64 `json:"timestamp"`
+	SentSeconds     float64 `json:"sent_seconds"`
+	SentBytes       float64 `json:"sent_bytes"`
+	ReceivedSeconds float64 `json:"received_seconds"`
+	ReceivedBytes   float64 `json:"received_bytes"`
+
+	// RefreshSeconds is the longest time until the agent sends the next
+	// result of the target.
+	RefreshSeconds float64 `json:"refresh_seconds,omitempty"`
+}
+
+// agentAck is sent by the exporter when an agent closes its stream.
+type agentAck struct{}
+
+type agentReportServer interface{}
+
+var agentServiceDesc = grpc.ServiceDesc{
+	ServiceName: "iperf3_exporter.Agent",
+	HandlerType: (*agentReportServer)(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Report",
+		ClientStreams: true,
+		Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			return srv.(*agentCollector).report(stream)
+		},
+	}},
+}
+
+type agentKey struct {
+	agent  string
+	target string
+	port   int
+}
+
+type agentEntry struct {
+	result  agentResult
+	expires time.Time
+}
+
+// agentCollector receives the results streamed by agents and exports the last
+// result of every agent and target.
+type agentCollector struct {
+	// token is the bearer token agents must send (none if empty).
+	token string
+
+	mutex   sync.Mutex
+	results map[agentKey]agentEntry
+
+	// previous are the throughputs of the previous successful tests.
+	previous map[agentKey]float64
+
+	success         *prometheus.Desc
+	timestamp       *prometheus.Desc
+	sentSeconds     *prometheus.Desc
+	sentBytes       *prometheus.Desc
+	receivedSeconds *prometheus.Desc
+	receivedBytes   *prometheus.Desc
+	change          *prometheus.Desc
+}
+
+func newAgentCollector(token string) *agentCollector {
+	labels := []string{"agent", "target", "port"}
+	return &agentCollector{
+		token:           token,
+		results:         map[agentKey]agentEntry{},
+		previous:        map[agentKey]float64{},
+		success:         prometheus.NewDesc(prometheus.BuildFQName(namespace, "agent", "success"), "Was the last iperf3 test of the agent successful.", labels, nil),
+		timestamp:       prometheus.NewDesc(prometheus.BuildFQName(namespace, "agent", "last_test_timestamp_seconds"), "Time of the last iperf3 test of the agent.", labels, nil),
+		sentSeconds:     prometheus.NewDesc(prometheus.BuildFQName(namespace, "agent", "sent_seconds"), "Total seconds spent sending packets by the agent.", labels, nil),
+		sentBytes:       prometheus.NewDesc(prometheus.BuildFQName(namespace, "agent", "sent_bytes"), "Total bytes sent by the agent.", labels, nil),
+		receivedSeconds: prometheus.NewDesc(prometheus.BuildFQName(namespace, "agent", "received_seconds"), "Total seconds spent receiving packets from the agent.", labels, nil),
+		receivedBytes:   prometheus.NewDesc(prometheus.BuildFQName(namespace, "agent", "received_bytes"), "Total bytes received from the agent.", labels, nil),
+		change:          prometheus.NewDesc(prometheus.BuildFQName(namespace, "agent", "throughput_change_ratio"), "Relative change of the received throughput from the previous successful test of the agent.", labels, nil),
+	}
+}
+
+// Serve accepts agent streams on l, over TLS unless tlsConfig is nil.
+func (a *agentCollector) Serve(l net.Listener, tlsConfig *tls.Config) error {
+	opts := []grpc.ServerOption{grpc.StreamInterceptor(a.authenticate)}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	srv := grpc.NewServer(opts...)
+	srv.RegisterService(&agentServiceDesc, a)
+	return srv.Serve(l)
+}
+
+// authenticate refuses the streams not carrying the bearer token of the
+// exporter, client certificates being verified by the TLS handshake.
+func (a *agentCollector) authenticate(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if a.token == "" {
+		return handler(srv, ss)
+	}
+	md, _ := metadata.FromIncomingContext(ss.Context())
+	for _, v := range md.Get("authorization") {
+		if subtle.ConstantTimeCompare([]byte(v), []byte("Bearer "+a.token)) == 1 {
+			return handler(srv, ss)
+		}
+	}
+	agentAuthFailures.Inc()
+	return status.Error(codes.Unauthenticated, "invalid agent token")
+}
+
+// certificateNames returns the names of the verified client certificate of
+// the stream, or nil if it has none.
+func certificateNames(ctx context.Context) []string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	cert := info.State.VerifiedChains[0][0]
+	return append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+}
+
+func (a *agentCollector) report(stream grpc.ServerStream) error {
+	names := certificateNames(stream.Context())
+	for {
+		r := agentResult{}
+		err := stream.RecvMsg(&r)
+		if err == io.EOF {
+			return stream.SendMsg(&agentAck{})
+		}
+		if err != nil {
+			return err
+		}
+		// Agents authenticated by a certificate only report under its names.
+		if names != nil && !containsString(names, r.Agent) {
+			agentAuthFailures.Inc()
+			return status.Errorf(codes.PermissionDenied, "agent %q does not match the client certificate", r.Agent)
+		}
+		refresh := agentDefaultRefresh
+		if r.RefreshSeconds > 0 {
+			refresh = time.Duration(r.RefreshSeconds * float64(time.Second))
+		}
+		k := agentKey{agent: r.Agent, target: r.Target, port: r.Port}
+		a.mutex.Lock()
+		if old, ok := a.results[k]; ok && old.result.Success {
+			a.previous[k] = throughput(old.result.ReceivedBytes, old.result.ReceivedSeconds)
+		}
+		a.results[k] = agentEntry{result: r, expires: time.Now().Add(agentExpiryRounds * refresh)}
+		a.mutex.Unlock()
+	}
+}
+
+func containsString(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Describe implements prometheus.Collector.
+func (a *agentCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- a.success
+	ch <- a.timestamp
+	ch <- a.sentSeconds
+	ch <- a.sentBytes
+	ch <- a.receivedSeconds
+	ch <- a.receivedBytes
+	ch <- a.change
+}
+
+// Collect implements prometheus.Collector.
+func (a *agentCollector) Collect(ch chan<- prometheus.Metric) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	now := time.Now()
+	for k, e := range a.results {
+		if now.After(e.expires) {
+			delete(a.results, k)
+			delete(a.previous, k)
+			continue
+		}
+		r := e.result
+		labels := []string{k.agent, k.target, strconv.Itoa(k.port)}
+		ch <- prometheus.MustNewConstMetric(a.success, prometheus.GaugeValue, boolToFloat(r.Success), labels...)
+		ch <- prometheus.MustNewConstMetric(a.timestamp, prometheus.GaugeValue, r.Timestamp, labels...)
+		if !r.Success {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(a.sentSeconds, prometheus.GaugeValue, r.SentSeconds, labels...)
+		ch <- prometheus.MustNewConstMetric(a.sentBytes, prometheus.GaugeValue, r.SentBytes, labels...)
+		ch <- prometheus.MustNewConstMetric(a.receivedSeconds, prometheus.GaugeValue, r.ReceivedSeconds, labels...)
+		ch <- prometheus.MustNewConstMetric(a.receivedBytes, prometheus.GaugeValue, r.ReceivedBytes, labels...)
+		if ratio, ok := changeRatio(a.previous[k], throughput(r.ReceivedBytes, r.ReceivedSeconds)); ok {
+			ch <- prometheus.MustNewConstMetric(a.change, prometheus.GaugeValue, ratio, labels...)
+		}
+	}
+}
+
+// readTokenFile returns the token of file, empty if file is.
+func readTokenFile(file string) (string, error) {
+	if file == "" {
+		return "", nil
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// loadCertPool reads the PEM certificates of file.
+func loadCertPool(file string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificate found in %s", file)
+	}
+	return pool, nil
+}
+
+// agentServerTLS returns the TLS configuration of the agent listener, nil if
+// certFile and keyFile are empty. With clientCAFile, agents must present a
+// certificate signed by one of its CAs.
+func agentServerTLS(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		if clientCAFile != "" {
+			return nil, errors.New("client certificates require a server certificate and key")
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if clientCAFile != "" {
+		if cfg.ClientCAs, err = loadCertPool(clientCAFile); err != nil {
+			return nil, err
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// agentToken sends the bearer token of the agent with its streams.
+type agentToken string
+
+func (t agentToken) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+func (t agentToken) RequireTransportSecurity() bool { return false }
+
+// agentDialOptions returns the options connecting to the exporter: over TLS
+// if enabled or any of caFile, certFile and serverName is set, presenting the
+// certFile client certificate, and sending token unless empty.
+func agentDialOptions(enableTLS bool, caFile, certFile, keyFile, serverName, token string) ([]grpc.DialOption, error) {
+	var opts []grpc.DialOption
+	if enableTLS || caFile != "" || certFile != "" || serverName != "" {
+		cfg := &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12}
+		if caFile != "" {
+			pool, err := loadCertPool(caFile)
+			if err != nil {
+				return nil, err
+			}
+			cfg.RootCAs = pool
+		}
+		if certFile != "" {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return nil, err
+			}
+			cfg.Certificates = []tls.Certificate{cert}
+		}
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(cfg)))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+	if token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(agentToken(token)))
+	}
+	return opts, nil
+}
+
+// runAgent tests the configured targets every interval and streams the results
+// to the exporter at address, reconnecting whenever the stream breaks.
+func runAgent(ctx context.Context, name string, address string, opts []grpc.DialOption, interval time.Duration, period time.Duration) {
+	results := make(chan agentResult, 64)
+	go func() {
+		for {
+			targets := sc.Get().Targets
+			// A round takes at most the run timeout of every target.
+			refresh := interval + time.Duration(len(targets))*agentRunTimeout(period)
+			for _, t := range targets {
+				r := agentTest(ctx, name, t, period)
+				r.RefreshSeconds = refresh.Seconds()
+				results <- r
+			}
+			select {
+			case <-ctx.Done():
+				close(results)
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+
+	for ctx.Err() == nil {
+		if err := streamAgentResults(ctx, address, opts, results); err != nil {
+			slog.Error("Failed to stream results", "address", address, "err", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(5 * time.Second):
+			}
+		}
+	}
+}
+
+func agentTest(ctx context.Context, name string, t config.Target, period time.Duration) agentResult {
+	port := t.Port
+	if port == 0 {
+		port = config.DefaultPort
+	}
+	ctx, cancel := context.WithTimeout(ctx, agentRunTimeout(period))
+	defer cancel()
+
+	r := agentResult{Agent: name, Target: t.Target, Port: port}
+	stats, err := runIperfRetrying(ctx, iperfOptions{target: t.Target, port: port, period: period, threads: 1, auth: t.Auth})
+	r.Timestamp = float64(time.Now().UnixNano()) / 1e9
+	if err != nil {
+		iperfErrors.Inc()
+		slog.Error("Failed to test", "target", t.Target, "err", err)
+		return r
+	}
+	r.Success = true
+	r.SentSeconds = stats.End.SumSent.Seconds
+	r.SentBytes = stats.End.SumSent.Bytes
+	r.ReceivedSeconds = stats.End.SumReceived.Seconds
+	r.ReceivedBytes = stats.End.SumReceived.Bytes
+	return r
+}
+
+// agentRunTimeout returns the timeout of the agent tests of period.
+func agentRunTimeout(period time.Duration) time.Duration {
+	if *timeout < period+periodMargin {
+		return period + periodMargin
+	}
+	return *timeout
+}
+
+func streamAgentResults(ctx context.Context, address string, opts []grpc.DialOption, results <-chan agentResult) error {
+	conn, err := grpc.DialContext(ctx, address, opts...)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	stream, err := conn.NewStream(ctx, &agentServiceDesc.Streams[0], agentMethodName, grpc.CallContentSubtype(agentCodecName))
+	if err != nil {
+		return err
+	}
+	for r := range results {
+		if err := stream.SendMsg(&r); err == io.EOF {
+			// The exporter ended the stream, its status tells why.
+			return stream.RecvMsg(&agentAck{})
+		} else if err != nil {
+			return err
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	return stream.RecvMsg(&agentAck{})
+}
@@ -0,0 +1,42 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var probeAuthFailures = prometheus.NewCounter(prometheus.CounterOpts{Name: prometheus.BuildFQName(namespace, "exporter", "probe_auth_failures_total"), Help: "Requests refused because they were not authenticated as probe_auth requires."})
+
+// requireProbeAuth wraps a handler so that it refuses the requests not
+// authenticated as the probe_auth settings of the configuration require. It
+// guards the probes and every endpoint revealing targets or changing state.
+func requireProbeAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a := sc.Get().ProbeAuth
+		if a == nil || a.Authenticated(r) {
+			next(w, r)
+			return
+		}
+		probeAuthFailures.Inc()
+		slog.Debug("Refused an unauthenticated request", "path", r.URL.Path, "client", r.RemoteAddr)
+		if a.HtpasswdFile != "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="iperf3_exporter"`)
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/edgard/iperf3_exporter/internal/iperf"
+)
+
+// backend drives a kind of test client.
+type backend interface {
+	// Check returns an error when o uses options the client does not
+	// support.
+	Check(o iperfOptions) error
+
+	// Run runs the test of o and returns its result in the shape of the
+	// iperf3 JSON output.
+	Run(ctx context.Context, o iperfOptions) (*iperf.Result, error)
+}
+
+// backendOf returns the backend of the module setting name, that of
+// --iperf3.backend if empty.
+func backendOf(name string) backend {
+	if name == "" {
+		name = *iperfBackend
+	}
+	switch name {
+	case "iperf2":
+		return iperf2Backend{}
+	case "native":
+		return nativeBackend{}
+	}
+	return iperf3Backend{}
+}
+
+// iperf3Backend runs the iperf3 client.
+type iperf3Backend struct{}
+
+func (iperf3Backend) Check(o iperfOptions) error {
+	return nil
+}
+
+func (b iperf3Backend) Run(ctx context.Context, o iperfOptions) (*iperf.Result, error) {
+	args, env := b.args(o)
+	return runCommand(ctx, o, args, env, func(out []byte) (*iperf.Result, error) {
+		doc, stats, err := b.parse(out)
+		if err == nil {
+			rawResults.Set(o.target, o.port, doc)
+		}
+		return stats, err
+	})
+}
+
+func (iperf3Backend) args(o iperfOptions) ([]string, []string) {
+	args := []string{"-J", "-t", strconv.FormatFloat(o.period.Seconds(), 'f', 0, 64), "-c", o.target, "-p", strconv.Itoa(o.port)}
+	if o.threads > 1 {
+		args = append(args, "-P", strconv.Itoa(o.threads))
+	}
+	if o.serverOutput {
+		args = append(args, "--get-server-output")
+	}
+	if o.flowLabel != 0 {
+		args = append(args, "-L", strconv.Itoa(o.flowLabel))
+	}
+	if o.bidir {
+		args = append(args, "--bidir")
+	}
+	if o.udp {
+		args = append(args, "-u")
+	}
+	if o.reverse {
+		args = append(args, "-R")
+	}
+	if *jsonStream {
+		binary := ""
+		if lr, ok := o.runner.(localRunner); ok {
+			binary = lr.binary
+		}
+		// Older binaries still report the intervals at the end of the test.
+		if requireFeature(binary, "json-stream") == nil {
+			args = append(args, "--json-stream")
+		}
+	}
+	env := localeEnv()
+	if o.auth != nil {
+		args = append(args, "--username", o.auth.Username, "--rsa-public-key-path", o.auth.RSAPublicKeyFile)
+		env = append(env, "IPERF3_PASSWORD="+o.auth.Password)
+	}
+	return args, env
+}
+
+// parse parses the output of the iperf3 client, returning the JSON document
+// it is or, with --json-stream, it is assembled into.
+func (iperf3Backend) parse(out []byte) ([]byte, *iperf.Result, error) {
+	if iperf.IsStream(out) {
+		doc, err := iperf.Assemble(out)
+		if err != nil {
+			iperfFailures.WithLabelValues("non_json").Inc()
+			return nil, nil, &testError{reason: "non_json", err: fmt.Errorf("unexpected iperf3 output: %s", err)}
+		}
+		out = doc
+	}
+	// Some distribution builds print localized warnings on the standard
+	// output, which are reported apart from results of an unexpected shape.
+	if err := iperf.CheckJSON(out); err != nil {
+		iperfFailures.WithLabelValues("non_json").Inc()
+		return nil, nil, &testError{reason: "non_json", err: fmt.Errorf("unexpected iperf3 output: %s", err)}
+	}
+	stats, err := parseResult(out, *parseMode == "strict")
+	if err != nil {
+		iperfFailures.WithLabelValues("parse_error").Inc()
+		return nil, nil, &testError{reason: "parse_error", err: fmt.Errorf("failed to parse iperf3 result: %s", err)}
+	}
+	return out, stats, nil
+}
+
+// iperf2Backend runs the classic iperf (v2) client, for legacy appliances that
+// only ship an iperf2 server.
+type iperf2Backend struct{}
+
+func (iperf2Backend) Check(o iperfOptions) error {
+	switch {
+	case o.bidir:
+		return errors.New("iperf2 does not support 'bidir'")
+	case o.udp:
+		return errors.New("iperf2 does not support 'udp'")
+	case o.reverse:
+		return errors.New("iperf2 does not support 'reverse'")
+	case o.serverOutput:
+		return errors.New("iperf2 does not support 'server_output'")
+	case o.flowLabel != 0:
+		return errors.New("iperf2 does not support 'flowlabel'")
+	case o.auth != nil:
+		return errors.New("iperf2 does not support authentication")
+	}
+	return nil
+}
+
+func (b iperf2Backend) Run(ctx context.Context, o iperfOptions) (*iperf.Result, error) {
+	args := []string{"-y", "C", "-t", strconv.FormatFloat(o.period.Seconds(), 'f', 0, 64), "-c", o.target, "-p", strconv.Itoa(o.port)}
+	if o.threads > 1 {
+		args = append(args, "-P", strconv.Itoa(o.threads))
+	}
+	return runCommand(ctx, o, args, localeEnv(), b.parse)
+}
+
+func (iperf2Backend) parse(out []byte) (*iperf.Result, error) {
+	stats, err := iperf.ParseIperf2CSV(out)
+	if err != nil {
+		iperfFailures.WithLabelValues("parse_error").Inc()
+		return nil, &testError{reason: "parse_error", err: fmt.Errorf("failed to parse iperf2 result: %s", err)}
+	}
+	return stats, nil
+}
+
+// nativeBackend runs the tests with the iperf3 protocol rather than the
+// iperf3 binary, so that probes need neither a system binary nor a process
+// per test.
+type nativeBackend struct{}
+
+func (nativeBackend) Check(o iperfOptions) error {
+	switch {
+	case !hostNetwork(o.runner):
+		return errors.New("the native client only runs in the network namespace of the exporter")
+	case o.bidir:
+		return errors.New("the native client does not support 'bidir'")
+	case o.udp:
+		return errors.New("the native client does not support 'udp'")
+	case o.reverse:
+		return errors.New("the native client does not support 'reverse'")
+	case o.serverOutput:
+		return errors.New("the native client does not support 'server_output'")
+	case o.flowLabel != 0:
+		return errors.New("the native client does not support 'flowlabel'")
+	case o.auth != nil:
+		return errors.New("the native client does not support authentication")
+	}
+	return nil
+}
+
+func (nativeBackend) Run(ctx context.Context, o iperfOptions) (*iperf.Result, error) {
+	stats, err := iperf.RunClient(ctx, iperf.ClientOptions{Target: o.target, Port: o.port, Duration: o.period, Streams: o.threads})
+	if err != nil {
+		reason := iperf.FailureReason(ctx, nil, err)
+		iperfFailures.WithLabelValues(reason).Inc()
+		return nil, &testError{reason: reason, err: fmt.Errorf("failed to run the native iperf3 client: %s", err)}
+	}
+	return stats, nil
+}
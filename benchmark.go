@@ -0,0 +1,176 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/edgard/iperf3_exporter/internal/cache"
+	"github.com/edgard/iperf3_exporter/internal/config"
+	"github.com/edgard/iperf3_exporter/internal/iperf"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+const (
+	// benchmarkBudget is the time spent on every benchmark.
+	benchmarkBudget = 200 * time.Millisecond
+
+	// The canned result is as large as a 60 seconds test with 128 streams.
+	benchmarkStreams   = 128
+	benchmarkIntervals = 60
+
+	benchmarkCacheKeys = 1000
+)
+
+var (
+	// benchmarkMutex keeps concurrent benchmarks from skewing each other.
+	benchmarkMutex sync.Mutex
+
+	benchmarkOnce sync.Once
+	benchmarkJSON []byte
+)
+
+// benchmarkStats is the outcome of one benchmark.
+type benchmarkStats struct {
+	Operations   int     `json:"operations"`
+	Seconds      float64 `json:"seconds"`
+	SecondsPerOp float64 `json:"seconds_per_operation"`
+	OpsPerSecond float64 `json:"operations_per_second"`
+}
+
+// benchmarkReport is the JSON document served by /benchmark.
+type benchmarkReport struct {
+	Parse struct {
+		benchmarkStats
+		Bytes int `json:"bytes"`
+	} `json:"parse"`
+	Cache  benchmarkStats `json:"cache"`
+	Render struct {
+		benchmarkStats
+		Series int `json:"series"`
+	} `json:"render"`
+}
+
+// runBenchmark runs op until benchmarkBudget is spent.
+func runBenchmark(op func() error) (benchmarkStats, error) {
+	s := benchmarkStats{}
+	start := time.Now()
+	for time.Since(start) < benchmarkBudget {
+		if err := op(); err != nil {
+			return s, err
+		}
+		s.Operations++
+	}
+	s.Seconds = time.Since(start).Seconds()
+	s.SecondsPerOp = s.Seconds / float64(s.Operations)
+	s.OpsPerSecond = float64(s.Operations) / s.Seconds
+	return s, nil
+}
+
+// cannedResult returns a large iperf3 JSON result, with the per-stream
+// intervals that iperf3 reports.
+func cannedResult() []byte {
+	benchmarkOnce.Do(func() {
+		stream := map[string]interface{}{"socket": 5, "start": 0, "end": 1, "seconds": 1, "bytes": 117964800, "bits_per_second": 943718400, "retransmits": 0, "snd_cwnd": 3145728, "rtt": 312, "rttvar": 45, "pmtu": 1500, "omitted": false, "sender": true}
+		var streams []interface{}
+		for i := 0; i < benchmarkStreams; i++ {
+			streams = append(streams, stream)
+		}
+		var intervals []interface{}
+		for i := 0; i < benchmarkIntervals; i++ {
+			intervals = append(intervals, map[string]interface{}{"streams": streams, "sum": stream})
+		}
+		var end []interface{}
+		for i := 0; i < benchmarkStreams; i++ {
+			end = append(end, map[string]interface{}{"sender": stream, "receiver": stream})
+		}
+		benchmarkJSON, _ = json.Marshal(map[string]interface{}{
+			"start": map[string]interface{}{
+				"connected":  []interface{}{map[string]interface{}{"remote_port": config.DefaultPort}},
+				"test_start": map[string]interface{}{"protocol": "TCP", "num_streams": benchmarkStreams, "blksize": 131072, "duration": benchmarkIntervals},
+			},
+			"intervals": intervals,
+			"end": map[string]interface{}{
+				"streams":      end,
+				"sum_sent":     stream,
+				"sum_received": stream,
+			},
+		})
+	})
+	return benchmarkJSON
+}
+
+// benchmarkHandler measures the overhead of the exporter itself, so that
+// instances hosting many scheduled targets can be sized: parsing a large
+// iperf3 result, result cache operations and rendering the registry.
+func benchmarkHandler(w http.ResponseWriter, r *http.Request) {
+	benchmarkMutex.Lock()
+	defer benchmarkMutex.Unlock()
+
+	report := benchmarkReport{}
+	var err error
+	out := cannedResult()
+	report.Parse.Bytes = len(out)
+	report.Parse.benchmarkStats, err = runBenchmark(func() error {
+		_, _, err := iperf.Parse(out, false)
+		return err
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to parse the canned result: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	// A scratch cache, so that the probe cache is left alone.
+	scratch := cache.New(time.Hour, 0, benchmarkCacheKeys, errorReason)
+	result := &iperf.Result{}
+	n := 0
+	report.Cache, _ = runBenchmark(func() error {
+		k := cache.Key{Target: "benchmark", Port: n % benchmarkCacheKeys}
+		scratch.Set(k, result)
+		scratch.Get(k, 0)
+		n++
+		return nil
+	})
+
+	report.Render.benchmarkStats, err = runBenchmark(func() error {
+		mfs, err := prometheus.DefaultGatherer.Gather()
+		if err != nil {
+			return err
+		}
+		report.Render.Series = 0
+		for _, mf := range mfs {
+			report.Render.Series += len(mf.Metric)
+			if _, err := expfmt.MetricFamilyToText(ioutil.Discard, mf); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to render the registry: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		slog.Warn("Failed to write to HTTP client", "err", err)
+	}
+}
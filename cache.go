@@ -0,0 +1,247 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/edgard/iperf3_exporter/internal/cache"
+	"github.com/edgard/iperf3_exporter/internal/config"
+	"github.com/edgard/iperf3_exporter/internal/iperf"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	cacheHits = prometheus.NewCounterFunc(prometheus.CounterOpts{Name: prometheus.BuildFQName(namespace, "exporter", "cache_hits_total"), Help: "Probes served from the result cache."}, func() float64 {
+		return float64(probeCache.Stats().Hits)
+	})
+	cacheStaleHits = prometheus.NewCounterFunc(prometheus.CounterOpts{Name: prometheus.BuildFQName(namespace, "exporter", "cache_stale_hits_total"), Help: "Probes served a stale cached result while a new test ran in the background."}, func() float64 {
+		return float64(probeCache.Stats().StaleHits)
+	})
+	cacheMisses = prometheus.NewCounterFunc(prometheus.CounterOpts{Name: prometheus.BuildFQName(namespace, "exporter", "cache_misses_total"), Help: "Probes that ran a test because no cached result could be used."}, func() float64 {
+		return float64(probeCache.Stats().Misses)
+	})
+
+	backoffSkips = prometheus.NewCounter(prometheus.CounterOpts{Name: prometheus.BuildFQName(namespace, "exporter", "backoff_skips_total"), Help: "Probes answered with the previous failure because their test configuration is backed off."})
+)
+
+// outcomeOf returns the outcome of a test that just ended with err.
+func outcomeOf(err error) cache.Outcome {
+	return cache.Outcome{OK: err == nil, Time: time.Now(), Reason: errorReason(err)}
+}
+
+var (
+	// probeCache is the cache of the /probe results (disabled until a TTL is
+	// set).
+	probeCache = cache.New(0, 0, 0, errorReason)
+
+	// probeBackoff is the failure backoff of the /probe tests (disabled until
+	// an initial window is set).
+	probeBackoff = cache.NewBackoff(0, 0)
+)
+
+// cacheEntryInfo is a cached result as listed by /cache.
+type cacheEntryInfo struct {
+	Target          string  `json:"target"`
+	Port            int     `json:"port"`
+	PeriodSeconds   float64 `json:"period_seconds"`
+	Threads         int     `json:"threads"`
+	FlowLabel       int     `json:"flowlabel,omitempty"`
+	ServerOutput    bool    `json:"server_output,omitempty"`
+	Bidir           bool    `json:"bidir,omitempty"`
+	UDP             bool    `json:"udp,omitempty"`
+	Reverse         bool    `json:"reverse,omitempty"`
+	Module          string  `json:"module,omitempty"`
+	NetNS           string  `json:"netns,omitempty"`
+	AgeSeconds      float64 `json:"age_seconds"`
+	LastProbeOK     bool    `json:"last_probe_success"`
+	LastProbeTime   float64 `json:"last_probe_timestamp_seconds"`
+	LastProbeReason string  `json:"last_probe_failure_reason,omitempty"`
+	SentSeconds     float64 `json:"sent_seconds"`
+	SentBytes       float64 `json:"sent_bytes"`
+	ReceivedSeconds float64 `json:"received_seconds"`
+	ReceivedBytes   float64 `json:"received_bytes"`
+}
+
+// listCache returns the results of c, oldest first, as listed by /cache.
+func listCache(c *cache.Cache) []cacheEntryInfo {
+	entries := c.Entries()
+	infos := make([]cacheEntryInfo, 0, len(entries))
+	for _, e := range entries {
+		k := e.Key
+		infos = append(infos, cacheEntryInfo{
+			Target:          k.Target,
+			Port:            k.Port,
+			PeriodSeconds:   k.Period.Seconds(),
+			Threads:         k.Threads,
+			FlowLabel:       k.FlowLabel,
+			ServerOutput:    k.ServerOutput,
+			Bidir:           k.Bidir,
+			UDP:             k.UDP,
+			Reverse:         k.Reverse,
+			Module:          k.Module,
+			NetNS:           k.NetNS,
+			AgeSeconds:      time.Since(e.Time).Seconds(),
+			LastProbeOK:     e.Last.OK,
+			LastProbeTime:   float64(e.Last.Time.UnixNano()) / 1e9,
+			LastProbeReason: e.Last.Reason,
+			SentSeconds:     e.Result.End.SumSent.Seconds,
+			SentBytes:       e.Result.End.SumSent.Bytes,
+			ReceivedSeconds: e.Result.End.SumReceived.Seconds,
+			ReceivedBytes:   e.Result.End.SumReceived.Bytes,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].AgeSeconds > infos[j].AgeSeconds })
+	return infos
+}
+
+// invalidateCache drops cached results and failure backoffs, and reports how
+// many results were dropped.
+func invalidateCache(w http.ResponseWriter, target string) {
+	n := probeCache.Invalidate(target)
+	probeBackoff.Reset(target)
+	if target == "" {
+		slog.Info("Flushed the result cache", "results", n)
+	} else {
+		slog.Info("Dropped the cached results of a target", "target", config.RedactTarget(target), "results", n)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]int{"removed": n}); err != nil {
+		slog.Warn("Failed to write to HTTP client", "err", err)
+	}
+}
+
+// flushCacheHandler drops every cached result.
+func flushCacheHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	invalidateCache(w, "")
+}
+
+// persistedCacheEntry is a cached result saved across restarts.
+type persistedCacheEntry struct {
+	Target       string        `json:"target"`
+	Port         int           `json:"port"`
+	Period       time.Duration `json:"period"`
+	Threads      int           `json:"threads"`
+	FlowLabel    int           `json:"flowlabel,omitempty"`
+	ServerOutput bool          `json:"server_output,omitempty"`
+	Bidir        bool          `json:"bidir,omitempty"`
+	UDP          bool          `json:"udp,omitempty"`
+	Reverse      bool          `json:"reverse,omitempty"`
+	Module       string        `json:"module,omitempty"`
+	NetNS        string        `json:"netns,omitempty"`
+	Time         time.Time     `json:"time"`
+	Result       *iperf.Result `json:"result"`
+}
+
+// saveCache atomically writes the cached results to file, least recently used
+// first.
+func saveCache(c *cache.Cache, file string) error {
+	cached := c.Entries()
+	entries := make([]persistedCacheEntry, 0, len(cached))
+	for _, e := range cached {
+		entries = append(entries, persistedCacheEntry{
+			Target:       e.Key.Target,
+			Port:         e.Key.Port,
+			Period:       e.Key.Period,
+			Threads:      e.Key.Threads,
+			FlowLabel:    e.Key.FlowLabel,
+			ServerOutput: e.Key.ServerOutput,
+			Bidir:        e.Key.Bidir,
+			UDP:          e.Key.UDP,
+			Reverse:      e.Key.Reverse,
+			Module:       e.Key.Module,
+			NetNS:        e.Key.NetNS,
+			Time:         e.Time,
+			Result:       e.Result,
+		})
+	}
+
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(file, b)
+}
+
+// loadCache restores the results saved in file, keeping their original time
+// so that they expire as if the exporter never restarted. A missing file is
+// not an error.
+func loadCache(c *cache.Cache, file string) error {
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var persisted []persistedCacheEntry
+	if err := json.Unmarshal(b, &persisted); err != nil {
+		return err
+	}
+
+	entries := make([]cache.Entry, 0, len(persisted))
+	for _, e := range persisted {
+		entries = append(entries, cache.Entry{
+			Key: cache.Key{
+				Target:       e.Target,
+				Port:         e.Port,
+				Period:       e.Period,
+				Threads:      e.Threads,
+				FlowLabel:    e.FlowLabel,
+				ServerOutput: e.ServerOutput,
+				Bidir:        e.Bidir,
+				UDP:          e.UDP,
+				Reverse:      e.Reverse,
+				Module:       e.Module,
+				NetNS:        e.NetNS,
+			},
+			Result: e.Result,
+			Time:   e.Time,
+		})
+	}
+	c.Restore(entries)
+	return nil
+}
+
+// persistCache saves the cached results to file every interval.
+func persistCache(c *cache.Cache, file string, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := saveCache(c, file); err != nil {
+			slog.Error("Failed to save the result cache", "err", err)
+		}
+	}
+}
+
+// cacheHandler lists the cached results, or drops those of the target
+// parameter (all of them without one) on DELETE requests.
+func cacheHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		invalidateCache(w, r.URL.Query().Get("target"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(listCache(probeCache)); err != nil {
+		slog.Warn("Failed to write to HTTP client", "err", err)
+	}
+}
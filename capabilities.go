@@ -0,0 +1,316 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/edgard/iperf3_exporter/internal/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/version"
+)
+
+const (
+	// versionTimeout bounds the iperf3 --version run.
+	versionTimeout = 5 * time.Second
+)
+
+// probeParameters are the query parameters understood by /probe.
+var probeParameters = []string{"target", "pool", "port", "period", "thread", "module", "server_output", "flowlabel", "bidir", "udp", "reverse", "netns", "cache_ttl", "max_age", "cache", "debug", labelParamPrefix + "<name>"}
+
+var iperfVersionRE = regexp.MustCompile(`iperf (\d+\.\d+(?:\.\d+)?)`)
+
+// featureVersions are the first iperf3 versions supporting the options that
+// are only passed on request.
+var featureVersions = map[string]string{
+	"bidir":       "3.7",
+	"json-stream": "3.17",
+}
+
+var (
+	versionsMutex sync.RWMutex
+
+	// iperfInfos describe the local iperf3 binaries detected on start and
+	// on reloads, by module binary ("" for the default binary).
+	iperfInfos = map[string]iperfInfo{}
+)
+
+// iperfInfo is what the local iperf3 client reports about itself.
+type iperfInfo struct {
+	Version  string   `json:"version,omitempty"`
+	Features []string `json:"features,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// capabilities describes what this exporter and its iperf3 client support.
+type capabilities struct {
+	Version       string    `json:"version"`
+	Parameters    []string  `json:"parameters"`
+	Protocols     []string  `json:"protocols"`
+	Modules       []string  `json:"modules"`
+	AllowedLabels []string  `json:"allowed_labels"`
+	AllowedNetNS  []string  `json:"allowed_netns"`
+	Iperf3        iperfInfo `json:"iperf3"`
+	Limits        struct {
+		MaxThreads        int     `json:"max_threads"`
+		MaxFlowLabel      int     `json:"max_flowlabel"`
+		MaxPeriodSeconds  float64 `json:"max_period_seconds"`
+		MinPeriodSeconds  float64 `json:"min_period_seconds"`
+		MaxTimeoutSeconds float64 `json:"max_timeout_seconds"`
+	} `json:"limits"`
+
+	// ModuleIperf3 describes the iperf3 binaries of the modules that have
+	// their own.
+	ModuleIperf3 map[string]iperfInfo `json:"module_iperf3,omitempty"`
+}
+
+// detectIperf runs binary --version (the default iperf3 if empty) and parses
+// the version and the optional features it was built with.
+func detectIperf(ctx context.Context, binary string) iperfInfo {
+	ctx, cancel := context.WithTimeout(ctx, versionTimeout)
+	defer cancel()
+
+	out, err := localRunner{binary: binary}.Output(ctx, []string{"--version"}, localeEnv())
+	if err != nil {
+		return iperfInfo{Error: err.Error()}
+	}
+	info := iperfInfo{}
+	if m := iperfVersionRE.FindStringSubmatch(string(out)); m != nil {
+		info.Version = m[1]
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if v := strings.TrimPrefix(line, "Optional features available:"); v != line {
+			for _, f := range strings.Split(v, ",") {
+				if f = strings.TrimSpace(f); f != "" {
+					info.Features = append(info.Features, f)
+				}
+			}
+		}
+	}
+	return info
+}
+
+// compareVersions compares two dotted versions, returning -1, 0 or 1. Missing
+// components count as zero.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
+
+// lookIperf returns the path of the iperf3 binary name, searched in the PATH
+// and then, for a bare name, in the iperfSearchDirs of the platform.
+func lookIperf(name string) (string, error) {
+	path, err := exec.LookPath(name)
+	if err == nil || filepath.Base(name) != name {
+		return path, err
+	}
+	for _, dir := range iperfSearchDirs() {
+		if p, dirErr := exec.LookPath(filepath.Join(dir, name)); dirErr == nil {
+			return p, nil
+		}
+	}
+	return "", err
+}
+
+var iperfVersionCheck = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: prometheus.BuildFQName(namespace, "exporter", "iperf3_version_check_success"), Help: "Whether the iperf3 binary meets the minimum version."}, []string{"binary"})
+
+var iperfVersionInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: prometheus.BuildFQName(namespace, "", "version_info"), Help: "Version of the default iperf3 binary, checked on start."}, []string{"version", "path"})
+
+// checkIperfBinary verifies that --iperf3.path is an executable iperf3 binary,
+// so that a missing binary fails on start rather than with an exec error on
+// every probe, and exports its version.
+func checkIperfBinary(ctx context.Context) error {
+	path, err := lookIperf(*iperfPath)
+	if err != nil {
+		return err
+	}
+	// The probes run the binary found, which may not be in the PATH.
+	*iperfPath = path
+	info := detectIperf(ctx, "")
+	if info.Error != "" {
+		return fmt.Errorf("failed to run %s --version: %s", path, info.Error)
+	}
+	if info.Version == "" {
+		return fmt.Errorf("%s does not look like iperf3: no version in its --version output", path)
+	}
+	slog.Info("Using iperf3", "version", info.Version, "path", path)
+	versionsMutex.Lock()
+	iperfInfos[""] = info
+	versionsMutex.Unlock()
+	iperfVersionInfo.WithLabelValues(info.Version, path).Set(1)
+	return nil
+}
+
+// detectModuleVersions detects the versions of the iperf3 binaries of the
+// modules of c, so that probes can check the options they need.
+func detectModuleVersions(ctx context.Context, c *config.Config) {
+	infos := map[string]iperfInfo{}
+	for name, m := range c.Modules {
+		if m.Binary == "" || m.Backend == "iperf2" {
+			continue
+		}
+		info := detectIperf(ctx, m.Binary)
+		if info.Version == "" {
+			slog.Warn("Failed to detect the iperf3 version of module", "module", name, "err", info.Error)
+		}
+		infos[m.Binary] = info
+	}
+
+	versionsMutex.Lock()
+	defer versionsMutex.Unlock()
+	for binary, info := range infos {
+		iperfInfos[binary] = info
+	}
+}
+
+// detectedIperf returns what was detected of the local iperf3 binary, the
+// default one if empty.
+func detectedIperf(binary string) (iperfInfo, bool) {
+	versionsMutex.RLock()
+	defer versionsMutex.RUnlock()
+	info, ok := iperfInfos[binary]
+	return info, ok
+}
+
+// requireFeature returns an error when the local iperf3 binary is known to be
+// too old for feature. Binaries of unknown version, e.g. on remote hosts, are
+// assumed to support it.
+func requireFeature(binary string, feature string) error {
+	info, _ := detectedIperf(binary)
+	v := info.Version
+	if v == "" || compareVersions(v, featureVersions[feature]) >= 0 {
+		return nil
+	}
+	if binary == "" {
+		binary = *iperfPath
+	}
+	return fmt.Errorf("%s is iperf3 %s, --%s needs %s or later", binary, v, feature, featureVersions[feature])
+}
+
+// localBinaries returns the local iperf3 binaries the probes of c can run, ""
+// being the default one, which --iperf3.backend=native only runs for the
+// modules asking for the iperf3 backend.
+func localBinaries(c *config.Config) []string {
+	var binaries []string
+	usesDefault := *iperfBackend != "native"
+	for _, m := range c.Modules {
+		if m == nil || m.SSH != nil || m.Backend == "iperf2" || m.Backend == "native" {
+			continue
+		}
+		if m.Binary != "" {
+			binaries = append(binaries, m.Binary)
+		} else if m.Backend == "iperf3" {
+			usesDefault = true
+		}
+	}
+	if usesDefault {
+		binaries = append([]string{""}, binaries...)
+	}
+	return binaries
+}
+
+// checkIperfVersions verifies that the local iperf3 binaries the probes of c
+// can run are at least minVersion.
+func checkIperfVersions(ctx context.Context, c *config.Config, minVersion string) error {
+	binaries := localBinaries(c)
+
+	var failed []string
+	for _, b := range binaries {
+		info := detectIperf(ctx, b)
+		name := b
+		if name == "" {
+			name = *iperfPath
+		}
+		ok := info.Error == "" && info.Version != "" && compareVersions(info.Version, minVersion) >= 0
+		iperfVersionCheck.WithLabelValues(name).Set(boolToFloat(ok))
+		if !ok {
+			reason := fmt.Sprintf("version %q", info.Version)
+			if info.Error != "" {
+				reason = info.Error
+			}
+			failed = append(failed, name+": "+reason)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("iperf3 older than %s or unusable: %s", minVersion, strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func capabilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	c := capabilities{
+		Version:       version.Version,
+		Parameters:    probeParameters,
+		Protocols:     []string{"tcp"},
+		Modules:       []string{},
+		AllowedLabels: append([]string{}, allowedLabelNames()...),
+		AllowedNetNS:  append([]string{}, sc.Get().AllowedNetNS...),
+	}
+	// The binaries are not run again for every request: their versions are
+	// those detected on start and on reloads.
+	c.Iperf3, _ = detectedIperf("")
+	for name, m := range sc.Get().Modules {
+		c.Modules = append(c.Modules, name)
+		if m.Binary != "" && m.Backend != "iperf2" {
+			if c.ModuleIperf3 == nil {
+				c.ModuleIperf3 = map[string]iperfInfo{}
+			}
+			info, ok := detectedIperf(m.Binary)
+			if !ok {
+				info = iperfInfo{Error: "not detected"}
+			}
+			c.ModuleIperf3[name] = info
+		}
+	}
+	sort.Strings(c.Modules)
+	c.Limits.MaxThreads = maxThreads
+	c.Limits.MaxFlowLabel = maxFlowLabel
+	c.Limits.MaxPeriodSeconds = (maxTimeout - periodMargin).Seconds()
+	c.Limits.MinPeriodSeconds = minPeriod.Seconds()
+	c.Limits.MaxTimeoutSeconds = maxTimeout.Seconds()
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(c); err != nil {
+		slog.Warn("Failed to write to HTTP client", "err", err)
+	}
+}
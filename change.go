@@ -0,0 +1,62 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+
+	"github.com/edgard/iperf3_exporter/internal/cache"
+	"github.com/edgard/iperf3_exporter/internal/iperf"
+)
+
+// throughputHistory is the received throughput of the latest two results of a
+// test configuration.
+type throughputHistory struct {
+	result            *iperf.Result
+	previous, current float64
+}
+
+var (
+	historyMutex sync.Mutex
+	histories    = map[cache.Key]*throughputHistory{}
+)
+
+// changeRatio returns the relative change from the previous throughput to the
+// current one, e.g. -0.5 when it halved. ok is false without a previous
+// throughput.
+func changeRatio(previous, current float64) (ratio float64, ok bool) {
+	if previous == 0 {
+		return 0, false
+	}
+	return current/previous - 1, true
+}
+
+// throughputChange returns the change ratio of stats, the result of a test of
+// k, from the previous result of k. A cached result collected again is
+// compared with the same previous result rather than with itself.
+func throughputChange(k cache.Key, stats *iperf.Result) (float64, bool) {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+
+	h, ok := histories[k]
+	if !ok {
+		h = &throughputHistory{}
+		histories[k] = h
+	}
+	if h.result != stats {
+		h.result = stats
+		h.previous, h.current = h.current, throughput(stats.End.SumReceived.Bytes, stats.End.SumReceived.Seconds)
+	}
+	return changeRatio(h.previous, h.current)
+}
@@ -0,0 +1,44 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/edgard/iperf3_exporter/internal/iperf"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// checkConnect opens and closes a TCP connection to the iperf3 server of the
+// test before iperf3 runs, so that an unreachable server fails the probe
+// within the connect timeout rather than the probe timeout. Its outcome is
+// delivered on ch.
+func (e *Exporter) checkConnect(ctx context.Context, ch chan<- prometheus.Metric, o iperfOptions) error {
+	d := net.Dialer{Timeout: *connectTimeout}
+	start := time.Now()
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(o.target, strconv.Itoa(o.port)))
+	ch <- prometheus.MustNewConstMetric(e.connectDuration, prometheus.GaugeValue, time.Since(start).Seconds())
+	ch <- prometheus.MustNewConstMetric(e.connectSuccess, prometheus.GaugeValue, boolToFloat(err == nil))
+	if err != nil {
+		reason := iperf.FailureReason(ctx, nil, err)
+		iperfFailures.WithLabelValues(reason).Inc()
+		return &testError{reason: reason, err: fmt.Errorf("failed to connect to the iperf3 server: %s", err)}
+	}
+	conn.Close()
+	return nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/edgard/iperf3_exporter/internal/config"
+	"github.com/prometheus/common/model"
+)
+
+// consulServiceEntry is the partial result of the Consul health API.
+type consulServiceEntry struct {
+	Node struct {
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		Address string   `json:"Address"`
+		Port    int      `json:"Port"`
+		Tags    []string `json:"Tags"`
+	} `json:"Service"`
+}
+
+// consulTargets returns the healthy instances of the given Consul services.
+// Service tags in the "name=value" form are mapped to target labels, other
+// tags are ignored.
+func consulTargets(ctx context.Context, server string, token string, services []string) ([]config.Target, error) {
+	var targets []config.Target
+	for _, service := range services {
+		u := strings.TrimSuffix(server, "/") + "/v1/health/service/" + url.PathEscape(service) + "?passing=true"
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		if token != "" {
+			req.Header.Set("X-Consul-Token", token)
+		}
+
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		var entries []consulServiceEntry
+		err = json.NewDecoder(resp.Body).Decode(&entries)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status for service %q: %s", service, resp.Status)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse instances of service %q: %s", service, err)
+		}
+
+		for _, e := range entries {
+			address := e.Service.Address
+			if address == "" {
+				address = e.Node.Address
+			}
+			labels := map[string]string{}
+			for _, tag := range e.Service.Tags {
+				kv := strings.SplitN(tag, "=", 2)
+				if len(kv) != 2 || !model.LabelName(kv[0]).IsValid() {
+					continue
+				}
+				labels[kv[0]] = kv[1]
+			}
+			targets = append(targets, config.Target{Target: address, Port: e.Service.Port, Labels: labels})
+		}
+	}
+	return targets, nil
+}
@@ -0,0 +1,332 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/edgard/iperf3_exporter/internal/config"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// maxAttemptStderr is the number of bytes of standard error kept for every
+// recorded iperf3 run.
+const maxAttemptStderr = 2048
+
+// probeAttempt is a run of a test client binary, kept for /debug/probes.
+type probeAttempt struct {
+	Time            time.Time `json:"time"`
+	Target          string    `json:"target"`
+	Port            int       `json:"port"`
+	Args            []string  `json:"args"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	ExitCode        int       `json:"exit_code"`
+	Error           string    `json:"error,omitempty"`
+	Stderr          string    `json:"stderr,omitempty"`
+}
+
+// newProbeAttempt records the run of args for o started at start and ended
+// with err. The exit code is -1 when the client did not exit by itself.
+func newProbeAttempt(o iperfOptions, args []string, start time.Time, err error) probeAttempt {
+	a := probeAttempt{
+		Time:            start,
+		Target:          config.RedactTarget(o.target),
+		Port:            o.port,
+		Args:            args,
+		DurationSeconds: time.Since(start).Seconds(),
+	}
+	if err == nil {
+		return a
+	}
+	a.Error = err.Error()
+	a.ExitCode = -1
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		a.ExitCode = exitErr.ExitCode()
+		a.Stderr = string(exitErr.Stderr)
+		if len(a.Stderr) > maxAttemptStderr {
+			a.Stderr = a.Stderr[:maxAttemptStderr]
+		}
+	}
+	return a
+}
+
+// probeHistory is a ring buffer of the latest probe attempts.
+type probeHistory struct {
+	mutex    sync.Mutex
+	attempts []probeAttempt
+	next     int
+	full     bool
+}
+
+// probeAttempts are the latest runs of --debug.probe-history, nil if disabled.
+var probeAttempts *probeHistory
+
+func newProbeHistory(size int) *probeHistory {
+	if size <= 0 {
+		return nil
+	}
+	return &probeHistory{attempts: make([]probeAttempt, size)}
+}
+
+// Add records a, replacing the oldest attempt once the buffer is full.
+func (h *probeHistory) Add(a probeAttempt) {
+	if h == nil {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.attempts[h.next] = a
+	h.next = (h.next + 1) % len(h.attempts)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// List returns the recorded attempts, newest first.
+func (h *probeHistory) List() []probeAttempt {
+	l := []probeAttempt{}
+	if h == nil {
+		return l
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	n := h.next
+	if h.full {
+		n = len(h.attempts)
+	}
+	for i := 1; i <= n; i++ {
+		l = append(l, h.attempts[(h.next-i+len(h.attempts))%len(h.attempts)])
+	}
+	return l
+}
+
+// debugProbesHandler serves the latest probe attempts as an HTML table, or
+// as JSON with format=json.
+func debugProbesHandler(w http.ResponseWriter, r *http.Request) {
+	attempts := probeAttempts.List()
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(attempts); err != nil {
+			slog.Warn("Failed to write to HTTP client", "err", err)
+		}
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString(`<html>
+    <head><title>iPerf3 Exporter probes</title></head>
+    <body>
+    <h1>Latest probes</h1>
+    <table>
+    <tr><th>Time</th><th>Target</th><th>Port</th><th>Duration</th><th>Exit code</th><th>Arguments</th><th>Error</th><th>Standard error</th></tr>
+`)
+	for _, a := range attempts {
+		b.WriteString("    <tr><td>" + a.Time.Format(time.RFC3339) + "</td><td>" + html.EscapeString(a.Target) + "</td><td>" + strconv.Itoa(a.Port) + "</td>")
+		b.WriteString("<td>" + strconv.FormatFloat(a.DurationSeconds, 'f', 3, 64) + "s</td><td>" + strconv.Itoa(a.ExitCode) + "</td>")
+		b.WriteString("<td><code>" + html.EscapeString(strings.Join(a.Args, " ")) + "</code></td><td>" + html.EscapeString(a.Error) + "</td>")
+		b.WriteString("<td><pre>" + html.EscapeString(a.Stderr) + "</pre></td></tr>\n")
+	}
+	b.WriteString("    </table>\n    </body>\n    </html>")
+
+	w.Header().Set("Content-Type", "text/html")
+	if _, err := w.Write([]byte(b.String())); err != nil {
+		slog.Warn("Failed to write to HTTP client", "err", err)
+	}
+}
+
+// probeTrace gathers what a probe with debug=true reports besides its
+// metrics: its logs and every run of the test client.
+type probeTrace struct {
+	start time.Time
+
+	mutex   sync.Mutex
+	logs    bytes.Buffer
+	command []string // of the run in progress, as traced by the runner
+	runs    []tracedRun
+}
+
+// tracedRun is a run of the test client during a traced probe.
+type tracedRun struct {
+	command  []string
+	offset   time.Duration // from the start of the probe
+	duration time.Duration
+	stdout   []byte
+	stderr   []byte
+	err      error
+}
+
+type traceKey struct{}
+
+func newProbeTrace() *probeTrace {
+	return &probeTrace{start: time.Now()}
+}
+
+// withTrace returns a copy of ctx carrying t, or ctx itself if t is nil.
+func withTrace(ctx context.Context, t *probeTrace) context.Context {
+	if t == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, traceKey{}, t)
+}
+
+func traceOf(ctx context.Context) *probeTrace {
+	t, _ := ctx.Value(traceKey{}).(*probeTrace)
+	return t
+}
+
+// traceCommand records the command line a runner is about to run for the
+// probe of ctx, if traced.
+func traceCommand(ctx context.Context, argv []string) {
+	if t := traceOf(ctx); t != nil {
+		t.mutex.Lock()
+		t.command = argv
+		t.mutex.Unlock()
+	}
+}
+
+// traceRun records the run of args started at start for the probe of ctx, if
+// traced. Runners that run no command, such as replays, only leave args.
+func traceRun(ctx context.Context, args []string, start time.Time, out []byte, err error) {
+	t := traceOf(ctx)
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	run := tracedRun{command: t.command, offset: start.Sub(t.start), duration: time.Since(start), stdout: out, err: err}
+	if run.command == nil {
+		run.command = args
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		run.stderr = exitErr.Stderr
+	}
+	t.runs = append(t.runs, run)
+	t.command = nil
+}
+
+// traceHandler passes the records of a traced probe to both the exporter log
+// and the trace, whatever the log level.
+type traceHandler struct {
+	log, trace slog.Handler
+}
+
+func (h traceHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	return h.log.Enabled(ctx, l) || h.trace.Enabled(ctx, l)
+}
+
+func (h traceHandler) Handle(ctx context.Context, r slog.Record) error {
+	if h.log.Enabled(ctx, r.Level) {
+		if err := h.log.Handle(ctx, r.Clone()); err != nil {
+			return err
+		}
+	}
+	return h.trace.Handle(ctx, r)
+}
+
+func (h traceHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return traceHandler{log: h.log.WithAttrs(attrs), trace: h.trace.WithAttrs(attrs)}
+}
+
+func (h traceHandler) WithGroup(name string) slog.Handler {
+	return traceHandler{log: h.log.WithGroup(name), trace: h.trace.WithGroup(name)}
+}
+
+// handler returns the log handler of the probe, writing its debug records to
+// the trace too.
+func (t *probeTrace) handler() slog.Handler {
+	return traceHandler{
+		log:   slog.Default().Handler(),
+		trace: slog.NewTextHandler(&traceWriter{t}, &slog.HandlerOptions{Level: slog.LevelDebug}),
+	}
+}
+
+// traceWriter appends to the logs of a trace.
+type traceWriter struct {
+	t *probeTrace
+}
+
+func (w *traceWriter) Write(p []byte) (int, error) {
+	w.t.mutex.Lock()
+	defer w.t.mutex.Unlock()
+	return w.t.logs.Write(p)
+}
+
+// writeDebug writes the plain text page of a probe with debug=true: its logs,
+// the runs of the test client, a timing breakdown and the metrics that would
+// have been returned.
+func writeDebug(w io.Writer, t *probeTrace, cacheStatus string, duration time.Duration, mfs []*dto.MetricFamily) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var b bytes.Buffer
+	b.WriteString("Logs for the probe:\n")
+	b.Write(t.logs.Bytes())
+
+	var running time.Duration
+	fmt.Fprintf(&b, "\nRuns of the test client (cache %s):\n", cacheStatus)
+	if len(t.runs) == 0 {
+		b.WriteString("None, the result was not produced by this probe.\n")
+	}
+	for i, r := range t.runs {
+		running += r.duration
+		exitCode := 0
+		if r.err != nil {
+			exitCode = -1
+			var exitErr *exec.ExitError
+			if errors.As(r.err, &exitErr) {
+				exitCode = exitErr.ExitCode()
+			}
+		}
+		fmt.Fprintf(&b, "\nRun %d, started at %.3fs, took %.3fs, exit code %d\n", i+1, r.offset.Seconds(), r.duration.Seconds(), exitCode)
+		b.WriteString("Command line: " + strings.Join(r.command, " ") + "\n")
+		if r.err != nil {
+			b.WriteString("Error: " + r.err.Error() + "\n")
+		}
+		b.WriteString("Standard output:\n")
+		b.Write(r.stdout)
+		b.WriteString("\nStandard error:\n")
+		b.Write(r.stderr)
+		b.WriteString("\n")
+	}
+
+	b.WriteString("\nTiming:\n")
+	fmt.Fprintf(&b, "Probe: %.3fs\n", duration.Seconds())
+	fmt.Fprintf(&b, "Test client: %.3fs\n", running.Seconds())
+	fmt.Fprintf(&b, "Other (admission, hooks, ping, connection check, collection): %.3fs\n", (duration - running).Seconds())
+
+	b.WriteString("\nMetrics that would have been returned:\n")
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(&b, mf); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
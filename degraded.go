@@ -0,0 +1,112 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/edgard/iperf3_exporter/internal/cache"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// seriesInterval is the interval between two counts of the series.
+	seriesInterval = 15 * time.Second
+
+	// probeSeriesWindow is how long the series of a probe configuration
+	// count once it is no longer probed.
+	probeSeriesWindow = 5 * time.Minute
+
+	// seriesRecovery is the share of --web.max-series under which the
+	// degraded mode ends, so that it does not flap around the threshold.
+	seriesRecovery = 0.9
+)
+
+var (
+	seriesCount  = prometheus.NewGauge(prometheus.GaugeOpts{Name: prometheus.BuildFQName(namespace, "exporter", "series"), Help: "Series exported on the metrics path and by the recent probes."})
+	degradedMode = prometheus.NewGauge(prometheus.GaugeOpts{Name: prometheus.BuildFQName(namespace, "exporter", "degraded_mode"), Help: "Whether probes only export summary series because the exporter has too many series."})
+
+	degraded int32
+
+	probeSeriesMutex sync.Mutex
+	probeSeries      = map[cache.Key]probeSeriesCount{}
+)
+
+type probeSeriesCount struct {
+	series int
+	time   time.Time
+}
+
+// isDegraded reports whether probes should leave out their detail series,
+// those of every stream or interval.
+func isDegraded() bool {
+	return atomic.LoadInt32(&degraded) == 1
+}
+
+// recordProbeSeries records the number of series of the latest probe of k.
+func recordProbeSeries(k cache.Key, series int) {
+	probeSeriesMutex.Lock()
+	defer probeSeriesMutex.Unlock()
+	probeSeries[k] = probeSeriesCount{series: series, time: time.Now()}
+}
+
+// countSeries returns the series of the default registry and those of the
+// latest probe of every configuration probed recently.
+func countSeries() (int, error) {
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, mf := range mfs {
+		n += len(mf.Metric)
+	}
+
+	probeSeriesMutex.Lock()
+	defer probeSeriesMutex.Unlock()
+	for k, c := range probeSeries {
+		if time.Since(c.time) > probeSeriesWindow {
+			delete(probeSeries, k)
+			continue
+		}
+		n += c.series
+	}
+	return n, nil
+}
+
+// monitorSeries counts the series every seriesInterval and switches to the
+// degraded mode above max series, until they are back under seriesRecovery
+// of max.
+func monitorSeries(max int) {
+	for range time.Tick(seriesInterval) {
+		n, err := countSeries()
+		if err != nil {
+			slog.Error("Failed to count the exported series", "err", err)
+			continue
+		}
+		seriesCount.Set(float64(n))
+		switch {
+		case !isDegraded() && n > max:
+			slog.Warn("Series above the limit, only exporting summaries", "series", n, "limit", max)
+			atomic.StoreInt32(&degraded, 1)
+		case isDegraded() && float64(n) < seriesRecovery*float64(max):
+			slog.Info("Series back under the limit, exporting details again", "series", n)
+			atomic.StoreInt32(&degraded, 0)
+		}
+		degradedMode.Set(boolToFloat(isDegraded()))
+	}
+}
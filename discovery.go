@@ -0,0 +1,114 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/edgard/iperf3_exporter/internal/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	discoveryErrors = prometheus.NewCounterVec(prometheus.CounterOpts{Name: prometheus.BuildFQName(namespace, "exporter", "discovery_errors_total"), Help: "Errors raised while discovering targets."}, []string{"mechanism"})
+)
+
+// discoverer finds targets outside of the configuration file.
+type discoverer interface {
+	Targets() []config.Target
+}
+
+// refreshFunc returns the current targets and, optionally, how long they stay
+// valid. A zero validity uses the refresh interval of the discoverer.
+type refreshFunc func(ctx context.Context) ([]config.Target, time.Duration, error)
+
+// refreshDiscoverer periodically refreshes its targets using fn. The last
+// known targets are kept when a refresh fails.
+type refreshDiscoverer struct {
+	mechanism string
+	interval  time.Duration
+	fn        refreshFunc
+
+	mutex   sync.RWMutex
+	targets []config.Target
+}
+
+func newRefreshDiscoverer(mechanism string, interval time.Duration, fn refreshFunc) *refreshDiscoverer {
+	return &refreshDiscoverer{mechanism: mechanism, interval: interval, fn: fn}
+}
+
+// Targets returns the last discovered targets.
+func (d *refreshDiscoverer) Targets() []config.Target {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.targets
+}
+
+// Run refreshes the targets until ctx is done.
+func (d *refreshDiscoverer) Run(ctx context.Context) {
+	for {
+		next := d.refresh(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(next):
+		}
+	}
+}
+
+// refresh updates the targets and returns the delay until the next refresh.
+func (d *refreshDiscoverer) refresh(ctx context.Context) time.Duration {
+	ctx, cancel := context.WithTimeout(ctx, d.interval)
+	defer cancel()
+
+	targets, validity, err := d.fn(ctx)
+	if err != nil {
+		discoveryErrors.WithLabelValues(d.mechanism).Inc()
+		slog.Error("Failed to refresh targets", "mechanism", d.mechanism, "err", err)
+		return d.interval
+	}
+
+	valid := targets[:0]
+	for _, t := range targets {
+		if err := config.CheckTarget("discovered target", t.Target); err != nil {
+			discoveryErrors.WithLabelValues(d.mechanism).Inc()
+			slog.Error("Ignoring a discovered target", "mechanism", d.mechanism, "err", err)
+			continue
+		}
+		valid = append(valid, t)
+	}
+
+	d.mutex.Lock()
+	d.targets = valid
+	d.mutex.Unlock()
+
+	if validity <= 0 {
+		return d.interval
+	}
+	return validity
+}
+
+// discoveredTargets returns the configured targets followed by the targets of
+// every discoverer.
+func discoveredTargets(c *config.Config, discoverers []discoverer) []config.Target {
+	targets := append([]config.Target{}, c.Targets...)
+	for _, d := range discoverers {
+		targets = append(targets, d.Targets()...)
+	}
+	return targets
+}
@@ -0,0 +1,157 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/edgard/iperf3_exporter/internal/config"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const resolvConf = "/etc/resolv.conf"
+
+// srvTargets expands the given SRV records into targets. The returned validity
+// is the lowest TTL of the records, or zero if it is unknown.
+func srvTargets(ctx context.Context, names []string) ([]config.Target, time.Duration, error) {
+	var (
+		targets  []config.Target
+		validity time.Duration
+	)
+	for _, name := range names {
+		srvs, ttl, err := lookupSRV(ctx, name)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to resolve %q: %s", name, err)
+		}
+		if ttl > 0 && (validity == 0 || ttl < validity) {
+			validity = ttl
+		}
+		for _, srv := range srvs {
+			targets = append(targets, config.Target{Target: strings.TrimSuffix(srv.Target, "."), Port: int(srv.Port)})
+		}
+	}
+	return targets, validity, nil
+}
+
+// lookupSRV resolves an SRV record with the nameservers of the system so that
+// the record TTL is known. It falls back to the Go resolver, which does not
+// report TTLs, when no nameserver answers.
+func lookupSRV(ctx context.Context, name string) ([]*net.SRV, time.Duration, error) {
+	for _, server := range nameservers(resolvConf) {
+		srvs, ttl, err := querySRV(ctx, server, name)
+		if err == nil {
+			return srvs, ttl, nil
+		}
+		slog.Debug("Failed to query the DNS server", "server", server, "name", name, "err", err)
+	}
+
+	_, srvs, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+	return srvs, 0, err
+}
+
+// nameservers returns the nameservers listed in a resolv.conf file.
+func nameservers(file string) []string {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var servers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers
+}
+
+// querySRV sends a single SRV query over UDP to a nameserver.
+func querySRV(ctx context.Context, server string, name string) ([]*net.SRV, time.Duration, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: uint16(rand.Uint32()), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: qname, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET}},
+	}
+	b, err := query.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", net.JoinHostPort(server, "53"))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return nil, 0, err
+		}
+	}
+	if _, err := conn.Write(b); err != nil {
+		return nil, 0, err
+	}
+	buf := make([]byte, 512)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var resp dnsmessage.Message
+	if err := resp.Unpack(buf[:n]); err != nil {
+		return nil, 0, err
+	}
+	switch {
+	case resp.ID != query.ID:
+		return nil, 0, errors.New("mismatched response ID")
+	case resp.Truncated:
+		return nil, 0, errors.New("truncated response")
+	case resp.RCode != dnsmessage.RCodeSuccess:
+		return nil, 0, fmt.Errorf("response code %s", resp.RCode)
+	}
+
+	var (
+		srvs []*net.SRV
+		ttl  time.Duration
+	)
+	for _, a := range resp.Answers {
+		srv, ok := a.Body.(*dnsmessage.SRVResource)
+		if !ok {
+			continue
+		}
+		srvs = append(srvs, &net.SRV{Target: srv.Target.String(), Port: srv.Port, Priority: srv.Priority, Weight: srv.Weight})
+		if recordTTL := time.Duration(a.Header.TTL) * time.Second; ttl == 0 || recordTTL < ttl {
+			ttl = recordTTL
+		}
+	}
+	return srvs, ttl, nil
+}
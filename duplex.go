@@ -0,0 +1,69 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"sync"
+
+	"github.com/edgard/iperf3_exporter/internal/cache"
+	"github.com/edgard/iperf3_exporter/internal/iperf"
+)
+
+// duplexMismatchRatio is the fraction of the unidirectional throughput below
+// which the best direction of a bidirectional test is a suspected duplex
+// mismatch. On a healthy full-duplex link both directions keep close to the
+// unidirectional throughput, and even a half-duplex link shares it, while a
+// duplex mismatch makes both directions collapse.
+const duplexMismatchRatio = 0.25
+
+var (
+	// unidirThroughputs are the received throughputs of the latest
+	// unidirectional tests, the baseline of the bidirectional tests.
+	unidirMutex       sync.Mutex
+	unidirThroughputs = map[cache.Key]float64{}
+)
+
+// throughput returns the received throughput of a sum, or zero if it has no
+// duration.
+func throughput(bytes, seconds float64) float64 {
+	if seconds == 0 {
+		return 0
+	}
+	return bytes / seconds
+}
+
+// recordUnidir records the throughput of a unidirectional test of k.
+func recordUnidir(k cache.Key, stats *iperf.Result) {
+	unidirMutex.Lock()
+	defer unidirMutex.Unlock()
+	unidirThroughputs[k] = throughput(stats.End.SumReceived.Bytes, stats.End.SumReceived.Seconds)
+}
+
+// suspectedDuplexMismatch compares a bidirectional test of k with the latest
+// unidirectional test of the same configuration. ok is false when there is no
+// unidirectional baseline yet.
+func suspectedDuplexMismatch(k cache.Key, stats *iperf.Result) (mismatch bool, ok bool) {
+	k.Bidir = false
+	unidirMutex.Lock()
+	baseline, ok := unidirThroughputs[k]
+	unidirMutex.Unlock()
+	if !ok || baseline == 0 {
+		return false, false
+	}
+
+	forward := throughput(stats.End.SumReceived.Bytes, stats.End.SumReceived.Seconds)
+	reverse := throughput(stats.End.SumReceivedBidirReverse.Bytes, stats.End.SumReceivedBidirReverse.Seconds)
+	return math.Max(forward, reverse) < duplexMismatchRatio*baseline, true
+}
@@ -0,0 +1,69 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/edgard/iperf3_exporter/internal/cache"
+)
+
+func TestSuspectedDuplexMismatch(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		baseline string
+		bidir    string
+		mismatch bool
+		ok       bool
+	}{
+		{
+			name:  "no baseline",
+			bidir: `{"end": {"sum_received": {"bytes": 1000, "seconds": 1}, "sum_received_bidir_reverse": {"bytes": 1000, "seconds": 1}}}`,
+		},
+		{
+			name:     "no traffic in the baseline",
+			baseline: `{"end": {"sum_received": {"bytes": 0, "seconds": 1}}}`,
+			bidir:    `{"end": {"sum_received": {"bytes": 1000, "seconds": 1}, "sum_received_bidir_reverse": {"bytes": 1000, "seconds": 1}}}`,
+		},
+		{
+			name:     "full duplex",
+			baseline: `{"end": {"sum_received": {"bytes": 1000, "seconds": 1}}}`,
+			bidir:    `{"end": {"sum_received": {"bytes": 950, "seconds": 1}, "sum_received_bidir_reverse": {"bytes": 900, "seconds": 1}}}`,
+			ok:       true,
+		},
+		{
+			name:     "half duplex",
+			baseline: `{"end": {"sum_received": {"bytes": 1000, "seconds": 1}}}`,
+			bidir:    `{"end": {"sum_received": {"bytes": 100, "seconds": 1}, "sum_received_bidir_reverse": {"bytes": 500, "seconds": 1}}}`,
+			ok:       true,
+		},
+		{
+			name:     "collapsed",
+			baseline: `{"end": {"sum_received": {"bytes": 1000, "seconds": 1}}}`,
+			bidir:    `{"end": {"sum_received": {"bytes": 100, "seconds": 1}, "sum_received_bidir_reverse": {"bytes": 200, "seconds": 1}}}`,
+			mismatch: true,
+			ok:       true,
+		},
+	} {
+		k := cache.Key{Target: tc.name, Port: 5201}
+		if tc.baseline != "" {
+			recordUnidir(k, testResult(t, tc.baseline))
+		}
+		k.Bidir = true
+		mismatch, ok := suspectedDuplexMismatch(k, testResult(t, tc.bidir))
+		if mismatch != tc.mismatch || ok != tc.ok {
+			t.Errorf("%s: got %t, %t, want %t, %t", tc.name, mismatch, ok, tc.mismatch, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/edgard/iperf3_exporter/internal/iperf"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var iperfFailures = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(namespace, "", "failure_total"),
+		Help: "Failed iperf3 tests by reason.",
+	},
+	[]string{"reason"},
+)
+
+func init() {
+	// Every reason is exported from the start, so that alerts on increases
+	// work for the first failure too.
+	for _, reason := range iperf.FailureReasons {
+		iperfFailures.WithLabelValues(reason)
+	}
+}
+
+// testError is a failed test with the reason of the failure.
+type testError struct {
+	reason string
+	err    error
+}
+
+func (e *testError) Error() string {
+	return e.err.Error()
+}
+
+// errorReason returns the failure reason of err, empty without error.
+func errorReason(err error) string {
+	if err == nil {
+		return ""
+	}
+	if e, ok := err.(*testError); ok {
+		return e.reason
+	}
+	return "other"
+}
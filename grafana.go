@@ -0,0 +1,112 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/edgard/iperf3_exporter/internal/cache"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// annotationTimeout bounds the Grafana API calls, which run in the background
+// of the probes.
+const annotationTimeout = 10 * time.Second
+
+var annotationErrors = prometheus.NewCounter(prometheus.CounterOpts{Name: prometheus.BuildFQName(namespace, "exporter", "grafana_annotation_errors_total"), Help: "Errors creating Grafana annotations."})
+
+var (
+	// probeStates are the outcomes of the latest tests, so that only changes
+	// are annotated rather than every failing scrape.
+	probeStatesMutex sync.Mutex
+	probeStates      = map[cache.Key]bool{}
+)
+
+// grafanaAnnotation is the body of the Grafana annotations API.
+type grafanaAnnotation struct {
+	Time int64    `json:"time"`
+	Tags []string `json:"tags"`
+	Text string   `json:"text"`
+}
+
+// annotate creates a Grafana annotation in the background, if Grafana is
+// configured. The target and event are added to the configured tags.
+func annotate(target string, event string, text string) {
+	if *grafanaURL == "" {
+		return
+	}
+	a := grafanaAnnotation{
+		Time: time.Now().UnixNano() / int64(time.Millisecond),
+		Tags: append(append([]string{}, *grafanaTags...), "target:"+target, "event:"+event),
+		Text: text,
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), annotationTimeout)
+		defer cancel()
+		if err := postAnnotation(ctx, a); err != nil {
+			annotationErrors.Inc()
+			slog.Error("Failed to create Grafana annotation", "err", err)
+		}
+	}()
+}
+
+func postAnnotation(ctx context.Context, a grafanaAnnotation) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(*grafanaURL, "/")+"/api/annotations", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if *grafanaAPIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+*grafanaAPIKey)
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
+// annotateOutcome annotates the failures and recoveries of the tests of k.
+func annotateOutcome(k cache.Key, err error) {
+	if *grafanaURL == "" {
+		return
+	}
+	probeStatesMutex.Lock()
+	ok, known := probeStates[k]
+	probeStates[k] = err == nil
+	probeStatesMutex.Unlock()
+
+	switch {
+	case err != nil && (ok || !known):
+		annotate(k.Target, "failure", fmt.Sprintf("iperf3 test to %s:%d failed: %s", k.Target, k.Port, err))
+	case err == nil && known && !ok:
+		annotate(k.Target, "recovery", fmt.Sprintf("iperf3 test to %s:%d succeeded again", k.Target, k.Port))
+	}
+}
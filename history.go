@@ -0,0 +1,215 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/edgard/iperf3_exporter/internal/config"
+	"github.com/edgard/iperf3_exporter/internal/iperf"
+	"github.com/prometheus/client_golang/prometheus"
+
+	// The pure Go driver keeps the releases free of cgo.
+	_ "modernc.org/sqlite"
+)
+
+// historyPruneInterval is the interval between removals of the results older
+// than the history retention.
+const historyPruneInterval = time.Hour
+
+var historyErrors = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: prometheus.BuildFQName(namespace, "exporter", "history_errors_total"),
+	Help: "Errors storing, pruning or querying the result history.",
+})
+
+const historySchema = `CREATE TABLE IF NOT EXISTS results (
+	time INTEGER NOT NULL,
+	target TEXT NOT NULL,
+	port INTEGER NOT NULL,
+	success INTEGER NOT NULL,
+	sent_bits_per_second REAL,
+	received_bits_per_second REAL,
+	retransmits REAL
+);
+CREATE INDEX IF NOT EXISTS results_target_time ON results (target, time);`
+
+// historyResult is a stored test result.
+type historyResult struct {
+	Time                  time.Time `json:"time"`
+	Port                  int       `json:"port"`
+	Success               bool      `json:"success"`
+	SentBitsPerSecond     *float64  `json:"sent_bits_per_second,omitempty"`
+	ReceivedBitsPerSecond *float64  `json:"received_bits_per_second,omitempty"`
+	Retransmits           *float64  `json:"retransmits,omitempty"`
+}
+
+// resultHistory stores the results of the tests run by the probes in a
+// SQLite database, for longer than the Prometheus retention.
+type resultHistory struct {
+	db        *sql.DB
+	retention time.Duration
+}
+
+// history is the store of --history.file, nil if disabled.
+var history *resultHistory
+
+// openHistory opens the SQLite database at path, creating it if needed.
+func openHistory(path string, retention time.Duration) (*resultHistory, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only has a single writer at once.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(historySchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create the history schema: %s", err)
+	}
+	return &resultHistory{db: db, retention: retention}, nil
+}
+
+// Record stores the outcome of a test of target and port, either its result
+// stats or its failure err.
+func (h *resultHistory) Record(target string, port int, stats *iperf.Result, err error) {
+	if h == nil {
+		return
+	}
+	var sent, received, retransmits interface{}
+	if err == nil && stats != nil {
+		sent = throughput(stats.End.SumSent.Bytes, stats.End.SumSent.Seconds) * 8
+		received = throughput(stats.End.SumReceived.Bytes, stats.End.SumReceived.Seconds) * 8
+		retransmits = stats.End.SumSent.Retransmits
+	}
+	_, dbErr := h.db.Exec("INSERT INTO results (time, target, port, success, sent_bits_per_second, received_bits_per_second, retransmits) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		time.Now().UnixMilli(), config.RedactTarget(target), port, err == nil, sent, received, retransmits)
+	if dbErr != nil {
+		historyErrors.Inc()
+		slog.Error("Failed to store the result in the history", "err", dbErr)
+	}
+}
+
+// Query returns the results of target, on port if non-zero, from since to
+// until, oldest first.
+func (h *resultHistory) Query(ctx context.Context, target string, port int, since, until time.Time) ([]historyResult, error) {
+	rows, err := h.db.QueryContext(ctx, "SELECT time, port, success, sent_bits_per_second, received_bits_per_second, retransmits FROM results WHERE target = ? AND (? = 0 OR port = ?) AND time >= ? AND time <= ? ORDER BY time",
+		target, port, port, since.UnixMilli(), until.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []historyResult{}
+	for rows.Next() {
+		var (
+			r  historyResult
+			ms int64
+		)
+		if err := rows.Scan(&ms, &r.Port, &r.Success, &r.SentBitsPerSecond, &r.ReceivedBitsPerSecond, &r.Retransmits); err != nil {
+			return nil, err
+		}
+		r.Time = time.UnixMilli(ms).UTC()
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
+
+// Run removes the results older than the retention every prune interval,
+// until ctx is done.
+func (h *resultHistory) Run(ctx context.Context) {
+	for {
+		cutoff := time.Now().Add(-h.retention).UnixMilli()
+		if res, err := h.db.ExecContext(ctx, "DELETE FROM results WHERE time < ?", cutoff); err != nil {
+			if ctx.Err() == nil {
+				historyErrors.Inc()
+				slog.Error("Failed to prune the history", "err", err)
+			}
+		} else if n, _ := res.RowsAffected(); n > 0 {
+			slog.Debug("Pruned the history", "results", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(historyPruneInterval):
+		}
+	}
+}
+
+// parseHistoryTime parses an RFC 3339 or Unix timestamp, like the Prometheus
+// HTTP API.
+func parseHistoryTime(s string) (time.Time, error) {
+	if t, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, frac := math.Modf(t)
+		return time.Unix(int64(sec), int64(frac*1e9)), nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+// historyHandler serves the stored results of the target parameter between
+// the since and until parameters, the last 24 hours by default.
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	if history == nil {
+		http.Error(w, "The result history is disabled, see --history.file", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	target := q.Get("target")
+	if target == "" {
+		http.Error(w, "'target' parameter must be specified", http.StatusBadRequest)
+		return
+	}
+	var port int
+	if v := q.Get("port"); v != "" {
+		var err error
+		if port, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "'port' parameter must be an integer: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	until := time.Now()
+	if v := q.Get("until"); v != "" {
+		var err error
+		if until, err = parseHistoryTime(v); err != nil {
+			http.Error(w, "'until' parameter must be an RFC 3339 or Unix timestamp: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	since := until.Add(-24 * time.Hour)
+	if v := q.Get("since"); v != "" {
+		var err error
+		if since, err = parseHistoryTime(v); err != nil {
+			http.Error(w, "'since' parameter must be an RFC 3339 or Unix timestamp: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	results, err := history.Query(r.Context(), target, port, since, until)
+	if err != nil {
+		historyErrors.Inc()
+		http.Error(w, fmt.Sprintf("Failed to query the history: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"target": target, "results": results}); err != nil {
+		slog.Warn("Failed to write to HTTP client", "err", err)
+	}
+}
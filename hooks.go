@@ -0,0 +1,68 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/edgard/iperf3_exporter/internal/config"
+)
+
+const (
+	defaultHookTimeout = 10 * time.Second
+
+	// maxHookOutput is the number of bytes of hook output kept for reporting.
+	maxHookOutput = 4096
+)
+
+// hookResult is the outcome of a hook command.
+type hookResult struct {
+	output   string
+	duration time.Duration
+	err      error
+}
+
+// runHook runs a hook command for a probe of o. The target and port are passed
+// to the command in the IPERF3_TARGET and IPERF3_PORT environment variables.
+func runHook(ctx context.Context, h *config.Hook, o iperfOptions) hookResult {
+	t := time.Duration(h.Timeout)
+	if t == 0 {
+		t = defaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, t)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+	cmd.Env = append(os.Environ(), "IPERF3_TARGET="+o.target, "IPERF3_PORT="+strconv.Itoa(o.port))
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	// Children that escaped the process group of the hook with its output
+	// still open do not hold the probe once the hook exited.
+	cmd.WaitDelay = time.Second
+
+	start := time.Now()
+	// The commands started by a shell hook are killed along with it on
+	// timeout.
+	err := runKillable(ctx, cmd)
+	output := out.Bytes()
+	if len(output) > maxHookOutput {
+		output = output[:maxHookOutput]
+	}
+	return hookResult{output: string(output), duration: time.Since(start), err: err}
+}
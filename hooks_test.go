@@ -0,0 +1,59 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/edgard/iperf3_exporter/internal/config"
+)
+
+func TestRunHook(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skipf("No shell: %s", err)
+	}
+	o := iperfOptions{target: "a.example.com", port: 5202}
+	for _, tc := range []struct {
+		name    string
+		command string
+		output  string
+		failed  bool
+	}{
+		{"success", `echo "$IPERF3_TARGET:$IPERF3_PORT"; echo warning >&2`, "a.example.com:5202\nwarning\n", false},
+		{"failure", "echo refused; exit 3", "refused\n", true},
+		// The background command keeps the output of the hook open, and
+		// only dies with its process group.
+		{"timeout", "echo started; sleep 30 & sleep 30", "started\n", true},
+	} {
+		start := time.Now()
+		r := runHook(context.Background(), &config.Hook{Command: []string{"sh", "-c", tc.command}, Timeout: model.Duration(500 * time.Millisecond)}, o)
+		if (r.err != nil) != tc.failed || r.output != tc.output {
+			t.Errorf("%s: got %q, %v", tc.name, r.output, r.err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("%s: took %s", tc.name, elapsed)
+		}
+	}
+
+	r := runHook(context.Background(), &config.Hook{Command: []string{"sh", "-c", "head -c 10000 /dev/zero"}}, o)
+	if r.err != nil || len(r.output) != maxHookOutput || strings.Trim(r.output, "\x00") != "" {
+		t.Errorf("got %d bytes of output, %v, want %d", len(r.output), r.err, maxHookOutput)
+	}
+}
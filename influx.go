@@ -0,0 +1,252 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/edgard/iperf3_exporter/internal/config"
+	"github.com/edgard/iperf3_exporter/internal/iperf"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/common/version"
+)
+
+const (
+	// influxQueueSize is the number of results waiting to be written, past
+	// which new results are dropped.
+	influxQueueSize = 1000
+
+	// influxTimeout bounds every write.
+	influxTimeout = 10 * time.Second
+)
+
+var influxErrors = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: prometheus.BuildFQName(namespace, "exporter", "influx_errors_total"),
+	Help: "Probe results that could not be written in InfluxDB line protocol.",
+})
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `)
+	influxTagEscaper         = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `)
+	influxStringEscaper      = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+// influxOutput writes the result of every test as a line of InfluxDB line
+// protocol to an InfluxDB write endpoint or a socket, e.g. that of a Telegraf
+// socket_listener. Lines are queued and written in batches, so that a slow
+// endpoint does not hold up the probes.
+type influxOutput struct {
+	url         *url.URL
+	token       string
+	measurement string
+	queue       chan string
+
+	client *http.Client
+	conn   net.Conn
+}
+
+// influx is the output of --influx.url, nil if disabled.
+var influx *influxOutput
+
+// newInfluxOutput returns the output to rawURL, an http(s), udp, tcp or unix
+// URL. The token, if any, is read from tokenFile.
+func newInfluxOutput(rawURL, tokenFile, measurement string) (*influxOutput, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+	case "udp", "tcp":
+		if u.Host == "" {
+			return nil, fmt.Errorf("missing address in %q", rawURL)
+		}
+	case "unix":
+		if u.Path == "" {
+			return nil, fmt.Errorf("missing socket path in %q", rawURL)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q, must be http, https, udp, tcp or unix", u.Scheme)
+	}
+	o := &influxOutput{
+		url:         u,
+		measurement: measurement,
+		queue:       make(chan string, influxQueueSize),
+		client:      &http.Client{Timeout: influxTimeout},
+	}
+	if tokenFile != "" {
+		b, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		o.token = strings.TrimSpace(string(b))
+	}
+	return o, nil
+}
+
+// Record queues the outcome of a test of target and port, either its result
+// stats or its failure err. The tags of the line are the target, port and
+// module of the probe, and the labels of the configured target, if any.
+func (o *influxOutput) Record(t *config.Target, target string, port int, module string, stats *iperf.Result, err error) {
+	if o == nil {
+		return
+	}
+	tags := map[string]string{"target": config.RedactTarget(target), "port": strconv.Itoa(port)}
+	if module != "" {
+		tags["module"] = module
+	}
+	if t != nil {
+		for name, value := range t.Labels {
+			if _, ok := tags[name]; !ok && !strings.HasPrefix(name, model.ReservedLabelPrefix) {
+				tags[name] = value
+			}
+		}
+	}
+	fields := []string{"success=" + strconv.FormatBool(err == nil)}
+	if err != nil {
+		fields = append(fields, `failure_reason="`+influxStringEscaper.Replace(errorReason(err))+`"`)
+	} else if stats != nil {
+		fields = append(fields,
+			"sent_bytes="+formatFloat(stats.End.SumSent.Bytes),
+			"sent_seconds="+formatFloat(stats.End.SumSent.Seconds),
+			"received_bytes="+formatFloat(stats.End.SumReceived.Bytes),
+			"received_seconds="+formatFloat(stats.End.SumReceived.Seconds),
+			"sent_bits_per_second="+formatFloat(throughput(stats.End.SumSent.Bytes, stats.End.SumSent.Seconds)*8),
+			"received_bits_per_second="+formatFloat(throughput(stats.End.SumReceived.Bytes, stats.End.SumReceived.Seconds)*8),
+			"retransmits="+formatFloat(stats.End.SumSent.Retransmits),
+		)
+	}
+	line := influxLine(o.measurement, tags, fields, time.Now())
+
+	select {
+	case o.queue <- line:
+	default:
+		influxErrors.Inc()
+		slog.Warn("Dropped a result, the InfluxDB output is falling behind", "url", o.url.Redacted())
+	}
+}
+
+// influxLine formats a line of line protocol, with the tags sorted by key.
+func influxLine(measurement string, tags map[string]string, fields []string, t time.Time) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(influxMeasurementEscaper.Replace(measurement))
+	for _, k := range keys {
+		if tags[k] == "" {
+			// Line protocol has no empty tag values.
+			continue
+		}
+		b.WriteString("," + influxTagEscaper.Replace(k) + "=" + influxTagEscaper.Replace(tags[k]))
+	}
+	b.WriteString(" " + strings.Join(fields, ",") + " " + strconv.FormatInt(t.UnixNano(), 10) + "\n")
+	return b.String()
+}
+
+// Run writes the queued lines until ctx is done, batching those queued while
+// the previous batch was written.
+func (o *influxOutput) Run(ctx context.Context) {
+	for {
+		var batch []string
+		select {
+		case <-ctx.Done():
+			return
+		case line := <-o.queue:
+			batch = append(batch, line)
+		}
+	collect:
+		for {
+			select {
+			case line := <-o.queue:
+				batch = append(batch, line)
+			default:
+				break collect
+			}
+		}
+		if err := o.write(ctx, batch); err != nil {
+			influxErrors.Add(float64(len(batch)))
+			slog.Error("Failed to write the results in InfluxDB line protocol", "url", o.url.Redacted(), "err", err)
+		}
+	}
+}
+
+func (o *influxOutput) write(ctx context.Context, lines []string) error {
+	if o.url.Scheme == "http" || o.url.Scheme == "https" {
+		return o.post(ctx, strings.Join(lines, ""))
+	}
+	if o.conn == nil {
+		address := o.url.Host
+		if o.url.Scheme == "unix" {
+			address = o.url.Path
+		}
+		d := net.Dialer{Timeout: influxTimeout}
+		conn, err := d.DialContext(ctx, o.url.Scheme, address)
+		if err != nil {
+			return err
+		}
+		o.conn = conn
+	}
+	o.conn.SetWriteDeadline(time.Now().Add(influxTimeout))
+	// A datagram carries whole lines, one at a time to stay below the
+	// datagram size limit.
+	for _, line := range lines {
+		if _, err := io.WriteString(o.conn, line); err != nil {
+			// The connection is dialed again for the next batch.
+			o.conn.Close()
+			o.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *influxOutput) post(ctx context.Context, body string) error {
+	req, err := http.NewRequest(http.MethodPost, o.url.String(), bytes.NewBufferString(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("User-Agent", "iperf3_exporter/"+version.Version)
+	if o.token != "" {
+		req.Header.Set("Authorization", "Token "+o.token)
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
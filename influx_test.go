@@ -0,0 +1,64 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInfluxLine(t *testing.T) {
+	at := time.Unix(1700000000, 5)
+	for _, tc := range []struct {
+		measurement string
+		tags        map[string]string
+		fields      []string
+		want        string
+	}{
+		{
+			measurement: "iperf3",
+			tags:        map[string]string{"target": "a.example.com", "port": "5201"},
+			fields:      []string{"success=1"},
+			want:        "iperf3,port=5201,target=a.example.com success=1 1700000000000000005\n",
+		},
+		{
+			measurement: "iperf 3,tests",
+			tags:        map[string]string{"site name": "a=b,c", "module": ""},
+			fields:      []string{"success=0", `failure_reason="timeout"`},
+			want:        `iperf\ 3\,tests,site\ name=a\=b\,c success=0,failure_reason="timeout" 1700000000000000005` + "\n",
+		},
+		{
+			measurement: "iperf=3",
+			fields:      []string{"success=1"},
+			want:        "iperf=3 success=1 1700000000000000005\n",
+		},
+	} {
+		if got := influxLine(tc.measurement, tc.tags, tc.fields, at); got != tc.want {
+			t.Errorf("got %q, want %q", got, tc.want)
+		}
+	}
+}
+
+func TestInfluxStringEscaper(t *testing.T) {
+	for in, want := range map[string]string{
+		`refused`:   `refused`,
+		`say "hi"`:  `say \"hi\"`,
+		`C:\iperf3`: `C:\\iperf3`,
+		`\"`:        `\\\"`,
+	} {
+		if got := influxStringEscaper.Replace(in); got != want {
+			t.Errorf("%q: got %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package integration runs end-to-end checks of the exporter against real
+// iperf3 servers started as local processes or Docker containers, with the
+// integration build tag:
+//
+//	go test -tags integration ./integration -args -iperf3=iperf3
+//	go test -tags integration ./integration -args -docker-image=networkstatic/iperf3
+package integration
@@ -0,0 +1,270 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build integration
+// +build integration
+
+package integration
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+var (
+	iperfBinary = flag.String("iperf3", "iperf3", "iperf3 binary used by the servers and the exporter.")
+	dockerImage = flag.String("docker-image", "", "Docker image running the iperf3 servers instead of local processes, e.g. networkstatic/iperf3.")
+	exporterBin = flag.String("exporter", "", "Exporter binary (built from the current tree if empty).")
+)
+
+// harness holds the iperf3 servers and the exporter of a test.
+type harness struct {
+	t        *testing.T
+	exporter string
+	ports    []int
+}
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %s", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func waitPort(port int) error {
+	for i := 0; i < 50; i++ {
+		c, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+		if err == nil {
+			c.Close()
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("port %d not listening", port)
+}
+
+// newHarness builds the exporter, unless -exporter is set, and starts two
+// iperf3 servers.
+func newHarness(t *testing.T) *harness {
+	if _, err := exec.LookPath(*iperfBinary); err != nil {
+		t.Skipf("No iperf3 binary: %s", err)
+	}
+	h := &harness{t: t, exporter: *exporterBin}
+	if h.exporter == "" {
+		h.exporter = filepath.Join(t.TempDir(), "iperf3_exporter")
+		build := exec.Command("go", "build", "-o", h.exporter, "..")
+		build.Stdout, build.Stderr = os.Stderr, os.Stderr
+		if err := build.Run(); err != nil {
+			t.Fatalf("Failed to build the exporter: %s", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		h.startServer()
+	}
+	return h
+}
+
+func (h *harness) start(name string, args ...string) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Start(); err != nil {
+		h.t.Fatalf("Failed to start %s: %s", name, err)
+	}
+	h.t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+}
+
+// startServer starts an iperf3 server on a free port.
+func (h *harness) startServer() {
+	port := freePort(h.t)
+	if *dockerImage != "" {
+		name := fmt.Sprintf("iperf3-exporter-integration-%d", port)
+		h.t.Cleanup(func() { exec.Command("docker", "rm", "-f", name).Run() })
+		// UDP tests send their datagrams to the port of the control
+		// connection.
+		h.start("docker", "run", "--rm", "--name", name, "-p", fmt.Sprintf("127.0.0.1:%d:5201", port), "-p", fmt.Sprintf("127.0.0.1:%d:5201/udp", port), *dockerImage, "-s")
+	} else {
+		h.start(*iperfBinary, "-s", "-p", strconv.Itoa(port))
+	}
+	if err := waitPort(port); err != nil {
+		h.t.Fatalf("Failed to start an iperf3 server: %s", err)
+	}
+	h.ports = append(h.ports, port)
+}
+
+// startExporter starts the exporter and returns its base URL.
+func (h *harness) startExporter(args ...string) string {
+	port := freePort(h.t)
+	args = append([]string{"--web.listen-address=127.0.0.1:" + strconv.Itoa(port), "--iperf3.path=" + *iperfBinary}, args...)
+	h.start(h.exporter, args...)
+	if err := waitPort(port); err != nil {
+		h.t.Fatalf("Failed to start the exporter: %s", err)
+	}
+	return "http://127.0.0.1:" + strconv.Itoa(port)
+}
+
+// scrape fetches url and parses the metrics, with the Prometheus timeout
+// header when timeout is not zero.
+func scrape(t *testing.T, url string, timeout time.Duration) map[string]*dto.MetricFamily {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatalf("NewRequest: %s", err)
+	}
+	if timeout != 0 {
+		req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", strconv.FormatFloat(timeout.Seconds(), 'f', -1, 64))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s: %s", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		t.Fatalf("GET %s: %s: %s", url, resp.Status, body)
+	}
+	var parser expfmt.TextParser
+	mfs, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to parse the metrics of %s: %s", url, err)
+	}
+	return mfs
+}
+
+// value returns the value of the first sample of name whose labels include
+// the given name/value pairs, or -1 if there is none.
+func value(mfs map[string]*dto.MetricFamily, name string, labels ...string) float64 {
+	mf, ok := mfs[name]
+	if !ok {
+		return -1
+	}
+next:
+	for _, m := range mf.Metric {
+		for i := 0; i+1 < len(labels); i += 2 {
+			found := false
+			for _, l := range m.Label {
+				if l.GetName() == labels[i] && l.GetValue() == labels[i+1] {
+					found = true
+				}
+			}
+			if !found {
+				continue next
+			}
+		}
+		switch {
+		case m.Gauge != nil:
+			return m.Gauge.GetValue()
+		case m.Counter != nil:
+			return m.Counter.GetValue()
+		case m.Untyped != nil:
+			return m.Untyped.GetValue()
+		}
+	}
+	return -1
+}
+
+func expect(t *testing.T, mfs map[string]*dto.MetricFamily, name string, ok func(float64) bool, labels ...string) {
+	t.Helper()
+	if v := value(mfs, name, labels...); !ok(v) {
+		t.Errorf("unexpected %s%v: %v", name, labels, v)
+	}
+}
+
+func positive(v float64) bool { return v > 0 }
+
+func equals(x float64) func(float64) bool { return func(v float64) bool { return v == x } }
+
+func TestProbe(t *testing.T) {
+	h := newHarness(t)
+	base := h.startExporter("--cache.ttl=1m")
+	probe := func(params ...string) string {
+		return base + "/probe?target=127.0.0.1&period=2s&" + strings.Join(params, "&")
+	}
+	port := func(i int) string { return "port=" + strconv.Itoa(h.ports[i]) }
+
+	// The cache subtests rely on the result of the tcp one.
+	t.Run("tcp", func(t *testing.T) {
+		mfs := scrape(t, probe(port(0)), 0)
+		expect(t, mfs, "iperf3_success", equals(1))
+		expect(t, mfs, "iperf3_received_bytes", positive, "side", "client")
+		expect(t, mfs, "iperf3_client_sender", equals(1))
+	})
+	t.Run("udp", func(t *testing.T) {
+		mfs := scrape(t, probe(port(0), "udp=true"), 0)
+		expect(t, mfs, "iperf3_success", equals(1))
+		expect(t, mfs, "iperf3_received_bytes", positive, "side", "client")
+	})
+	t.Run("reverse", func(t *testing.T) {
+		mfs := scrape(t, probe(port(1), "reverse=true"), 0)
+		expect(t, mfs, "iperf3_success", equals(1))
+		expect(t, mfs, "iperf3_received_bytes", positive, "side", "client")
+		expect(t, mfs, "iperf3_client_sender", equals(0))
+	})
+	t.Run("second server port", func(t *testing.T) {
+		mfs := scrape(t, probe(port(1)), 0)
+		expect(t, mfs, "iperf3_success", equals(1), "port", strconv.Itoa(h.ports[1]))
+	})
+	t.Run("parallel streams", func(t *testing.T) {
+		mfs := scrape(t, probe(port(0), "thread=2", "cache=false"), 0)
+		expect(t, mfs, "iperf3_streams", equals(2))
+	})
+	t.Run("bidirectional", func(t *testing.T) {
+		mfs := scrape(t, probe(port(1), "bidir=true"), 0)
+		expect(t, mfs, "iperf3_success", equals(1))
+		expect(t, mfs, "iperf3_reverse_received_bytes", positive)
+	})
+	t.Run("period trimmed to the scrape timeout", func(t *testing.T) {
+		mfs := scrape(t, base+"/probe?target=127.0.0.1&period=10s&"+port(0), 4*time.Second)
+		expect(t, mfs, "iperf3_period_seconds", equals(2))
+	})
+	t.Run("unreachable server", func(t *testing.T) {
+		mfs := scrape(t, base+"/probe?target=127.0.0.1&port="+strconv.Itoa(freePort(t)), 5*time.Second)
+		expect(t, mfs, "iperf3_success", equals(0))
+	})
+	t.Run("cache", func(t *testing.T) {
+		before := scrape(t, base+"/metrics", 0)
+		scrape(t, probe(port(0)), 0)
+		after := scrape(t, base+"/metrics", 0)
+		if value(after, "iperf3_exporter_cache_hits_total") <= value(before, "iperf3_exporter_cache_hits_total") {
+			t.Error("probe not served from the cache")
+		}
+		if value(after, "iperf3_exporter_tests_total") != value(before, "iperf3_exporter_tests_total") {
+			t.Error("cached probe ran a test")
+		}
+	})
+	t.Run("cache bypass", func(t *testing.T) {
+		before := scrape(t, base+"/metrics", 0)
+		scrape(t, probe(port(0), "cache=false"), 0)
+		after := scrape(t, base+"/metrics", 0)
+		if value(after, "iperf3_exporter_tests_total") != value(before, "iperf3_exporter_tests_total")+1 {
+			t.Error("cache=false did not run a test")
+		}
+	})
+}
@@ -0,0 +1,104 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// backoffState is the failure streak of a test configuration.
+type backoffState struct {
+	failures int
+	until    time.Time
+	last     Outcome
+}
+
+// Backoff remembers failed tests for an exponentially growing window, from
+// initial up to max, so that a target that is down does not stall every scrape
+// for a full timeout. It is safe for concurrent use.
+type Backoff struct {
+	initial time.Duration
+	max     time.Duration
+
+	mutex  sync.Mutex
+	states map[Key]*backoffState
+}
+
+// NewBackoff returns a backoff, disabled if initial is zero.
+func NewBackoff(initial time.Duration, max time.Duration) *Backoff {
+	return &Backoff{initial: initial, max: max, states: map[Key]*backoffState{}}
+}
+
+// Active returns the outcome of the latest failed test of k while k is backed
+// off.
+func (b *Backoff) Active(k Key) (Outcome, bool) {
+	if b.initial == 0 {
+		return Outcome{}, false
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	s, ok := b.states[k]
+	if !ok || time.Now().After(s.until) {
+		return Outcome{}, false
+	}
+	return s.last, true
+}
+
+// Record updates the failure streak of k with the outcome of a test. A
+// success ends the streak and every failure doubles the window.
+func (b *Backoff) Record(k Key, outcome Outcome) {
+	if b.initial == 0 {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if outcome.OK {
+		delete(b.states, k)
+		return
+	}
+	s, ok := b.states[k]
+	if !ok {
+		s = &backoffState{}
+		b.states[k] = s
+	}
+	window := b.initial << uint(s.failures)
+	if window > b.max || window <= 0 {
+		window = b.max
+	}
+	s.failures++
+	s.until = outcome.Time.Add(window)
+	s.last = outcome
+
+	// Configurations that are not tested anymore are forgotten once their
+	// longest window is over.
+	for k, s := range b.states {
+		if outcome.Time.Sub(s.until) > b.max {
+			delete(b.states, k)
+		}
+	}
+}
+
+// Reset ends the failure streaks of target, or of every target if target is
+// empty.
+func (b *Backoff) Reset(target string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for k := range b.states {
+		if target == "" || k.Target == target {
+			delete(b.states, k)
+		}
+	}
+}
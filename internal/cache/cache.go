@@ -0,0 +1,329 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cache holds the results of recent iperf3 tests, so that scrapes in
+// quick succession share a test instead of running one each.
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/edgard/iperf3_exporter/internal/iperf"
+)
+
+// Key identifies a test configuration. Every probe parameter that changes the
+// test itself is part of the key, so that probes of the same target with
+// different settings never share results.
+type Key struct {
+	Target       string
+	Port         int
+	Period       time.Duration
+	Threads      int
+	FlowLabel    int
+	ServerOutput bool
+	Bidir        bool
+	UDP          bool
+	Reverse      bool
+	Module       string
+	NetNS        string
+}
+
+// Outcome is the outcome of the latest test of a configuration, with the
+// reason of its failure.
+type Outcome struct {
+	OK     bool
+	Time   time.Time
+	Reason string
+}
+
+// Entry is the latest successful result of a configuration, and the outcome
+// of its latest test, which may have failed since.
+type Entry struct {
+	Key    Key
+	Result *iperf.Result
+	Time   time.Time
+	Last   Outcome
+}
+
+// Stats are the number of lookups of a cache by their outcome.
+type Stats struct {
+	// Hits are the lookups served a cached result or the result of a test
+	// already in progress, StaleHits those of them served a stale result.
+	Hits      uint64
+	StaleHits uint64
+
+	// Misses are the lookups that ran a test.
+	Misses uint64
+}
+
+// sweepInterval is the minimum interval between two sweeps of the expired
+// results.
+const sweepInterval = time.Minute
+
+// call is a test in progress for a key.
+type call struct {
+	done    chan struct{}
+	result  *iperf.Result
+	outcome Outcome
+}
+
+// Cache holds the successful results of recent tests. It is safe for
+// concurrent use. The TTL is the default maximum age of the results served,
+// which lookups can override. Beyond maxEntries results, the least recently
+// used ones are evicted. Results up to stale past their maximum age are still
+// served while a new test runs in the background.
+type Cache struct {
+	// The counters come first to be 64-bit aligned for the atomic operations.
+	hits, staleHits, misses uint64
+
+	ttl        time.Duration
+	stale      time.Duration
+	maxEntries int
+	reason     func(error) string
+
+	mutex     sync.Mutex
+	entries   map[Key]*list.Element
+	lru       *list.List // of *Entry, most recently used first
+	calls     map[Key]*call
+	lastSweep time.Time
+}
+
+// New returns an empty cache. reason tells the failure reason of the error of
+// a test, for the outcomes.
+func New(ttl time.Duration, stale time.Duration, maxEntries int, reason func(error) string) *Cache {
+	return &Cache{
+		ttl:        ttl,
+		stale:      stale,
+		maxEntries: maxEntries,
+		reason:     reason,
+		entries:    map[Key]*list.Element{},
+		lru:        list.New(),
+		calls:      map[Key]*call{},
+		lastSweep:  time.Now(),
+	}
+}
+
+// Enabled reports whether results are cached at all.
+func (c *Cache) Enabled() bool {
+	return c.ttl > 0
+}
+
+// TTL returns the default maximum age of the cached results.
+func (c *Cache) TTL() time.Duration {
+	return c.ttl
+}
+
+// Stats returns the number of lookups so far.
+func (c *Cache) Stats() Stats {
+	return Stats{
+		Hits:      atomic.LoadUint64(&c.hits),
+		StaleHits: atomic.LoadUint64(&c.staleHits),
+		Misses:    atomic.LoadUint64(&c.misses),
+	}
+}
+
+// outcomeOf returns the outcome of a test that just ended with err.
+func (c *Cache) outcomeOf(err error) Outcome {
+	o := Outcome{OK: err == nil, Time: time.Now()}
+	if err != nil && c.reason != nil {
+		o.Reason = c.reason(err)
+	}
+	return o
+}
+
+// Get returns the cached result for k with the time it was produced, or nil if
+// there is none or it is older than maxAge.
+func (c *Cache) Get(k Key, maxAge time.Duration) (*iperf.Result, time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if e := c.get(k, maxAge); e != nil {
+		return e.Result, e.Time
+	}
+	return nil, time.Time{}
+}
+
+func (c *Cache) get(k Key, maxAge time.Duration) *Entry {
+	el, ok := c.entries[k]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*Entry)
+	if time.Since(e.Time) > maxAge {
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return e
+}
+
+// Set stores r as the result for k.
+func (c *Cache) Set(k Key, r *iperf.Result) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.setAt(k, r, time.Now())
+}
+
+func (c *Cache) setAt(k Key, r *iperf.Result, t time.Time) {
+	now := time.Now()
+	e := &Entry{Key: k, Result: r, Time: t, Last: Outcome{OK: true, Time: t}}
+	if el, ok := c.entries[k]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+	} else {
+		c.entries[k] = c.lru.PushFront(e)
+	}
+	for c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+
+	// Results older than the TTL (and stale period) can only be served to
+	// lookups asking for an older maximum age, so they are dropped once in a
+	// while to bound the memory used by targets that are not probed anymore.
+	if c.ttl > 0 && now.Sub(c.lastSweep) > sweepInterval {
+		c.lastSweep = now
+		for el := c.lru.Front(); el != nil; {
+			next := el.Next()
+			if now.Sub(el.Value.(*Entry).Time) > c.ttl+c.stale {
+				c.remove(el)
+			}
+			el = next
+		}
+	}
+}
+
+func (c *Cache) remove(el *list.Element) {
+	delete(c.entries, el.Value.(*Entry).Key)
+	c.lru.Remove(el)
+}
+
+// Do returns the cached result for k if it is at most maxAge old, or runs fn
+// to get one and caches it if it succeeds. Concurrent calls for the same key
+// wait for a single run of fn instead of starting tests of their own, which
+// the iperf3 server would refuse anyway.
+//
+// Unless stale is false, a result that is too old but still within the stale
+// period is returned right away, and refresh runs in the background to
+// replace it, so that the caller does not wait for a full test.
+//
+// The result is returned with the time it was produced. The outcome returned
+// is that of the latest test, so a cached result comes with a failed outcome
+// when the tests failed since it was produced.
+func (c *Cache) Do(k Key, maxAge time.Duration, stale bool, fn func() (*iperf.Result, error), refresh func() (*iperf.Result, error)) (*iperf.Result, time.Time, Outcome) {
+	c.mutex.Lock()
+	if e := c.get(k, maxAge); e != nil {
+		c.mutex.Unlock()
+		atomic.AddUint64(&c.hits, 1)
+		return e.Result, e.Time, e.Last
+	}
+	if maxAge > 0 && c.stale > 0 && stale {
+		if e := c.get(k, maxAge+c.stale); e != nil {
+			if _, ok := c.calls[k]; !ok {
+				go c.run(k, c.start(k), refresh)
+			}
+			c.mutex.Unlock()
+			atomic.AddUint64(&c.hits, 1)
+			atomic.AddUint64(&c.staleHits, 1)
+			return e.Result, e.Time, e.Last
+		}
+	}
+	if cl, ok := c.calls[k]; ok {
+		c.mutex.Unlock()
+		atomic.AddUint64(&c.hits, 1)
+		<-cl.done
+		return cl.result, cl.outcome.Time, cl.outcome
+	}
+	cl := c.start(k)
+	c.mutex.Unlock()
+	atomic.AddUint64(&c.misses, 1)
+
+	c.run(k, cl, fn)
+	return cl.result, cl.outcome.Time, cl.outcome
+}
+
+// start registers a test in progress for k. c.mutex must be held.
+func (c *Cache) start(k Key) *call {
+	cl := &call{done: make(chan struct{})}
+	c.calls[k] = cl
+	return cl
+}
+
+// run runs the test of cl and caches its result if it succeeds, or records
+// the failure next to the previous result otherwise.
+func (c *Cache) run(k Key, cl *call, fn func() (*iperf.Result, error)) {
+	var err error
+	cl.result, err = fn()
+	cl.outcome = c.outcomeOf(err)
+
+	c.mutex.Lock()
+	if err == nil {
+		c.setAt(k, cl.result, cl.outcome.Time)
+	} else if el, found := c.entries[k]; found {
+		el.Value.(*Entry).Last = cl.outcome
+	}
+	delete(c.calls, k)
+	c.mutex.Unlock()
+	close(cl.done)
+}
+
+// Len returns the number of cached results.
+func (c *Cache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.entries)
+}
+
+// Entries returns a copy of the cached results, least recently used first.
+func (c *Cache) Entries() []Entry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entries := make([]Entry, 0, c.lru.Len())
+	for el := c.lru.Back(); el != nil; el = el.Prev() {
+		entries = append(entries, *el.Value.(*Entry))
+	}
+	return entries
+}
+
+// Restore caches the results of entries, e.g. saved before a restart, with
+// their original time so that they expire as if they had never left the
+// cache. Entries are restored in order, so the last one ends up the most
+// recently used.
+func (c *Cache) Restore(entries []Entry) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, e := range entries {
+		if e.Result == nil {
+			continue
+		}
+		c.setAt(e.Key, e.Result, e.Time)
+	}
+}
+
+// Invalidate drops the cached results of target, or every result if target is
+// empty, and returns how many were dropped.
+func (c *Cache) Invalidate(target string) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	n := 0
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		if target == "" || el.Value.(*Entry).Key.Target == target {
+			c.remove(el)
+			n++
+		}
+		el = next
+	}
+	return n
+}
@@ -0,0 +1,352 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/edgard/iperf3_exporter/internal/iperf"
+)
+
+// resultWithBytes returns a result telling results apart by their bytes.
+func resultWithBytes(n float64) *iperf.Result {
+	r := &iperf.Result{}
+	r.End.SumReceived.Bytes = n
+	return r
+}
+
+func TestCacheGetSet(t *testing.T) {
+	c := New(time.Minute, 0, 0, nil)
+	k := Key{Target: "a", Port: 5201}
+	if r, _ := c.Get(k, time.Minute); r != nil {
+		t.Fatalf("Get before Set = %v, want nil", r)
+	}
+	c.Set(k, resultWithBytes(1))
+	if r, _ := c.Get(k, time.Minute); r == nil || r.End.SumReceived.Bytes != 1 {
+		t.Fatalf("Get after Set = %v, want the result set", r)
+	}
+	if r, _ := c.Get(Key{Target: "a", Port: 5202}, time.Minute); r != nil {
+		t.Fatalf("Get of another key = %v, want nil", r)
+	}
+
+	c.setAt(k, resultWithBytes(2), time.Now().Add(-2*time.Minute))
+	if r, _ := c.Get(k, time.Minute); r != nil {
+		t.Fatalf("Get of an expired result = %v, want nil", r)
+	}
+	if r, _ := c.Get(k, time.Hour); r == nil || r.End.SumReceived.Bytes != 2 {
+		t.Fatalf("Get with a longer maximum age = %v, want the expired result", r)
+	}
+}
+
+func TestCacheDoCoalesces(t *testing.T) {
+	c := New(time.Minute, 0, 0, nil)
+	k := Key{Target: "a", Port: 5201}
+
+	var runs int32
+	release := make(chan struct{})
+	fn := func() (*iperf.Result, error) {
+		atomic.AddInt32(&runs, 1)
+		<-release
+		return resultWithBytes(1), nil
+	}
+
+	const callers = 20
+	var wg sync.WaitGroup
+	results := make(chan *iperf.Result, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, _, outcome := c.Do(k, time.Minute, true, fn, fn)
+			if !outcome.OK {
+				t.Errorf("Do outcome = %+v, want success", outcome)
+			}
+			results <- r
+		}()
+	}
+	// Let the callers pile up behind the first test before it completes.
+	for atomic.LoadInt32(&runs) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(results)
+
+	if n := atomic.LoadInt32(&runs); n != 1 {
+		t.Fatalf("concurrent Do ran %d tests, want 1", n)
+	}
+	for r := range results {
+		if r == nil || r.End.SumReceived.Bytes != 1 {
+			t.Fatalf("Do = %v, want the result of the single test", r)
+		}
+	}
+
+	// The result is now cached.
+	r, _, _ := c.Do(k, time.Minute, true, func() (*iperf.Result, error) {
+		t.Fatal("Do ran a test for a cached result")
+		return nil, nil
+	}, nil)
+	if r == nil || r.End.SumReceived.Bytes != 1 {
+		t.Fatalf("Do of a cached result = %v, want the cached result", r)
+	}
+}
+
+func TestCacheStaleRefresh(t *testing.T) {
+	c := New(time.Minute, time.Hour, 0, nil)
+	k := Key{Target: "a", Port: 5201}
+	c.setAt(k, resultWithBytes(1), time.Now().Add(-2*time.Minute))
+
+	refreshed := make(chan struct{})
+	fn := func() (*iperf.Result, error) {
+		t.Error("Do waited for a test instead of serving the stale result")
+		return nil, nil
+	}
+	refresh := func() (*iperf.Result, error) {
+		defer close(refreshed)
+		return resultWithBytes(2), nil
+	}
+	r, _, _ := c.Do(k, time.Minute, true, fn, refresh)
+	if r == nil || r.End.SumReceived.Bytes != 1 {
+		t.Fatalf("Do = %v, want the stale result", r)
+	}
+
+	select {
+	case <-refreshed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stale result was not refreshed")
+	}
+	// The refreshed result is cached once the background test completes.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if r, _ := c.Get(k, time.Minute); r != nil {
+			if r.End.SumReceived.Bytes != 2 {
+				t.Fatalf("Get after refresh = %v, want the refreshed result", r)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the refreshed result was not cached")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Without stale, the probe waits for a new test.
+	c.setAt(k, resultWithBytes(1), time.Now().Add(-2*time.Minute))
+	r, _, _ = c.Do(k, time.Minute, false, func() (*iperf.Result, error) {
+		return resultWithBytes(3), nil
+	}, nil)
+	if r == nil || r.End.SumReceived.Bytes != 3 {
+		t.Fatalf("Do without stale = %v, want the result of a new test", r)
+	}
+}
+
+func TestCacheFailureKeepsResult(t *testing.T) {
+	c := New(time.Minute, 0, 0, func(error) string { return "refused" })
+	k := Key{Target: "a", Port: 5201}
+	c.setAt(k, resultWithBytes(1), time.Now().Add(-2*time.Minute))
+
+	failure := errors.New("connection refused")
+	r, _, outcome := c.Do(k, time.Minute, true, func() (*iperf.Result, error) {
+		return nil, failure
+	}, nil)
+	if r != nil || outcome.OK || outcome.Reason != "refused" {
+		t.Fatalf("Do of a failing test = %v, %+v, want no result and a failed outcome", r, outcome)
+	}
+
+	// The previous result is kept, with the outcome of the failed test.
+	r, _, outcome = c.Do(k, time.Hour, true, nil, nil)
+	if r == nil || r.End.SumReceived.Bytes != 1 {
+		t.Fatalf("Do after a failure = %v, want the previous result", r)
+	}
+	if outcome.OK {
+		t.Fatalf("Do after a failure outcome = %+v, want the failed outcome", outcome)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	c := New(time.Minute, 0, 2, nil)
+	a, b, d := Key{Target: "a"}, Key{Target: "b"}, Key{Target: "d"}
+	c.Set(a, resultWithBytes(1))
+	c.Set(b, resultWithBytes(2))
+	// a is now the most recently used result, so b goes first.
+	c.Get(a, time.Minute)
+	c.Set(d, resultWithBytes(3))
+
+	if n := c.Len(); n != 2 {
+		t.Fatalf("Len = %d, want 2", n)
+	}
+	if r, _ := c.Get(b, time.Minute); r != nil {
+		t.Fatalf("Get of the least recently used result = %v, want it evicted", r)
+	}
+	for _, k := range []Key{a, d} {
+		if r, _ := c.Get(k, time.Minute); r == nil {
+			t.Fatalf("Get(%v) = nil, want the result kept", k)
+		}
+	}
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	c := New(time.Minute, 0, 0, nil)
+	c.Set(Key{Target: "a", Port: 5201}, resultWithBytes(1))
+	c.Set(Key{Target: "a", Port: 5202}, resultWithBytes(2))
+	c.Set(Key{Target: "b", Port: 5201}, resultWithBytes(3))
+
+	if n := c.Invalidate("a"); n != 2 {
+		t.Fatalf("Invalidate(a) = %d, want 2", n)
+	}
+	if r, _ := c.Get(Key{Target: "a", Port: 5201}, time.Minute); r != nil {
+		t.Fatalf("Get of an invalidated result = %v, want nil", r)
+	}
+	if r, _ := c.Get(Key{Target: "b", Port: 5201}, time.Minute); r == nil {
+		t.Fatal("Invalidate(a) dropped the result of b")
+	}
+	if n := c.Invalidate(""); n != 1 {
+		t.Fatalf("Invalidate of every result = %d, want 1", n)
+	}
+	if n := c.Len(); n != 0 {
+		t.Fatalf("Len after flush = %d, want 0", n)
+	}
+}
+
+// TestResultCacheConcurrent exercises every accessor at once, for the race
+// detector.
+func TestCacheConcurrent(t *testing.T) {
+	c := New(time.Minute, time.Minute, 8, nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				k := Key{Target: strconv.Itoa((i + j) % 12), Port: 5201}
+				switch j % 6 {
+				case 0:
+					c.Set(k, resultWithBytes(float64(j)))
+				case 1:
+					c.Get(k, time.Minute)
+				case 2:
+					c.Do(k, time.Duration(j%3)*time.Second, true, func() (*iperf.Result, error) {
+						return resultWithBytes(float64(j)), nil
+					}, func() (*iperf.Result, error) {
+						return nil, errors.New("failed")
+					})
+				case 3:
+					c.Entries()
+				case 4:
+					c.Len()
+				case 5:
+					if j%30 == 5 {
+						c.Invalidate(k.Target)
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := c.Len(); n > 8 {
+		t.Fatalf("Len = %d, want at most the 8 entries allowed", n)
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	c := New(time.Minute, time.Hour, 0, nil)
+	ok := func() (*iperf.Result, error) { return resultWithBytes(1), nil }
+	k := Key{Target: "a"}
+	c.Do(k, time.Minute, true, ok, ok)
+	c.Do(k, time.Minute, true, ok, ok)
+	c.setAt(k, resultWithBytes(1), time.Now().Add(-2*time.Minute))
+	c.Do(k, time.Minute, true, ok, ok)
+
+	want := Stats{Hits: 2, StaleHits: 1, Misses: 1}
+	if s := c.Stats(); s != want {
+		t.Fatalf("Stats = %+v, want %+v", s, want)
+	}
+}
+
+func TestCacheEntriesRestore(t *testing.T) {
+	c := New(time.Minute, 0, 0, nil)
+	old := time.Now().Add(-30 * time.Second)
+	c.setAt(Key{Target: "a"}, resultWithBytes(1), old)
+	c.Set(Key{Target: "b"}, resultWithBytes(2))
+
+	entries := c.Entries()
+	if len(entries) != 2 || entries[0].Key.Target != "a" || entries[1].Key.Target != "b" {
+		t.Fatalf("Entries = %+v, want a then b, least recently used first", entries)
+	}
+
+	restored := New(time.Minute, 0, 1, nil)
+	restored.Restore(append(entries, Entry{Key: Key{Target: "nil"}}))
+	// Only the most recently used entry fits, and entries without a result
+	// are skipped.
+	if n := restored.Len(); n != 1 {
+		t.Fatalf("Len after Restore = %d, want 1", n)
+	}
+	if r, _ := restored.Get(Key{Target: "b"}, time.Minute); r == nil || r.End.SumReceived.Bytes != 2 {
+		t.Fatalf("Get after Restore = %v, want the restored result", r)
+	}
+	restored = New(time.Minute, 0, 0, nil)
+	restored.Restore(entries)
+	if _, produced := restored.Get(Key{Target: "a"}, time.Minute); !produced.Equal(old) {
+		t.Fatalf("restored result time = %v, want the original time %v", produced, old)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := NewBackoff(time.Minute, 4*time.Minute)
+	k := Key{Target: "a"}
+	if _, ok := b.Active(k); ok {
+		t.Fatal("Active before any failure")
+	}
+
+	now := time.Now()
+	failure := Outcome{Time: now, Reason: "refused"}
+	b.Record(k, failure)
+	if last, ok := b.Active(k); !ok || last.Reason != "refused" {
+		t.Fatalf("Active after a failure = %+v, %t, want the failure", last, ok)
+	}
+	// The window doubles with every failure, up to the maximum.
+	for i, want := range []time.Duration{2 * time.Minute, 4 * time.Minute, 4 * time.Minute} {
+		b.Record(k, failure)
+		if until := b.states[k].until; !until.Equal(now.Add(want)) {
+			t.Fatalf("window after %d failures = %v, want %v", i+2, until.Sub(now), want)
+		}
+	}
+
+	b.Record(k, Outcome{OK: true, Time: now})
+	if _, ok := b.Active(k); ok {
+		t.Fatal("Active after a success")
+	}
+
+	b.Record(Key{Target: "a", Port: 1}, failure)
+	b.Record(Key{Target: "b"}, failure)
+	b.Reset("a")
+	if _, ok := b.Active(Key{Target: "a", Port: 1}); ok {
+		t.Fatal("Active after Reset of the target")
+	}
+	if _, ok := b.Active(Key{Target: "b"}); !ok {
+		t.Fatal("Reset of a dropped the backoff of b")
+	}
+
+	disabled := NewBackoff(0, 0)
+	disabled.Record(k, failure)
+	if _, ok := disabled.Active(k); ok {
+		t.Fatal("Active with the backoff disabled")
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ProbeAuth restricts the probe endpoints to the users of an htpasswd file
+// and to the holders of bearer tokens, as every probe runs a bandwidth test.
+type ProbeAuth struct {
+	HtpasswdFile string   `yaml:"htpasswd_file,omitempty"`
+	BearerTokens []string `yaml:"bearer_tokens,omitempty"`
+
+	// users are the password hashes of the htpasswd file by user name.
+	users map[string]string
+}
+
+// load reads the htpasswd file, if any. Only bcrypt and SHA-1 hashes are
+// supported. Unsalted SHA-1 is weak against offline cracking and only kept for
+// existing files; crypt, MD5 and plaintext entries are refused.
+func (a *ProbeAuth) load() error {
+	if a.HtpasswdFile == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(a.HtpasswdFile)
+	if err != nil {
+		return err
+	}
+	a.users = map[string]string{}
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("%s:%d: invalid entry", a.HtpasswdFile, n)
+		}
+		if !strings.HasPrefix(parts[1], "$2") && !strings.HasPrefix(parts[1], "{SHA}") {
+			return fmt.Errorf("%s:%d: unsupported hash of user %q, use bcrypt (htpasswd -B)", a.HtpasswdFile, n, parts[0])
+		}
+		a.users[parts[0]] = parts[1]
+	}
+	return s.Err()
+}
+
+// Authenticated reports whether r carries one of the bearer tokens or the
+// credentials of a user of the htpasswd file.
+func (a *ProbeAuth) Authenticated(r *http.Request) bool {
+	h := r.Header.Get("Authorization")
+	if strings.HasPrefix(h, "Bearer ") {
+		token := []byte(strings.TrimPrefix(h, "Bearer "))
+		ok := false
+		for _, t := range a.BearerTokens {
+			if subtle.ConstantTimeCompare(token, []byte(t)) == 1 {
+				ok = true
+			}
+		}
+		return ok
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	hash, ok := a.users[user]
+	if !ok {
+		return false
+	}
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(hash[len("{SHA}"):]), []byte(base64.StdEncoding.EncodeToString(sum[:]))) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestProbeAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("GenerateFromPassword: %s", err)
+	}
+	file := filepath.Join(t.TempDir(), "htpasswd")
+	content := "# probers\n\nalice:" + string(hash) + "\n"
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	a := &ProbeAuth{HtpasswdFile: file, BearerTokens: []string{"token"}}
+	if err := a.load(); err != nil {
+		t.Fatalf("load: %s", err)
+	}
+
+	for _, tc := range []struct {
+		name          string
+		user, pass    string
+		authorization string
+		want          bool
+	}{
+		{name: "bcrypt user", user: "alice", pass: "secret", want: true},
+		{name: "wrong password", user: "alice", pass: "wrong"},
+		{name: "unknown user", user: "bob", pass: "secret"},
+		{name: "bearer token", authorization: "Bearer token", want: true},
+		{name: "wrong bearer token", authorization: "Bearer other"},
+		{name: "no credentials"},
+	} {
+		r := httptest.NewRequest("GET", "/probe", nil)
+		if tc.user != "" {
+			r.SetBasicAuth(tc.user, tc.pass)
+		}
+		if tc.authorization != "" {
+			r.Header.Set("Authorization", tc.authorization)
+		}
+		if got := a.Authenticated(r); got != tc.want {
+			t.Errorf("%s: Authenticated = %t, want %t", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestProbeAuthUnsupportedHash(t *testing.T) {
+	for _, entry := range []string{"alice:$apr1$salt$hash", "alice:plaintext", "no-colon"} {
+		file := filepath.Join(t.TempDir(), "htpasswd")
+		if err := ioutil.WriteFile(file, []byte(entry+"\n"), 0600); err != nil {
+			t.Fatalf("WriteFile: %s", err)
+		}
+		if err := (&ProbeAuth{HtpasswdFile: file}).load(); err == nil {
+			t.Errorf("load of %q succeeded", entry)
+		}
+	}
+}
@@ -0,0 +1,566 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package config loads and validates the exporter configuration file.
+package config
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	// DefaultPort is the port of the iperf3 servers.
+	DefaultPort = 5201
+
+	// MaxPingCount bounds the burst of the ping pre-probe so that it stays
+	// cheap next to the test.
+	MaxPingCount = 100
+)
+
+// reservedLabels are the label names used by the probe metrics themselves.
+var reservedLabels = map[string]bool{
+	"port": true, "flowlabel": true, "side": true, "perspective": true, "hook": true, "interface": true, "threshold": true, "target": true, "reason": true, "stat": true, "parameter": true, "used_port": true, "notes": true, "runbook_url": true,
+}
+
+// ValidAllowedLabel reports whether name can be allowed as a probe label.
+func ValidAllowedLabel(name string) bool {
+	return model.LabelName(name).IsValid() && !strings.HasPrefix(name, "__") && !reservedLabels[name]
+}
+
+// Config is the structure of the exporter configuration file.
+type Config struct {
+	Modules map[string]*Module `yaml:"modules,omitempty"`
+	Targets []Target           `yaml:"targets,omitempty"`
+	Mesh    *Mesh              `yaml:"mesh,omitempty"`
+
+	// Pools are groups of interchangeable iperf3 servers, selected with the
+	// pool probe parameter.
+	Pools map[string]*Pool `yaml:"pools,omitempty"`
+
+	// Janitor lists the directories whose files are removed by age and size,
+	// e.g. archived results or packet captures.
+	Janitor []JanitorDirectory `yaml:"janitor,omitempty"`
+
+	ProbeAuth *ProbeAuth `yaml:"probe_auth,omitempty"`
+
+	// AllowedLabels are label names that can be attached to probe metrics
+	// with a label_<name> parameter, in addition to --probe.allowed-label.
+	AllowedLabels []string `yaml:"allowed_labels,omitempty"`
+
+	// AllowedNetNS are the network namespaces probes can run the iperf3
+	// client in with the netns parameter (none if empty).
+	AllowedNetNS []string `yaml:"allowed_netns,omitempty"`
+}
+
+// JanitorDirectory is a directory kept within quotas by the janitor. Files
+// older than MaxAge are removed, then the oldest ones while the matched files
+// take more than MaxBytes.
+type JanitorDirectory struct {
+	Path     string         `yaml:"path"`
+	Pattern  string         `yaml:"pattern,omitempty"`
+	MaxAge   model.Duration `yaml:"max_age,omitempty"`
+	MaxBytes int64          `yaml:"max_bytes,omitempty"`
+}
+
+// Module is a named set of probe settings, selected with the module probe
+// parameter.
+type Module struct {
+	PreHook  *Hook `yaml:"pre_hook,omitempty"`
+	PostHook *Hook `yaml:"post_hook,omitempty"`
+	SSH      *SSH  `yaml:"ssh,omitempty"`
+
+	// NetNS is the network namespace the iperf3 client runs in.
+	NetNS string `yaml:"netns,omitempty"`
+
+	// Binary is the path of the local iperf3 client (iperf3 in the PATH by
+	// default).
+	Binary string `yaml:"binary,omitempty"`
+
+	// Backend is the test client, iperf3 by default or iperf2 for legacy
+	// servers.
+	Backend string `yaml:"backend,omitempty"`
+
+	// Ping sends a burst of ICMP echo requests to the target before the test.
+	Ping *Ping `yaml:"ping,omitempty"`
+
+	Thresholds *Thresholds `yaml:"thresholds,omitempty"`
+}
+
+// Thresholds are the limits the probes of a module are expected to stay
+// within, reported to a webhook when breached, for consumers not behind
+// Alertmanager.
+type Thresholds struct {
+	// MinBitsPerSecond is the lowest received throughput.
+	MinBitsPerSecond float64 `yaml:"min_bits_per_second,omitempty"`
+
+	// MaxLoss is the highest ratio of echo requests of the ping pre-probe
+	// left unanswered.
+	MaxLoss float64 `yaml:"max_loss,omitempty"`
+
+	// WebhookURL is POSTed the breaches and recoveries of the thresholds.
+	WebhookURL string `yaml:"webhook_url,omitempty"`
+
+	// WebhookToken is the bearer token of the webhook calls (none if empty),
+	// which can be read from a secret provider with a "<provider>:<reference>"
+	// string in WebhookTokenSecret.
+	WebhookToken       string `yaml:"webhook_token,omitempty"`
+	WebhookTokenSecret string `yaml:"webhook_token_secret,omitempty"`
+}
+
+// Ping configures the ICMP pre-probe, a cheap baseline telling a link down
+// from a slow link without using test bandwidth.
+type Ping struct {
+	Count    int            `yaml:"count,omitempty"`
+	Interval model.Duration `yaml:"interval,omitempty"`
+	Timeout  model.Duration `yaml:"timeout,omitempty"`
+}
+
+// netnsRE matches valid network namespace names.
+var netnsRE = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.-]*$`)
+
+// ValidNetNS reports whether name is a valid network namespace name.
+func ValidNetNS(name string) bool {
+	return netnsRE.MatchString(name)
+}
+
+// SSH configures running the iperf3 client on a remote host over SSH, so that
+// tests originate from that host.
+type SSH struct {
+	Host           string `yaml:"host"`
+	Port           int    `yaml:"port,omitempty"`
+	User           string `yaml:"user,omitempty"`
+	KeyFile        string `yaml:"key_file,omitempty"`
+	KnownHostsFile string `yaml:"known_hosts_file,omitempty"`
+	Command        string `yaml:"command,omitempty"`
+}
+
+// Hook is a command run before or after the iperf3 test of a probe.
+type Hook struct {
+	Command []string       `yaml:"command"`
+	Timeout model.Duration `yaml:"timeout,omitempty"`
+}
+
+// Mesh lists the exporter instances testing each other. The same list can be
+// shared by every instance, each one skipping the peer named after itself.
+type Mesh struct {
+	Interval model.Duration `yaml:"interval,omitempty"`
+	Period   model.Duration `yaml:"period,omitempty"`
+	Peers    []MeshPeer     `yaml:"peers"`
+
+	// Downsample exports the min, max and mean throughput of the tests run
+	// since the previous scrape instead of the latest test only.
+	Downsample bool `yaml:"downsample,omitempty"`
+}
+
+// MeshPeer is an exporter instance with its iperf3 server.
+type MeshPeer struct {
+	Name   string `yaml:"name"`
+	Target string `yaml:"target"`
+	Port   int    `yaml:"port,omitempty"`
+}
+
+// Pool lists the iperf3 servers of a logical target, statically or with SRV
+// records, of which every probe tests one.
+type Pool struct {
+	Servers []PoolServer `yaml:"servers,omitempty"`
+	SRV     []string     `yaml:"srv,omitempty"`
+}
+
+// PoolServer is an iperf3 server of a pool. Servers with a lower priority are
+// preferred while any of them is healthy, and servers of the same priority are
+// selected in proportion to their weight.
+type PoolServer struct {
+	Target   string `yaml:"target"`
+	Port     int    `yaml:"port,omitempty"`
+	Priority int    `yaml:"priority,omitempty"`
+	Weight   int    `yaml:"weight,omitempty"`
+}
+
+// Target is an iperf3 server known to the exporter.
+type Target struct {
+	Target string            `yaml:"target"`
+	Port   int               `yaml:"port,omitempty"`
+	Labels map[string]string `yaml:"labels,omitempty"`
+	Auth   *Auth             `yaml:"auth,omitempty"`
+
+	// Ports are the ports of several iperf3 servers running on the target,
+	// e.g. "5201-5210", tried in turn until one is not busy.
+	Ports string `yaml:"ports,omitempty"`
+	ports []int
+
+	// Notes and RunbookURL tell on-call what the target is, e.g. which
+	// circuit it tests, and how to troubleshoot it.
+	Notes      string `yaml:"notes,omitempty"`
+	RunbookURL string `yaml:"runbook_url,omitempty"`
+
+	// ExpectedBitsPerSecond is the contracted bandwidth of the circuit the
+	// target tests, which the SLA metrics compare the tests to.
+	ExpectedBitsPerSecond float64 `yaml:"expected_bits_per_second,omitempty"`
+}
+
+// PortList returns the ports of Ports in order, nil if it is not set.
+func (t *Target) PortList() []int {
+	return t.ports
+}
+
+// parsePorts parses a comma-separated list of ports and port ranges.
+func parsePorts(spec string) ([]int, error) {
+	var ports []int
+	for _, part := range strings.Split(spec, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", part)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, fmt.Errorf("invalid port %q", part)
+			}
+		}
+		if first < 1 || last > 65535 || first > last {
+			return nil, fmt.Errorf("invalid port range %q", part)
+		}
+		for p := first; p <= last; p++ {
+			ports = append(ports, p)
+		}
+	}
+	return ports, nil
+}
+
+// Auth are the iperf3 client authentication settings of a target. The password
+// can be read from a secret provider with a "<provider>:<reference>" string in
+// password_secret.
+type Auth struct {
+	Username         string `yaml:"username"`
+	Password         string `yaml:"password,omitempty"`
+	PasswordSecret   string `yaml:"password_secret,omitempty"`
+	RSAPublicKeyFile string `yaml:"rsa_public_key_file"`
+}
+
+// secretsTimeout bounds the time spent resolving the secrets of a configuration.
+const secretsTimeout = 30 * time.Second
+
+// SafeConfig guards the current configuration against concurrent reloads.
+type SafeConfig struct {
+	sync.RWMutex
+	C *Config
+
+	// ResolveSecret returns the secret a "<provider>:<reference>" string
+	// refers to.
+	ResolveSecret func(ctx context.Context, ref string) (string, error)
+
+	// Check, if set, vets a valid configuration before it replaces the
+	// current one, e.g. against the environment of the exporter.
+	Check func(c *Config) error
+}
+
+// ReloadConfig reads and validates the configuration file, replacing the
+// current configuration on success.
+func (sc *SafeConfig) ReloadConfig(file string) error {
+	c := &Config{}
+	if file != "" {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("error reading config file: %s", err)
+		}
+		if err := yaml.UnmarshalStrict(b, c); err != nil {
+			return fmt.Errorf("error parsing config file: %s", err)
+		}
+		if err := c.Validate(); err != nil {
+			return fmt.Errorf("invalid config file: %s", err)
+		}
+		if err := c.resolveSecrets(sc.ResolveSecret); err != nil {
+			return fmt.Errorf("error resolving secrets: %s", err)
+		}
+	}
+	if sc.Check != nil {
+		if err := sc.Check(c); err != nil {
+			return err
+		}
+	}
+
+	sc.Lock()
+	sc.C = c
+	sc.Unlock()
+
+	return nil
+}
+
+// Get returns the current configuration.
+func (sc *SafeConfig) Get() *Config {
+	sc.RLock()
+	defer sc.RUnlock()
+	return sc.C
+}
+
+// Validate checks the configuration and fills in the defaults it implies.
+func (c *Config) Validate() error {
+	for name, m := range c.Modules {
+		if m == nil {
+			return fmt.Errorf("module %q: empty module", name)
+		}
+		for _, h := range []*Hook{m.PreHook, m.PostHook} {
+			if h != nil && len(h.Command) == 0 {
+				return fmt.Errorf("module %q: hook 'command' must be specified", name)
+			}
+		}
+		if m.NetNS != "" && !netnsRE.MatchString(m.NetNS) {
+			return fmt.Errorf("module %q: invalid network namespace %q", name, m.NetNS)
+		}
+		if m.NetNS != "" && m.SSH != nil {
+			return fmt.Errorf("module %q: 'netns' and 'ssh' are mutually exclusive", name)
+		}
+		if m.Binary != "" && m.SSH != nil {
+			return fmt.Errorf("module %q: 'binary' does not apply to 'ssh', use the ssh 'command'", name)
+		}
+		// Modules running a binary keep doing so with --iperf3.backend=native.
+		if m.Backend == "" && (m.Binary != "" || m.SSH != nil || m.NetNS != "") {
+			m.Backend = "iperf3"
+		}
+		switch m.Backend {
+		case "", "iperf3":
+		case "iperf2":
+			if m.Binary == "" && m.SSH == nil {
+				m.Binary = "iperf"
+			}
+		case "native":
+			if m.Binary != "" || m.SSH != nil || m.NetNS != "" {
+				return fmt.Errorf("module %q: the native backend does not apply to 'binary', 'ssh' or 'netns'", name)
+			}
+		default:
+			return fmt.Errorf("module %q: unknown backend %q", name, m.Backend)
+		}
+		if m.Ping != nil && (m.Ping.Count < 0 || m.Ping.Count > MaxPingCount) {
+			return fmt.Errorf("module %q: ping 'count' must be between 1 and %d", name, MaxPingCount)
+		}
+		if m.Ping != nil && m.SSH != nil {
+			return fmt.Errorf("module %q: 'ping' does not apply to 'ssh'", name)
+		}
+		if t := m.Thresholds; t != nil {
+			if t.MinBitsPerSecond < 0 {
+				return fmt.Errorf("module %q: threshold 'min_bits_per_second' must not be negative", name)
+			}
+			if t.MaxLoss < 0 || t.MaxLoss > 1 {
+				return fmt.Errorf("module %q: threshold 'max_loss' must be between 0 and 1", name)
+			}
+			if t.MaxLoss > 0 && m.Ping == nil {
+				return fmt.Errorf("module %q: threshold 'max_loss' requires 'ping'", name)
+			}
+			if t.WebhookURL != "" {
+				if u, err := url.Parse(t.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+					return fmt.Errorf("module %q: invalid threshold 'webhook_url' %q", name, t.WebhookURL)
+				}
+			}
+			if t.WebhookToken != "" && t.WebhookTokenSecret != "" {
+				return fmt.Errorf("module %q: threshold 'webhook_token' and 'webhook_token_secret' are mutually exclusive", name)
+			}
+			if (t.WebhookToken != "" || t.WebhookTokenSecret != "") && t.WebhookURL == "" {
+				return fmt.Errorf("module %q: threshold webhook token requires 'webhook_url'", name)
+			}
+		}
+		if m.SSH != nil {
+			if m.SSH.Host == "" {
+				return fmt.Errorf("module %q: ssh 'host' must be specified", name)
+			}
+			if m.SSH.Command == "" {
+				m.SSH.Command = "iperf3"
+			}
+		}
+	}
+	for i, t := range c.Targets {
+		if t.Target == "" {
+			return fmt.Errorf("target #%d: 'target' must be specified", i)
+		}
+		if err := CheckTarget("target", t.Target); err != nil {
+			return err
+		}
+		if t.Port < 0 || t.Port > 65535 {
+			return fmt.Errorf("target %q: invalid port %d", t.Target, t.Port)
+		}
+		for name := range t.Labels {
+			if !model.LabelName(name).IsValid() {
+				return fmt.Errorf("target %q: invalid label name %q", t.Target, name)
+			}
+		}
+		if t.Auth != nil && (t.Auth.Username == "" || t.Auth.RSAPublicKeyFile == "") {
+			return fmt.Errorf("target %q: 'username' and 'rsa_public_key_file' must be specified for authentication", t.Target)
+		}
+		if t.RunbookURL != "" {
+			if u, err := url.Parse(t.RunbookURL); err != nil || u.Scheme != "http" && u.Scheme != "https" {
+				return fmt.Errorf("target %q: invalid runbook URL %q", t.Target, t.RunbookURL)
+			}
+		}
+		if t.ExpectedBitsPerSecond < 0 {
+			return fmt.Errorf("target %q: 'expected_bits_per_second' must not be negative", t.Target)
+		}
+		if t.Ports != "" {
+			if t.Port != 0 {
+				return fmt.Errorf("target %q: 'port' and 'ports' are mutually exclusive", t.Target)
+			}
+			ports, err := parsePorts(t.Ports)
+			if err != nil {
+				return fmt.Errorf("target %q: %s", t.Target, err)
+			}
+			c.Targets[i].ports = ports
+		}
+	}
+	if c.Mesh != nil {
+		if c.Mesh.Interval == 0 {
+			c.Mesh.Interval = model.Duration(5 * time.Minute)
+		}
+		if c.Mesh.Period == 0 {
+			c.Mesh.Period = model.Duration(5 * time.Second)
+		}
+		names := map[string]bool{}
+		for i, p := range c.Mesh.Peers {
+			if p.Name == "" || p.Target == "" {
+				return fmt.Errorf("mesh peer #%d: 'name' and 'target' must be specified", i)
+			}
+			if err := CheckTarget(fmt.Sprintf("mesh peer %q: target", p.Name), p.Target); err != nil {
+				return err
+			}
+			if names[p.Name] {
+				return fmt.Errorf("mesh peer %q: duplicate name", p.Name)
+			}
+			names[p.Name] = true
+			if p.Port == 0 {
+				c.Mesh.Peers[i].Port = DefaultPort
+			}
+		}
+	}
+	for name, p := range c.Pools {
+		if p == nil || len(p.Servers) == 0 && len(p.SRV) == 0 {
+			return fmt.Errorf("pool %q: 'servers' or 'srv' must be specified", name)
+		}
+		for i, s := range p.Servers {
+			if s.Target == "" {
+				return fmt.Errorf("pool %q: server #%d: 'target' must be specified", name, i)
+			}
+			if err := CheckTarget(fmt.Sprintf("pool %q: server", name), s.Target); err != nil {
+				return err
+			}
+			if s.Port < 0 || s.Port > 65535 {
+				return fmt.Errorf("pool %q: server %q: invalid port %d", name, s.Target, s.Port)
+			}
+			if s.Weight < 0 {
+				return fmt.Errorf("pool %q: server %q: invalid weight %d", name, s.Target, s.Weight)
+			}
+			if s.Port == 0 {
+				p.Servers[i].Port = DefaultPort
+			}
+		}
+	}
+	for _, name := range c.AllowedLabels {
+		if !ValidAllowedLabel(name) {
+			return fmt.Errorf("invalid allowed label name %q", name)
+		}
+	}
+	for _, name := range c.AllowedNetNS {
+		if !netnsRE.MatchString(name) {
+			return fmt.Errorf("invalid allowed network namespace %q", name)
+		}
+	}
+	if a := c.ProbeAuth; a != nil {
+		if a.HtpasswdFile == "" && len(a.BearerTokens) == 0 {
+			return fmt.Errorf("probe_auth: 'htpasswd_file' or 'bearer_tokens' must be specified")
+		}
+		for _, t := range a.BearerTokens {
+			if t == "" {
+				return fmt.Errorf("probe_auth: empty bearer token")
+			}
+		}
+		if err := a.load(); err != nil {
+			return fmt.Errorf("probe_auth: %s", err)
+		}
+	}
+	for i, d := range c.Janitor {
+		if d.Path == "" {
+			return fmt.Errorf("janitor directory #%d: 'path' must be specified", i)
+		}
+		if d.MaxAge <= 0 && d.MaxBytes <= 0 {
+			return fmt.Errorf("janitor directory %q: 'max_age' or 'max_bytes' must be specified", d.Path)
+		}
+		if d.Pattern == "" {
+			c.Janitor[i].Pattern = "*"
+		}
+		if _, err := filepath.Match(c.Janitor[i].Pattern, ""); err != nil {
+			return fmt.Errorf("janitor directory %q: invalid pattern %q", d.Path, d.Pattern)
+		}
+	}
+	return nil
+}
+
+func (c *Config) resolveSecrets(resolveSecret func(ctx context.Context, ref string) (string, error)) error {
+	ctx, cancel := context.WithTimeout(context.Background(), secretsTimeout)
+	defer cancel()
+
+	for _, t := range c.Targets {
+		if t.Auth == nil || t.Auth.PasswordSecret == "" {
+			continue
+		}
+		if resolveSecret == nil {
+			return fmt.Errorf("target %q: secret references are not supported", t.Target)
+		}
+		password, err := resolveSecret(ctx, t.Auth.PasswordSecret)
+		if err != nil {
+			return fmt.Errorf("target %q: %s", t.Target, err)
+		}
+		t.Auth.Password = password
+	}
+	for name, m := range c.Modules {
+		if m == nil || m.Thresholds == nil || m.Thresholds.WebhookTokenSecret == "" {
+			continue
+		}
+		if resolveSecret == nil {
+			return fmt.Errorf("module %q: secret references are not supported", name)
+		}
+		token, err := resolveSecret(ctx, m.Thresholds.WebhookTokenSecret)
+		if err != nil {
+			return fmt.Errorf("module %q: %s", name, err)
+		}
+		m.Thresholds.WebhookToken = token
+	}
+	return nil
+}
+
+// LookupTarget returns the configured target matching target and port, if any.
+// Targets with several ports match any of them.
+func (c *Config) LookupTarget(target string, port int) *Target {
+	for i, t := range c.Targets {
+		if t.Target != target {
+			continue
+		}
+		if t.Port == port || t.Port == 0 && port == DefaultPort {
+			return &c.Targets[i]
+		}
+		for _, p := range t.ports {
+			if p == port {
+				return &c.Targets[i]
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ErrCredentials is the error of targets embedding credentials, which are
+// never passed to iperf3 nor logged.
+const ErrCredentials = "must not embed credentials, use the 'auth' settings of the configuration file"
+
+// HasCredentials reports whether target embeds credentials, e.g. user:pass@host
+// or a URL with userinfo. Host names and addresses never contain '@'.
+func HasCredentials(target string) bool {
+	return strings.Contains(target, "@")
+}
+
+// RedactTarget returns target with its credentials, if any, replaced, so that
+// it can be logged.
+func RedactTarget(target string) string {
+	i := strings.LastIndex(target, "@")
+	if i < 0 {
+		return target
+	}
+	scheme := ""
+	if j := strings.Index(target[:i], "://"); j >= 0 {
+		scheme = target[:j+3]
+	}
+	return scheme + "xxxxx" + target[i:]
+}
+
+// CheckTarget returns an error naming what when target embeds credentials.
+func CheckTarget(what string, target string) error {
+	if HasCredentials(target) {
+		return fmt.Errorf("%s %q %s", what, RedactTarget(target), ErrCredentials)
+	}
+	return nil
+}
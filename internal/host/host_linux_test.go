@@ -0,0 +1,31 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package host
+
+import "testing"
+
+func TestHostStatistics(t *testing.T) {
+	if load, err := LoadAverage(); err != nil || load < 0 {
+		t.Errorf("LoadAverage = %v, %v, want a load", load, err)
+	}
+	if mem, err := AvailableMemory(); err != nil || mem <= 0 {
+		t.Errorf("AvailableMemory = %v, %v, want some memory", mem, err)
+	}
+	if _, err := InterfaceBytes("lo"); err != nil {
+		t.Errorf("InterfaceBytes(lo): %s", err)
+	}
+	if _, err := InterfaceBytes("no-such-interface"); err == nil {
+		t.Error("InterfaceBytes of a missing interface succeeded")
+	}
+}
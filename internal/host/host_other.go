@@ -0,0 +1,36 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package host
+
+import "errors"
+
+var errHostStats = errors.New("host statistics are not supported on this platform")
+
+// LoadAverage is only supported on Linux.
+func LoadAverage() (float64, error) {
+	return 0, errHostStats
+}
+
+// AvailableMemory is only supported on Linux.
+func AvailableMemory() (float64, error) {
+	return 0, errHostStats
+}
+
+// InterfaceBytes is only supported on Linux.
+func InterfaceBytes(name string) (float64, error) {
+	return 0, errHostStats
+}
@@ -0,0 +1,41 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package host
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// InterfaceSpeed returns the link speed of an interface in bits per second,
+// as reported by the kernel in Mbit/s.
+func InterfaceSpeed(name string) (float64, error) {
+	b, err := ioutil.ReadFile("/sys/class/net/" + name + "/speed")
+	if err != nil {
+		return 0, err
+	}
+	mbps, err := strconv.ParseFloat(strings.TrimSpace(string(b)), 64)
+	if err != nil {
+		return 0, err
+	}
+	if mbps <= 0 {
+		return 0, fmt.Errorf("unknown speed for interface %s", name)
+	}
+	return mbps * 1e6, nil
+}
@@ -0,0 +1,33 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package host
+
+import (
+	"net"
+	"testing"
+)
+
+func TestEgressInterface(t *testing.T) {
+	name, err := EgressInterface("127.0.0.1", 5201)
+	if err != nil {
+		t.Fatalf("EgressInterface(127.0.0.1): %s", err)
+	}
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		t.Fatalf("InterfaceByName(%s): %s", name, err)
+	}
+	if iface.Flags&net.FlagLoopback == 0 {
+		t.Fatalf("EgressInterface(127.0.0.1) = %s, want the loopback interface", name)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package host
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// Processes returns the processes running on the host, as listed in /proc.
+func Processes() ([]Process, error) {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	var procs []Process
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		// The process may have exited since /proc was listed.
+		b, err := ioutil.ReadFile("/proc/" + e.Name() + "/stat")
+		if err != nil {
+			continue
+		}
+		p, ok := parseStat(pid, string(b))
+		if !ok {
+			continue
+		}
+		procs = append(procs, p)
+	}
+	return procs, nil
+}
+
+// parseStat parses the /proc/<pid>/stat line s of process pid.
+func parseStat(pid int, s string) (Process, bool) {
+	// The name is within parentheses and may contain spaces and parentheses,
+	// so the fields are those after the last one.
+	start, end := strings.IndexByte(s, '('), strings.LastIndexByte(s, ')')
+	if start < 0 || end < start {
+		return Process{}, false
+	}
+	fields := strings.Fields(s[end+1:])
+	if len(fields) < 3 {
+		return Process{}, false
+	}
+	p := Process{PID: pid, Name: s[start+1 : end], Zombie: fields[0] == "Z"}
+	p.PPID, _ = strconv.Atoi(fields[1])
+	p.PGID, _ = strconv.Atoi(fields[2])
+	return p, true
+}
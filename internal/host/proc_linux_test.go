@@ -0,0 +1,57 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package host
+
+import (
+	"os"
+	"testing"
+)
+
+func TestParseStat(t *testing.T) {
+	for _, tc := range []struct {
+		pid  int
+		stat string
+		want Process
+		ok   bool
+	}{
+		{42, "42 (iperf3) S 1 42 42 0 -1", Process{PID: 42, PPID: 1, PGID: 42, Name: "iperf3"}, true},
+		{43, "43 (a (b) c) Z 42 41 41 0", Process{PID: 43, PPID: 42, PGID: 41, Name: "a (b) c", Zombie: true}, true},
+		{44, "44 iperf3 S 1 44", Process{}, false},
+		{45, "45 (iperf3) S", Process{}, false},
+	} {
+		p, ok := parseStat(tc.pid, tc.stat)
+		if ok != tc.ok || ok && p != tc.want {
+			t.Errorf("parseStat(%q) = %+v, %t, want %+v, %t", tc.stat, p, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestProcesses(t *testing.T) {
+	procs, err := Processes()
+	if err != nil {
+		t.Fatalf("Processes: %s", err)
+	}
+	for _, p := range procs {
+		if p.PID == os.Getpid() {
+			if p.PPID != os.Getppid() {
+				t.Fatalf("Processes parent of the test = %d, want %d", p.PPID, os.Getppid())
+			}
+			if p.Zombie {
+				t.Fatal("Processes lists the test as a zombie")
+			}
+			return
+		}
+	}
+	t.Fatalf("Processes does not list the test process %d", os.Getpid())
+}
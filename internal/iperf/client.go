@@ -0,0 +1,344 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iperf
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// States of the iperf3 control protocol, sent as a single signed byte.
+const (
+	stateTestStart       = 1
+	stateTestRunning     = 2
+	stateTestEnd         = 4
+	stateParamExchange   = 9
+	stateCreateStreams   = 10
+	stateServerTerminate = 11
+	stateExchangeResults = 13
+	stateDisplayResults  = 14
+	stateIperfDone       = 16
+	stateAccessDenied    = -1
+	stateServerError     = -2
+)
+
+// BlockSize is the length of the blocks the client writes, the iperf3 default
+// for TCP tests.
+const BlockSize = 128 * 1024
+
+const (
+	cookieSize  = 37
+	cookieChars = "abcdefghijklmnopqrstuvwxyz234567"
+	maxJSONSize = 1 << 20
+)
+
+// ClientOptions are the parameters of a native client test.
+type ClientOptions struct {
+	Target   string
+	Port     int
+	Duration time.Duration
+	Streams  int
+}
+
+// clientResults are the results exchanged with the server at the end of a
+// test. The CPU utilization is not measured.
+type clientResults struct {
+	CPUUtilTotal         float64        `json:"cpu_util_total"`
+	CPUUtilUser          float64        `json:"cpu_util_user"`
+	CPUUtilSystem        float64        `json:"cpu_util_system"`
+	SenderHasRetransmits int            `json:"sender_has_retransmits"`
+	Streams              []streamResult `json:"streams"`
+}
+
+type streamResult struct {
+	ID          int     `json:"id"`
+	Bytes       float64 `json:"bytes"`
+	Retransmits int     `json:"retransmits"`
+	Jitter      float64 `json:"jitter"`
+	Errors      int     `json:"errors"`
+	Packets     int     `json:"packets"`
+	StartTime   float64 `json:"start_time"`
+	EndTime     float64 `json:"end_time"`
+}
+
+// RunClient runs a TCP test against an iperf3 server with the iperf3 protocol
+// rather than the iperf3 binary, the client sending for o.Duration. The
+// result has the shape of the iperf3 JSON output.
+func RunClient(ctx context.Context, o ClientOptions) (*Result, error) {
+	if o.Streams < 1 {
+		o.Streams = 1
+	}
+	// Control connections are never kept for later tests: the server is busy
+	// for as long as one is open, refusing the other clients.
+	var d net.Dialer
+	address := net.JoinHostPort(o.Target, strconv.Itoa(o.Port))
+	control, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer control.Close()
+	// Closing the control connection unblocks its reads and writes when ctx
+	// is done.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			control.Close()
+		case <-stop:
+		}
+	}()
+
+	cookie := make([]byte, cookieSize)
+	for i := range cookie[:cookieSize-1] {
+		cookie[i] = cookieChars[rand.Intn(len(cookieChars))]
+	}
+	if _, err := control.Write(cookie); err != nil {
+		return nil, fmt.Errorf("failed to send the cookie: %s", err)
+	}
+
+	var (
+		streams []net.Conn
+		sent    []int64
+		start   time.Time
+		elapsed time.Duration
+	)
+	defer func() {
+		for _, s := range streams {
+			s.Close()
+		}
+	}()
+
+	for {
+		state, err := readState(control)
+		if err != nil {
+			return nil, ctxErr(ctx, fmt.Errorf("failed to read the test state: %s", err))
+		}
+		switch state {
+		case stateParamExchange:
+			if err := writeJSON(control, map[string]interface{}{
+				"tcp":      true,
+				"omit":     0,
+				"time":     int(math.Round(o.Duration.Seconds())),
+				"parallel": o.Streams,
+				"len":      BlockSize,
+			}); err != nil {
+				return nil, fmt.Errorf("failed to send the test parameters: %s", err)
+			}
+
+		case stateCreateStreams:
+			for i := 0; i < o.Streams; i++ {
+				s, err := d.DialContext(ctx, "tcp", address)
+				if err != nil {
+					return nil, err
+				}
+				streams = append(streams, s)
+				if _, err := s.Write(cookie); err != nil {
+					return nil, fmt.Errorf("failed to send the stream cookie: %s", err)
+				}
+			}
+			sent = make([]int64, len(streams))
+
+		case stateTestStart:
+
+		case stateTestRunning:
+			start = time.Now()
+			send(ctx, streams, sent, o.Duration)
+			elapsed = time.Since(start)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if err := writeState(control, stateTestEnd); err != nil {
+				return nil, fmt.Errorf("failed to end the test: %s", err)
+			}
+
+		case stateExchangeResults:
+			results := clientResults{}
+			for i := range streams {
+				results.Streams = append(results.Streams, streamResult{
+					ID:          streamID(i),
+					Bytes:       float64(sent[i]),
+					Retransmits: -1,
+					EndTime:     elapsed.Seconds(),
+				})
+			}
+			if err := writeJSON(control, results); err != nil {
+				return nil, fmt.Errorf("failed to send the results: %s", err)
+			}
+			var server clientResults
+			if err := readJSON(control, &server); err != nil {
+				return nil, fmt.Errorf("failed to read the server results: %s", err)
+			}
+			r := buildResult(o, results, server, elapsed)
+			if err := writeState(control, stateIperfDone); err != nil {
+				return nil, fmt.Errorf("failed to complete the test: %s", err)
+			}
+			return r, nil
+
+		case stateDisplayResults:
+			// Only sent after the results were exchanged.
+			return nil, errors.New("unexpected end of the test")
+
+		case stateAccessDenied:
+			return nil, errors.New("the server is busy running a test. try again later")
+
+		case stateServerError:
+			var codes [2]int32
+			binary.Read(control, binary.BigEndian, &codes)
+			return nil, fmt.Errorf("the server reported an error (iperf3 error %d, errno %d)", codes[0], codes[1])
+
+		case stateServerTerminate:
+			return nil, errors.New("the server terminated the test")
+
+		default:
+			return nil, fmt.Errorf("unexpected test state %d", state)
+		}
+	}
+}
+
+// streamID returns the id iperf3 gives to stream i, the second stream being
+// numbered 3.
+func streamID(i int) int {
+	if i == 0 {
+		return 1
+	}
+	return i + 2
+}
+
+// send writes blocks on every stream for duration, counting the bytes sent.
+func send(ctx context.Context, streams []net.Conn, sent []int64, duration time.Duration) {
+	block := make([]byte, BlockSize)
+	rand.Read(block)
+	deadline := time.Now().Add(duration)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	var wg sync.WaitGroup
+	for i, s := range streams {
+		wg.Add(1)
+		go func(i int, s net.Conn) {
+			defer wg.Done()
+			// The write deadline ends the blocked write at the end of the
+			// test, with the bytes written so far counted.
+			s.SetWriteDeadline(deadline)
+			for {
+				n, err := s.Write(block)
+				atomic.AddInt64(&sent[i], int64(n))
+				if err != nil {
+					return
+				}
+			}
+		}(i, s)
+	}
+	wg.Wait()
+}
+
+// buildResult returns the result of the test in the shape of the iperf3 JSON
+// output, the sent bytes being those of the client and the received bytes
+// those the server reported.
+func buildResult(o ClientOptions, client clientResults, server clientResults, elapsed time.Duration) *Result {
+	r := &Result{}
+	r.Start.Connected = []struct {
+		RemotePort int `json:"remote_port"`
+	}{{RemotePort: o.Port}}
+	r.Start.TestStart.NumStreams = o.Streams
+	r.Start.TestStart.Blksize = BlockSize
+	r.Start.TestStart.Duration = math.Round(o.Duration.Seconds())
+
+	received := map[int]streamResult{}
+	for _, s := range server.Streams {
+		received[s.ID] = s
+	}
+	for _, s := range client.Streams {
+		rs := received[s.ID]
+		seconds := rs.EndTime - rs.StartTime
+		if seconds <= 0 {
+			seconds = elapsed.Seconds()
+		}
+		r.End.Streams = append(r.End.Streams, struct {
+			Sender   StreamSummary `json:"sender"`
+			Receiver StreamSummary `json:"receiver"`
+		}{
+			Sender:   StreamSummary{Seconds: elapsed.Seconds(), Bytes: s.Bytes, Sender: true},
+			Receiver: StreamSummary{Seconds: seconds, Bytes: rs.Bytes, Sender: true},
+		})
+		r.End.SumSent.Bytes += s.Bytes
+		r.End.SumReceived.Bytes += rs.Bytes
+		r.End.SumReceived.Seconds = math.Max(r.End.SumReceived.Seconds, seconds)
+	}
+	r.End.SumSent.Seconds = elapsed.Seconds()
+	return r
+}
+
+// ctxErr returns the error of ctx when it is done, as it is the cause of
+// err, the failure of an operation on a connection closed by RunClient.
+func ctxErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func readState(r io.Reader) (int8, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, err
+	}
+	return int8(b[0]), nil
+}
+
+func writeState(w io.Writer, state int8) error {
+	_, err := w.Write([]byte{byte(state)})
+	return err
+}
+
+// writeJSON writes v as JSON prefixed with its length, as iperf3 exchanges
+// parameters and results.
+func writeJSON(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	msg := make([]byte, 4, 4+len(b))
+	binary.BigEndian.PutUint32(msg, uint32(len(b)))
+	_, err = w.Write(append(msg, b...))
+	return err
+}
+
+func readJSON(r io.Reader, v interface{}) error {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return err
+	}
+	if size > maxJSONSize {
+		return fmt.Errorf("message of %d bytes is too large", size)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
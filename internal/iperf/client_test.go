@@ -0,0 +1,217 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iperf
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeServer runs the server side of the iperf3 protocol for a single test,
+// or refuses it as busy.
+type fakeServer struct {
+	l    net.Listener
+	busy bool
+
+	params   map[string]interface{}
+	received int64
+	err      error
+	done     chan struct{}
+}
+
+func startFakeServer(t *testing.T, busy bool) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	s := &fakeServer{l: l, busy: busy, done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		s.err = s.serve()
+	}()
+	return s
+}
+
+func (s *fakeServer) port() int {
+	return s.l.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeServer) serve() error {
+	defer s.l.Close()
+	control, err := s.l.Accept()
+	if err != nil {
+		return err
+	}
+	defer control.Close()
+	cookie := make([]byte, cookieSize)
+	if _, err := io.ReadFull(control, cookie); err != nil {
+		return err
+	}
+	if s.busy {
+		return writeState(control, stateAccessDenied)
+	}
+
+	if err := writeState(control, stateParamExchange); err != nil {
+		return err
+	}
+	if err := readJSON(control, &s.params); err != nil {
+		return err
+	}
+	if err := writeState(control, stateCreateStreams); err != nil {
+		return err
+	}
+	n := int(s.params["parallel"].(float64))
+	var wg sync.WaitGroup
+	streams := make([]net.Conn, n)
+	counts := make([]int64, n)
+	for i := range streams {
+		if streams[i], err = s.l.Accept(); err != nil {
+			return err
+		}
+		defer streams[i].Close()
+		if _, err := io.ReadFull(streams[i], cookie); err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			buf := make([]byte, 64*1024)
+			for {
+				n, err := streams[i].Read(buf)
+				atomic.AddInt64(&counts[i], int64(n))
+				if err != nil {
+					return
+				}
+			}
+		}(i)
+	}
+	for _, state := range []int8{stateTestStart, stateTestRunning} {
+		if err := writeState(control, state); err != nil {
+			return err
+		}
+	}
+	if state, err := readState(control); err != nil {
+		return err
+	} else if state != stateTestEnd {
+		return fmt.Errorf("unexpected state %d", state)
+	}
+
+	if err := writeState(control, stateExchangeResults); err != nil {
+		return err
+	}
+	var client clientResults
+	if err := readJSON(control, &client); err != nil {
+		return err
+	}
+	results := clientResults{}
+	for i := range streams {
+		b := atomic.LoadInt64(&counts[i])
+		s.received += b
+		results.Streams = append(results.Streams, streamResult{ID: streamID(i), Bytes: float64(b), EndTime: 0.5})
+	}
+	if err := writeJSON(control, results); err != nil {
+		return err
+	}
+	if state, err := readState(control); err != nil {
+		return err
+	} else if state != stateIperfDone {
+		return fmt.Errorf("unexpected state %d", state)
+	}
+	for _, st := range streams {
+		st.Close()
+	}
+	wg.Wait()
+	return nil
+}
+
+func TestRunClient(t *testing.T) {
+	s := startFakeServer(t, false)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	r, err := RunClient(ctx, ClientOptions{Target: "127.0.0.1", Port: s.port(), Duration: 200 * time.Millisecond, Streams: 2})
+	if err != nil {
+		t.Fatalf("RunClient: %s", err)
+	}
+	<-s.done
+	if s.err != nil {
+		t.Fatalf("fake server: %s", s.err)
+	}
+	if p := s.params["parallel"]; p != 2.0 {
+		t.Fatalf("parallel parameter = %v, want 2", p)
+	}
+	if p := s.params["len"]; p != float64(BlockSize) {
+		t.Fatalf("len parameter = %v, want %d", p, BlockSize)
+	}
+
+	if r.RemotePort() != s.port() || r.Start.TestStart.NumStreams != 2 || len(r.End.Streams) != 2 {
+		t.Fatalf("RunClient start = %+v, want the test parameters", r.Start)
+	}
+	if r.End.SumSent.Bytes <= 0 || r.End.SumSent.Seconds <= 0 {
+		t.Fatalf("RunClient sum_sent = %+v, want the bytes sent", r.End.SumSent)
+	}
+	if r.End.SumReceived.Bytes != float64(s.received) || r.End.SumReceived.Seconds != 0.5 {
+		t.Fatalf("RunClient sum_received = %+v, want the %d bytes the server reported", r.End.SumReceived, s.received)
+	}
+}
+
+func TestRunClientBusy(t *testing.T) {
+	s := startFakeServer(t, true)
+	_, err := RunClient(context.Background(), ClientOptions{Target: "127.0.0.1", Port: s.port(), Duration: time.Second})
+	if err == nil || FailureReason(context.Background(), nil, err) != "server_busy" {
+		t.Fatalf("RunClient against a busy server = %v, want a server_busy failure", err)
+	}
+}
+
+func TestRunClientRefused(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	_, err = RunClient(context.Background(), ClientOptions{Target: "127.0.0.1", Port: port, Duration: time.Second})
+	if err == nil || !strings.Contains(err.Error(), "refused") {
+		t.Fatalf("RunClient without a server = %v, want connection refused", err)
+	}
+}
+
+func TestRunClientCanceled(t *testing.T) {
+	// The server accepts the control connection and never answers.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			defer c.Close()
+			io.Copy(ioutil.Discard, c)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := RunClient(ctx, ClientOptions{Target: "127.0.0.1", Port: l.Addr().(*net.TCPAddr).Port, Duration: time.Second}); err != context.DeadlineExceeded {
+		t.Fatalf("RunClient past the deadline = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
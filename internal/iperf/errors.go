@@ -0,0 +1,78 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iperf
+
+import (
+	"context"
+	"encoding/json"
+	"os/exec"
+	"strings"
+)
+
+// failurePatterns map substrings of the iperf3 error messages to a failure
+// reason, the first match winning.
+var failurePatterns = []struct {
+	reason   string
+	patterns []string
+}{
+	{"server_busy", []string{"server is busy"}},
+	{"auth", []string{"authorization failed", "authentication failed", "rsa public key"}},
+	{"dns", []string{"name or service not known", "temporary failure in name resolution", "no address associated", "nodename nor servname", "no such host"}},
+	{"connect_refused", []string{"connection refused"}},
+	{"timeout", []string{"timed out", "timeout"}},
+}
+
+// FailureReasons are the reasons returned by FailureReason, non_json for
+// output that CheckJSON rejects and parse_error for results that Parse
+// rejects.
+var FailureReasons = []string{"timeout", "canceled", "connect_refused", "server_busy", "dns", "non_json", "parse_error", "auth", "other"}
+
+// ErrorMessage returns the error iperf3 reported in its JSON output, if any.
+func ErrorMessage(out []byte) string {
+	if IsStream(out) {
+		out, _ = Assemble(out)
+	}
+	var r struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(out, &r) != nil {
+		return ""
+	}
+	return r.Error
+}
+
+// FailureReason classifies the failure of an iperf3 run from the error
+// reported in its output, its standard error and err, the error of the run
+// with ctx.
+func FailureReason(ctx context.Context, out []byte, err error) string {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return "timeout"
+	case context.Canceled:
+		return "canceled"
+	}
+	messages := []string{ErrorMessage(out), err.Error()}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		messages = append(messages, string(exitErr.Stderr))
+	}
+	message := strings.ToLower(strings.Join(messages, "\n"))
+	for _, f := range failurePatterns {
+		for _, p := range f.patterns {
+			if strings.Contains(message, p) {
+				return f.reason
+			}
+		}
+	}
+	return "other"
+}
@@ -0,0 +1,74 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iperf
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestFailureReason(t *testing.T) {
+	exit := errors.New("exit status 1")
+	for _, tc := range []struct {
+		out    string
+		err    error
+		reason string
+	}{
+		{`{"error": "the server is busy running a test. try again later"}`, exit, "server_busy"},
+		{`{"error": "unable to connect to server: Connection refused"}`, exit, "connect_refused"},
+		{`{"error": "unable to connect to server: Name or service not known"}`, exit, "dns"},
+		{`{"error": "test authorization failed"}`, exit, "auth"},
+		{`{"error": "control socket has closed unexpectedly"}`, exit, "other"},
+		{"", errors.New("dial tcp 10.0.0.1:5201: i/o timeout"), "timeout"},
+		{`{"event": "error", "data": "the server is busy running a test"}`, exit, "server_busy"},
+	} {
+		if reason := FailureReason(context.Background(), []byte(tc.out), tc.err); reason != tc.reason {
+			t.Errorf("FailureReason(%q, %q) = %s, want %s", tc.out, tc.err, reason, tc.reason)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	<-ctx.Done()
+	if reason := FailureReason(ctx, nil, exit); reason != "timeout" {
+		t.Errorf("FailureReason past the deadline = %s, want timeout", reason)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if reason := FailureReason(ctx, nil, exit); reason != "canceled" {
+		t.Errorf("FailureReason of a canceled test = %s, want canceled", reason)
+	}
+}
+
+func TestFailureReasonsComplete(t *testing.T) {
+	known := map[string]bool{}
+	for _, r := range FailureReasons {
+		known[r] = true
+	}
+	for _, f := range failurePatterns {
+		if !known[f.reason] {
+			t.Errorf("failure reason %s is not in FailureReasons", f.reason)
+		}
+	}
+}
+
+func TestErrorMessage(t *testing.T) {
+	if m := ErrorMessage([]byte(`{"error": "unable to connect"}`)); m != "unable to connect" {
+		t.Fatalf("ErrorMessage = %q, want the error of the output", m)
+	}
+	if m := ErrorMessage([]byte("not json")); m != "" {
+		t.Fatalf("ErrorMessage of output that is not JSON = %q, want none", m)
+	}
+}
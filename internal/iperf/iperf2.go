@@ -0,0 +1,74 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iperf
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// iperf2Fields are the report fields of the iperf2 CSV output, before the
+// fields newer releases may append:
+// timestamp,source_address,source_port,destination_address,destination_port,id,interval,transferred_bytes,bits_per_second
+const iperf2Fields = 9
+
+// ParseIperf2CSV decodes the CSV output of an iperf2 client run with -y C into
+// a Result. iperf2 only reports the client side of the test, so the received
+// summary is that of the sent bytes, which TCP acknowledged, and there are
+// no per-stream summaries.
+func ParseIperf2CSV(out []byte) (*Result, error) {
+	var final []string
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Split(strings.TrimSpace(line), ",")
+		if len(fields) < iperf2Fields {
+			continue
+		}
+		// With parallel streams, the sum of the streams has the id -1 and
+		// comes last.
+		if final == nil || fields[5] == "-1" || final[5] != "-1" {
+			final = fields
+		}
+	}
+	if final == nil {
+		return nil, errors.New("no report in the iperf2 output")
+	}
+
+	interval := strings.SplitN(final[6], "-", 2)
+	if len(interval) != 2 {
+		return nil, fmt.Errorf("invalid interval %q", final[6])
+	}
+	start, err := strconv.ParseFloat(interval[0], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid interval %q", final[6])
+	}
+	end, err := strconv.ParseFloat(interval[1], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid interval %q", final[6])
+	}
+	bytes, err := strconv.ParseFloat(final[7], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid transferred bytes %q", final[7])
+	}
+	port, _ := strconv.Atoi(final[4])
+
+	r := &Result{}
+	r.Start.Connected = []struct {
+		RemotePort int `json:"remote_port"`
+	}{{RemotePort: port}}
+	r.End.SumSent.Seconds, r.End.SumSent.Bytes = end-start, bytes
+	r.End.SumReceived.Seconds, r.End.SumReceived.Bytes = end-start, bytes
+	return r, nil
+}
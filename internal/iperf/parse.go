@@ -0,0 +1,92 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iperf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// maxExcerpt is the number of bytes of unexpected output quoted in errors.
+const maxExcerpt = 80
+
+// requiredFields are the fields of the "end" object of a result that the
+// exported metrics cannot do without.
+var requiredFields = []string{"sum_sent", "sum_received"}
+
+// Warning is a problem of a result that the lenient mode of Parse accepts.
+type Warning struct {
+	// Reason is type_mismatch or missing_field.
+	Reason  string
+	Message string
+}
+
+// CheckJSON returns an error when out is not a single JSON document, e.g. when a
+// localized build prints warnings on its standard output around the result.
+func CheckJSON(out []byte) error {
+	out = bytes.TrimSpace(out)
+	if len(out) > 0 && out[0] == '{' && json.Valid(out) {
+		return nil
+	}
+	excerpt := out
+	if i := bytes.IndexByte(excerpt, '\n'); i >= 0 {
+		excerpt = excerpt[:i]
+	}
+	if len(excerpt) > maxExcerpt {
+		excerpt = excerpt[:maxExcerpt]
+	}
+	return fmt.Errorf("output is not JSON: %q", excerpt)
+}
+
+// Parse decodes the JSON output of iperf3. Fields that Result does not know
+// about are always ignored, as iperf3 reports much more than is exported. In
+// strict mode, a field of an unexpected type or a missing required field is
+// an error; otherwise, the rest of the result is returned along with warnings,
+// so that newer iperf3 releases changing their output can still be used.
+func Parse(out []byte, strict bool) (*Result, []Warning, error) {
+	var warnings []Warning
+	r := &Result{}
+	if err := json.Unmarshal(out, r); err != nil {
+		typeErr, ok := err.(*json.UnmarshalTypeError)
+		if !ok || strict {
+			return nil, nil, err
+		}
+		warnings = append(warnings, Warning{Reason: "type_mismatch", Message: fmt.Sprintf("field %q has unexpected type %s", typeErr.Field, typeErr.Value)})
+	}
+
+	var raw struct {
+		End map[string]json.RawMessage `json:"end"`
+	}
+	// The output is known to be valid JSON at this point, and a type error
+	// leaves End empty, which is reported below.
+	_ = json.Unmarshal(out, &raw)
+	if _, ok := raw.End["sum"]; ok && raw.End["sum_sent"] == nil && raw.End["sum_received"] == nil {
+		// Older iperf3 releases report a single total for UDP tests, which
+		// stands for both sides.
+		r.End.SumSent.Seconds, r.End.SumSent.Bytes = r.End.Sum.Seconds, r.End.Sum.Bytes
+		r.End.SumReceived.Seconds, r.End.SumReceived.Bytes = r.End.Sum.Seconds, r.End.Sum.Bytes
+		return r, warnings, nil
+	}
+	for _, name := range requiredFields {
+		if _, ok := raw.End[name]; ok {
+			continue
+		}
+		if strict {
+			return nil, nil, fmt.Errorf("missing field end.%s", name)
+		}
+		warnings = append(warnings, Warning{Reason: "missing_field", Message: fmt.Sprintf("no end.%s field", name)})
+	}
+	return r, warnings, nil
+}
@@ -0,0 +1,168 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iperf
+
+import (
+	"strings"
+	"testing"
+)
+
+const sampleResult = `{
+	"start": {"connected": [{"remote_port": 5201}], "test_start": {"num_streams": 2, "blksize": 131072, "duration": 5}},
+	"intervals": [{"sum": {"seconds": 1, "bytes": 1000, "bits_per_second": 8000}}],
+	"end": {
+		"streams": [
+			{"sender": {"bytes": 600, "seconds": 5, "sender": true}, "receiver": {"bytes": 590, "seconds": 5.1}},
+			{"sender": {"bytes": 400, "seconds": 4.9, "sender": true}, "receiver": {"bytes": 390, "seconds": 5.2}}
+		],
+		"sum_sent": {"seconds": 5, "bytes": 1000, "retransmits": 3},
+		"sum_received": {"seconds": 5.2, "bytes": 980}
+	}
+}`
+
+func TestParse(t *testing.T) {
+	r, warnings, err := Parse([]byte(sampleResult), true)
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	if len(warnings) != 0 {
+		t.Fatalf("Parse warnings = %v, want none", warnings)
+	}
+	if r.End.SumSent.Bytes != 1000 || r.End.SumSent.Retransmits != 3 || r.End.SumReceived.Bytes != 980 {
+		t.Fatalf("Parse end = %+v, want the sums of the output", r.End)
+	}
+	if r.Start.TestStart.NumStreams != 2 || r.Start.TestStart.Blksize != 131072 || r.Start.TestStart.Duration != 5 {
+		t.Fatalf("Parse test_start = %+v, want the parameters of the output", r.Start.TestStart)
+	}
+	if p := r.RemotePort(); p != 5201 {
+		t.Fatalf("RemotePort = %d, want 5201", p)
+	}
+
+	sender, receiver, clientSender := r.Perspectives()
+	if sender.Bytes != 1000 || sender.Seconds != 5 || receiver.Bytes != 980 || receiver.Seconds != 5.2 || !clientSender {
+		t.Fatalf("Perspectives = %+v, %+v, %t, want the sums of the streams", sender, receiver, clientSender)
+	}
+}
+
+func TestParseMissingFields(t *testing.T) {
+	out := []byte(`{"end": {"sum_sent": {"seconds": 1, "bytes": 10}}}`)
+	if _, _, err := Parse(out, true); err == nil || !strings.Contains(err.Error(), "end.sum_received") {
+		t.Fatalf("strict Parse error = %v, want the missing field", err)
+	}
+	r, warnings, err := Parse(out, false)
+	if err != nil {
+		t.Fatalf("lenient Parse: %s", err)
+	}
+	if len(warnings) != 1 || warnings[0].Reason != "missing_field" {
+		t.Fatalf("lenient Parse warnings = %+v, want a missing field", warnings)
+	}
+	if r.End.SumSent.Bytes != 10 {
+		t.Fatalf("lenient Parse sum_sent = %+v, want the fields present", r.End.SumSent)
+	}
+}
+
+func TestParseUDPSum(t *testing.T) {
+	out := []byte(`{"end": {"sum": {"seconds": 5, "bytes": 655360, "jitter_ms": 0.01, "lost_packets": 0}}}`)
+	r, warnings, err := Parse(out, true)
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	if len(warnings) != 0 {
+		t.Fatalf("Parse warnings = %v, want none", warnings)
+	}
+	if r.End.SumSent.Bytes != 655360 || r.End.SumReceived.Bytes != 655360 || r.End.SumReceived.Seconds != 5 {
+		t.Fatalf("Parse end = %+v, want the UDP sum on both sides", r.End)
+	}
+}
+
+func TestParseTypeMismatch(t *testing.T) {
+	out := []byte(`{"end": {"sum_sent": {"seconds": "1"}, "sum_received": {}}}`)
+	if _, _, err := Parse(out, true); err == nil {
+		t.Fatal("strict Parse of a type mismatch succeeded")
+	}
+	_, warnings, err := Parse(out, false)
+	if err != nil {
+		t.Fatalf("lenient Parse: %s", err)
+	}
+	if len(warnings) == 0 || warnings[0].Reason != "type_mismatch" {
+		t.Fatalf("lenient Parse warnings = %+v, want a type mismatch first", warnings)
+	}
+}
+
+func TestCheckJSON(t *testing.T) {
+	if err := CheckJSON([]byte("  " + sampleResult + "\n")); err != nil {
+		t.Fatalf("CheckJSON of a result: %s", err)
+	}
+	for _, out := range []string{"", "iperf3: error - unable to connect\nmore", "[1, 2]", `{"truncated":`} {
+		if err := CheckJSON([]byte(out)); err == nil {
+			t.Errorf("CheckJSON(%q) succeeded", out)
+		}
+	}
+	long := strings.Repeat("x", 200)
+	if err := CheckJSON([]byte(long)); err == nil || len(err.Error()) > maxExcerpt+40 {
+		t.Fatalf("CheckJSON of a long output = %v, want an excerpt", err)
+	}
+}
+
+func TestParseIperf2CSV(t *testing.T) {
+	out := []byte(`20210101000000,10.0.0.1,40000,10.0.0.2,5001,3,0.0-10.0,1000,800
+20210101000000,10.0.0.1,40001,10.0.0.2,5001,4,0.0-10.0,2000,1600
+20210101000000,10.0.0.1,0,10.0.0.2,5001,-1,0.0-10.0,3000,2400
+`)
+	r, err := ParseIperf2CSV(out)
+	if err != nil {
+		t.Fatalf("ParseIperf2CSV: %s", err)
+	}
+	if r.End.SumSent.Bytes != 3000 || r.End.SumSent.Seconds != 10 || r.End.SumReceived.Bytes != 3000 {
+		t.Fatalf("ParseIperf2CSV end = %+v, want the sum of the streams", r.End)
+	}
+	if p := r.RemotePort(); p != 5001 {
+		t.Fatalf("ParseIperf2CSV port = %d, want 5001", p)
+	}
+
+	for _, out := range []string{"", "not,enough,fields", "0,a,0,b,5001,3,bad,1000,800", "0,a,0,b,5001,3,0.0-10.0,x,800"} {
+		if _, err := ParseIperf2CSV([]byte(out)); err == nil {
+			t.Errorf("ParseIperf2CSV(%q) succeeded", out)
+		}
+	}
+}
+
+func TestAssemble(t *testing.T) {
+	out := []byte(`{"event": "start", "data": {"connected": [{"remote_port": 5202}]}}
+{"event": "interval", "data": {"sum": {"seconds": 1, "bytes": 10}}}
+{"event": "interval", "data": {"sum": {"seconds": 1, "bytes": 20}}}
+{"event": "end", "data": {"sum_sent": {"bytes": 30}, "sum_received": {"bytes": 29}}}
+`)
+	if !IsStream(out) {
+		t.Fatal("IsStream of --json-stream output = false")
+	}
+	if IsStream([]byte(sampleResult)) {
+		t.Fatal("IsStream of -J output = true")
+	}
+	doc, err := Assemble(out)
+	if err != nil {
+		t.Fatalf("Assemble: %s", err)
+	}
+	r, _, err := Parse(doc, true)
+	if err != nil {
+		t.Fatalf("Parse of the assembled document: %s", err)
+	}
+	if r.RemotePort() != 5202 || len(r.Intervals) != 2 || r.Intervals[1].Sum.Bytes != 20 || r.End.SumReceived.Bytes != 29 {
+		t.Fatalf("assembled result = %+v, want the events of the stream", r)
+	}
+
+	if _, err := Assemble([]byte("{\"event\": \"start\", \"data\": {}}\ngarbage")); err == nil {
+		t.Fatal("Assemble of a line that is not an event succeeded")
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package iperf decodes and classifies the output of the iperf3 client, and of
+// the iperf2 client for legacy servers.
+package iperf
+
+import "math"
+
+// StreamSummary is the end summary of one side of a stream. Sender is
+// set when the host running the client was the sender of the stream.
+type StreamSummary struct {
+	Seconds float64 `json:"seconds"`
+	Bytes   float64 `json:"bytes"`
+	Sender  bool    `json:"sender"`
+}
+
+// Result collects the partial result from the iperf3 run.
+type Result struct {
+	Start struct {
+		Connected []struct {
+			RemotePort int `json:"remote_port"`
+		} `json:"connected"`
+
+		// TestStart are the test parameters iperf3 actually used.
+		TestStart struct {
+			NumStreams int     `json:"num_streams"`
+			Blksize    int     `json:"blksize"`
+			Duration   float64 `json:"duration"`
+		} `json:"test_start"`
+	} `json:"start"`
+
+	// Intervals are the periodic reports of the test, every second by
+	// default.
+	Intervals []struct {
+		Sum struct {
+			Seconds       float64 `json:"seconds"`
+			Bytes         float64 `json:"bytes"`
+			BitsPerSecond float64 `json:"bits_per_second"`
+			Omitted       bool    `json:"omitted"`
+		} `json:"sum"`
+	} `json:"intervals"`
+
+	End struct {
+		Streams []struct {
+			Sender   StreamSummary `json:"sender"`
+			Receiver StreamSummary `json:"receiver"`
+		} `json:"streams"`
+		SumSent struct {
+			Seconds     float64 `json:"seconds"`
+			Bytes       float64 `json:"bytes"`
+			Retransmits float64 `json:"retransmits"`
+		} `json:"sum_sent"`
+		SumReceived struct {
+			Seconds float64 `json:"seconds"`
+			Bytes   float64 `json:"bytes"`
+		} `json:"sum_received"`
+
+		// Sum is the only total of the UDP tests of older iperf3 releases.
+		Sum struct {
+			Seconds float64 `json:"seconds"`
+			Bytes   float64 `json:"bytes"`
+		} `json:"sum"`
+
+		// The reverse direction of a --bidir test.
+		SumSentBidirReverse struct {
+			Seconds float64 `json:"seconds"`
+			Bytes   float64 `json:"bytes"`
+		} `json:"sum_sent_bidir_reverse"`
+		SumReceivedBidirReverse struct {
+			Seconds float64 `json:"seconds"`
+			Bytes   float64 `json:"bytes"`
+		} `json:"sum_received_bidir_reverse"`
+	} `json:"end"`
+
+	// ServerOutput is the result reported by the server with
+	// --get-server-output.
+	ServerOutput *Result `json:"server_output_json"`
+
+	// RequestedPeriod is the test period in seconds the exporter asked for,
+	// possibly shortened when the test was admitted. It is not part of the
+	// iperf3 output.
+	RequestedPeriod float64 `json:"requested_period_seconds,omitempty"`
+}
+
+// RemotePort returns the server port of the test, or zero if it is unknown.
+func (r *Result) RemotePort() int {
+	if len(r.Start.Connected) == 0 {
+		return 0
+	}
+	return r.Start.Connected[0].RemotePort
+}
+
+// Perspectives sums the stream summaries by the side that measured them, and
+// reports whether the client was the sender according to the streams' sender
+// flags.
+func (r *Result) Perspectives() (sender StreamSummary, receiver StreamSummary, clientSender bool) {
+	for i, s := range r.End.Streams {
+		if i == 0 {
+			clientSender = s.Sender.Sender
+		}
+		sender.Bytes += s.Sender.Bytes
+		sender.Seconds = math.Max(sender.Seconds, s.Sender.Seconds)
+		receiver.Bytes += s.Receiver.Bytes
+		receiver.Seconds = math.Max(receiver.Seconds, s.Receiver.Seconds)
+	}
+	return sender, receiver, clientSender
+}
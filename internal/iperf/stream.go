@@ -0,0 +1,72 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iperf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// streamEvent is a line of the --json-stream output of iperf3 3.17 or later.
+type streamEvent struct {
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// IsStream reports whether out is --json-stream output rather than a single
+// JSON document.
+func IsStream(out []byte) bool {
+	line := bytes.TrimSpace(out)
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	var e streamEvent
+	return json.Unmarshal(line, &e) == nil && e.Event != ""
+}
+
+// Assemble turns --json-stream output into the JSON document iperf3 prints
+// with -J, so that it can be parsed the same way. Lines that are not JSON
+// events are an error.
+func Assemble(out []byte) ([]byte, error) {
+	doc := map[string]json.RawMessage{}
+	var intervals []json.RawMessage
+	for _, line := range bytes.Split(bytes.TrimSpace(out), []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		var e streamEvent
+		if json.Unmarshal(line, &e) != nil || e.Event == "" {
+			if len(line) > maxExcerpt {
+				line = line[:maxExcerpt]
+			}
+			return nil, fmt.Errorf("output is not a JSON event: %q", line)
+		}
+		switch e.Event {
+		case "interval":
+			intervals = append(intervals, e.Data)
+		case "start", "end", "error", "server_output_json":
+			doc[e.Event] = e.Data
+		}
+	}
+	if len(intervals) > 0 {
+		b, err := json.Marshal(intervals)
+		if err != nil {
+			return nil, err
+		}
+		doc["intervals"] = b
+	}
+	return json.Marshal(doc)
+}
@@ -0,0 +1,83 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"sort"
+
+	"github.com/edgard/iperf3_exporter/internal/iperf"
+)
+
+// intervalQuantiles are the quantiles of the interval throughput exported,
+// the low ones showing stalls hidden by the average.
+var intervalQuantiles = []float64{0.1, 0.5, 0.9}
+
+// intervalStats summarizes the throughput of the intervals of a test.
+type intervalStats struct {
+	count     int
+	sum       float64
+	min, max  float64
+	stddev    float64
+	quantiles map[float64]float64
+}
+
+// cv returns the coefficient of variation of the interval throughput, its
+// standard deviation relative to its mean. ok is false when no data was
+// transferred.
+func (s intervalStats) cv() (cv float64, ok bool) {
+	if s.sum == 0 {
+		return 0, false
+	}
+	return s.stddev / (s.sum / float64(s.count)), true
+}
+
+// summarizeIntervals returns the statistics of the throughput of the
+// intervals of stats, leaving out those omitted by iperf3. ok is false
+// without intervals.
+func summarizeIntervals(stats *iperf.Result) (s intervalStats, ok bool) {
+	var sorted []float64
+	for _, i := range stats.Intervals {
+		if !i.Sum.Omitted {
+			sorted = append(sorted, i.Sum.BitsPerSecond)
+		}
+	}
+	if len(sorted) == 0 {
+		return s, false
+	}
+	sort.Float64s(sorted)
+
+	s.count = len(sorted)
+	s.min, s.max = sorted[0], sorted[len(sorted)-1]
+	for _, v := range sorted {
+		s.sum += v
+	}
+	mean := s.sum / float64(s.count)
+	var variance float64
+	for _, v := range sorted {
+		variance += (v - mean) * (v - mean)
+	}
+	s.stddev = math.Sqrt(variance / float64(s.count))
+
+	// Nearest-rank quantiles, as there are only a few intervals.
+	s.quantiles = map[float64]float64{}
+	for _, q := range intervalQuantiles {
+		rank := int(math.Ceil(q*float64(s.count))) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		s.quantiles[q] = sorted[rank]
+	}
+	return s, true
+}
@@ -0,0 +1,103 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestSummarizeIntervals(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		output    string
+		ok        bool
+		count     int
+		min, max  float64
+		quantiles map[float64]float64
+	}{
+		{
+			name:   "no intervals",
+			output: `{}`,
+		},
+		{
+			name:   "omitted only",
+			output: `{"intervals": [{"sum": {"bits_per_second": 10, "omitted": true}}]}`,
+		},
+		{
+			name:      "single",
+			output:    `{"intervals": [{"sum": {"bits_per_second": 10}}]}`,
+			ok:        true,
+			count:     1,
+			min:       10,
+			max:       10,
+			quantiles: map[float64]float64{0.1: 10, 0.5: 10, 0.9: 10},
+		},
+		{
+			name: "ten",
+			output: `{"intervals": [
+				{"sum": {"bits_per_second": 1000, "omitted": true}},
+				{"sum": {"bits_per_second": 50}}, {"sum": {"bits_per_second": 10}},
+				{"sum": {"bits_per_second": 90}}, {"sum": {"bits_per_second": 30}},
+				{"sum": {"bits_per_second": 70}}, {"sum": {"bits_per_second": 20}},
+				{"sum": {"bits_per_second": 100}}, {"sum": {"bits_per_second": 40}},
+				{"sum": {"bits_per_second": 60}}, {"sum": {"bits_per_second": 80}}
+			]}`,
+			ok:        true,
+			count:     10,
+			min:       10,
+			max:       100,
+			quantiles: map[float64]float64{0.1: 10, 0.5: 50, 0.9: 90},
+		},
+		{
+			name: "four",
+			output: `{"intervals": [
+				{"sum": {"bits_per_second": 40}}, {"sum": {"bits_per_second": 10}},
+				{"sum": {"bits_per_second": 30}}, {"sum": {"bits_per_second": 20}}
+			]}`,
+			ok:        true,
+			count:     4,
+			min:       10,
+			max:       40,
+			quantiles: map[float64]float64{0.1: 10, 0.5: 20, 0.9: 40},
+		},
+	} {
+		s, ok := summarizeIntervals(testResult(t, tc.output))
+		if ok != tc.ok {
+			t.Errorf("%s: got ok %t, want %t", tc.name, ok, tc.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if s.count != tc.count || s.min != tc.min || s.max != tc.max {
+			t.Errorf("%s: got count %d, min %g, max %g, want %d, %g, %g", tc.name, s.count, s.min, s.max, tc.count, tc.min, tc.max)
+		}
+		if !reflect.DeepEqual(s.quantiles, tc.quantiles) {
+			t.Errorf("%s: got quantiles %v, want %v", tc.name, s.quantiles, tc.quantiles)
+		}
+	}
+}
+
+func TestIntervalCV(t *testing.T) {
+	s, _ := summarizeIntervals(testResult(t, `{"intervals": [{"sum": {"bits_per_second": 10}}, {"sum": {"bits_per_second": 30}}]}`))
+	if cv, ok := s.cv(); !ok || math.Abs(cv-0.5) > 1e-9 || s.stddev != 10 {
+		t.Errorf("got cv %g, %t, stddev %g, want 0.5, true, 10", cv, ok, s.stddev)
+	}
+	s, _ = summarizeIntervals(testResult(t, `{"intervals": [{"sum": {"bits_per_second": 0}}]}`))
+	if _, ok := s.cv(); ok {
+		t.Error("got a cv without data transferred")
+	}
+}
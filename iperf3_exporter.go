@@ -15,90 +15,629 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	cryptorand "crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
-	"os/exec"
+	"net/url"
+	"os"
+	"os/signal"
+	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	_ "net/http/pprof"
+	"net/http/pprof"
 
+	"github.com/edgard/iperf3_exporter/internal/cache"
+	"github.com/edgard/iperf3_exporter/internal/config"
+	"github.com/edgard/iperf3_exporter/internal/host"
+	"github.com/edgard/iperf3_exporter/internal/iperf"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/prometheus/common/log"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/version"
+	"github.com/prometheus/exporter-toolkit/web"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
 const (
 	namespace = "iperf3"
+
+	// maxThreads is the highest number of parallel streams iperf3 accepts.
+	maxThreads = 128
+
+	// maxFlowLabel is the highest IPv6 flow label (20 bits).
+	maxFlowLabel = 1<<20 - 1
+
+	labelParamPrefix = "label_"
+
+	// periodMargin is the part of the probe timeout reserved for connection
+	// setup and results exchange when the test period has to be shortened.
+	periodMargin = 2 * time.Second
+
+	// maxTimeout caps the probe timeout.
+	maxTimeout = 30 * time.Second
 )
 
 var (
-	listenAddress = kingpin.Flag("web.listen-address", "Address to listen on for web interface and telemetry.").Default(":9579").String()
-	metricsPath   = kingpin.Flag("web.telemetry-path", "Path under which to expose metrics.").Default("/metrics").String()
-	timeout       = kingpin.Flag("iperf3.timeout", "iperf3 run timeout.").Default("30s").Duration()
+	configFile     = kingpin.Flag("config.file", "iperf3 exporter configuration file.").Default("").String()
+	listenAddress  = kingpin.Flag("web.listen-address", "Address to listen on for web interface and telemetry.").Default(":9579").String()
+	metricsPath    = kingpin.Flag("web.telemetry-path", "Path under which to expose metrics.").Default("/metrics").String()
+	externalURL    = kingpin.Flag("web.external-url", "URL under which the exporter is externally reachable, e.g. behind a reverse proxy (used in links and as the default route prefix).").Default("").String()
+	maxSeries      = kingpin.Flag("web.max-series", "Series exported on the metrics path and by the recent probes above which probes only export summaries (disabled if zero).").Default("0").Int()
+	metricNaming   = kingpin.Flag("web.metric-naming", "Naming of the probe metrics: default, or upstream for the names of the edgard/iperf3_exporter releases (iperf3_up, no side label, iperf3_retransmits).").Default("default").Enum("default", "upstream")
+	routePrefix    = kingpin.Flag("web.route-prefix", "Prefix of the internal routes (defaults to the path of web.external-url).").Default("").String()
+	webConfigFile  = kingpin.Flag("web.config.file", "Exporter toolkit web configuration file enabling TLS and client certificate verification (plain HTTP if empty).").Default("").String()
+	timeout        = kingpin.Flag("iperf3.timeout", "iperf3 run timeout.").Default("30s").Duration()
+	allowedLabels  = kingpin.Flag("probe.allowed-label", "Label name that can be attached to probe metrics with a label_<name> parameter (repeatable).").Strings()
+	minPeriod      = kingpin.Flag("iperf3.min-period", "Shortest test period used when the period is shortened to fit the probe timeout.").Default("1s").Duration()
+	minVersion     = kingpin.Flag("iperf3.min-version", "Minimum version of the iperf3 binaries, checked on start and on configuration reloads, e.g. 3.7 (disabled if empty).").Default("").String()
+	iperfPath      = kingpin.Flag("iperf3.path", "Path or name in the PATH of the iperf3 binary, checked on start.").Default(iperfCmd).String()
+	iperfWrapper   = kingpin.Flag("iperf3.wrapper", "Command the local iperf3 client is run through, e.g. \"taskset -c 2\" (split on spaces).").Default("").String()
+	busyRetries    = kingpin.Flag("iperf3.busy-retries", "How many times a test is retried when the iperf3 server is busy running another test.").Default("0").Int()
+	busyDelay      = kingpin.Flag("iperf3.busy-retry-delay", "Delay before the first retry of a test refused by a busy server, doubling with every retry.").Default("1s").Duration()
+	iperfLocale    = kingpin.Flag("iperf3.locale", "Locale the iperf3 client runs with, so that its output is not localized (the exporter environment is kept if empty).").Default("C").String()
+	iperfBackend   = kingpin.Flag("iperf3.backend", "Test client of the probes without a module backend: the iperf3 binary or the native iperf3 protocol client.").Default("iperf3").Enum("iperf3", "native")
+	jsonStream     = kingpin.Flag("iperf3.json-stream", "Have iperf3 3.17 or later stream its intervals as line-delimited JSON (older binaries report them at the end of the test).").Default("false").Bool()
+	parseMode      = kingpin.Flag("iperf3.parse-mode", "How iperf3 results of an unexpected shape are handled: lenient uses what can be parsed, strict fails the probe.").Default("lenient").Enum("lenient", "strict")
+	reaperInterval = kingpin.Flag("iperf3.reaper-interval", "Interval between the sweeps looking for, and killing, the processes left running by finished iperf3 tests, on Linux (disabled if zero).").Default("1m").Duration()
+
+	connectCheck   = kingpin.Flag("iperf3.connect-check", "Check that the iperf3 server accepts TCP connections before running the test.").Default("false").Bool()
+	connectTimeout = kingpin.Flag("iperf3.connect-timeout", "Timeout of the TCP connection check.").Default("2s").Duration()
+
+	consulServer   = kingpin.Flag("consul.server", "Consul server URL to discover iperf3 servers from (disabled if empty).").Default("").String()
+	consulToken    = kingpin.Flag("consul.token", "Consul ACL token.").Default("").String()
+	consulSecret   = kingpin.Flag("consul.token-secret", "Secret reference of the Consul ACL token, e.g. vault:secret/data/consul#token.").Default("").String()
+	consulServices = kingpin.Flag("consul.service", "Consul service name of the iperf3 servers (repeatable).").Default("iperf3").Strings()
+	consulRefresh  = kingpin.Flag("consul.refresh-interval", "Interval between Consul discovery refreshes.").Default("30s").Duration()
+
+	dnsSDNames   = kingpin.Flag("dns-sd.name", "DNS SRV record to discover iperf3 servers from, e.g. _iperf._tcp.example.com (repeatable).").Strings()
+	dnsSDRefresh = kingpin.Flag("dns-sd.refresh-interval", "Interval between DNS SRV refreshes when the record TTL is unknown.").Default("30s").Duration()
+
+	kubernetesSelector  = kingpin.Flag("kubernetes.label-selector", "Label selector of the Kubernetes pods or nodes running iperf3 servers (disabled if empty).").Default("").String()
+	kubernetesRole      = kingpin.Flag("kubernetes.role", "Kubernetes objects to discover iperf3 servers from.").Default("pod").Enum("pod", "node")
+	kubernetesNamespace = kingpin.Flag("kubernetes.namespace", "Kubernetes namespace of the iperf3 server pods (all namespaces if empty).").Default("").String()
+	kubernetesPort      = kingpin.Flag("kubernetes.port", "iperf3 port of the discovered Kubernetes pods or nodes.").Default("5201").Int()
+	kubernetesRefresh   = kingpin.Flag("kubernetes.refresh-interval", "Interval between Kubernetes discovery refreshes.").Default("30s").Duration()
+
+	serverEnable       = kingpin.Flag("server.enable", "Also run and supervise a local iperf3 server.").Default("false").Bool()
+	serverPort         = kingpin.Flag("server.port", "Port of the supervised iperf3 server.").Default("5201").Int()
+	serverRestartDelay = kingpin.Flag("server.restart-delay", "Initial delay before restarting the supervised iperf3 server when it exits.").Default("1s").Duration()
+
+	agentExporter  = kingpin.Flag("agent.exporter-address", "Run as an agent streaming the results of the configured targets to the exporter gRPC address instead of serving metrics.").Default("").String()
+	agentName      = kingpin.Flag("agent.name", "Name of the agent (defaults to the hostname).").Default("").String()
+	agentInterval  = kingpin.Flag("agent.interval", "Interval between agent test rounds.").Default("1m").Duration()
+	agentPeriod    = kingpin.Flag("agent.period", "Period of the agent tests.").Default("5s").Duration()
+	agentTLS       = kingpin.Flag("agent.tls", "Connect to the exporter over TLS, implied by the other agent.tls flags.").Default("false").Bool()
+	agentCAFile    = kingpin.Flag("agent.tls-ca-file", "File with the CA certificates verifying the exporter (system CAs if empty).").Default("").String()
+	agentCertFile  = kingpin.Flag("agent.tls-cert-file", "File with the client certificate of the agent (none if empty).").Default("").String()
+	agentKeyFile   = kingpin.Flag("agent.tls-key-file", "File with the key of the agent client certificate.").Default("").String()
+	agentServer    = kingpin.Flag("agent.tls-server-name", "Name the exporter certificate is verified against (host of agent.exporter-address if empty).").Default("").String()
+	agentTokenFile = kingpin.Flag("agent.token-file", "File with the bearer token sent to the exporter (none if empty).").Default("").String()
+	grpcAddress    = kingpin.Flag("grpc.listen-address", "Address to receive agent results on (disabled if empty).").Default("").String()
+	grpcCertFile   = kingpin.Flag("grpc.tls-cert-file", "File with the TLS certificate of the agent listener (plaintext if empty).").Default("").String()
+	grpcKeyFile    = kingpin.Flag("grpc.tls-key-file", "File with the key of the agent listener TLS certificate.").Default("").String()
+	grpcClientCA   = kingpin.Flag("grpc.tls-client-ca-file", "File with the CA certificates agent client certificates must be signed by (not required if empty).").Default("").String()
+	grpcTokenFile  = kingpin.Flag("grpc.token-file", "File with the bearer token agents must send (not required if empty).").Default("").String()
+
+	meshName = kingpin.Flag("mesh.name", "Name of this exporter instance among the mesh peers (defaults to the hostname).").Default("").String()
+
+	cacheTTLFlag    = kingpin.Flag("cache.ttl", "How long successful probe results are reused, e.g. 90s or 15m (disabled if zero, defaults to the CACHE_TIME environment variable in minutes).").Default("0s").Duration()
+	cacheMaxEntries = kingpin.Flag("cache.max-entries", "Maximum number of cached results, the least recently used being evicted (unlimited if zero).").Default("1000").Int()
+	cacheStale      = kingpin.Flag("cache.stale-while-revalidate", "How long past their TTL cached results are still served while a new test runs in the background (disabled if zero).").Default("0s").Duration()
+	cacheFile       = kingpin.Flag("cache.file", "File to persist the result cache to across restarts (disabled if empty).").Default("").String()
+	cacheInterval   = kingpin.Flag("cache.persist-interval", "Interval between writes of the result cache file.").Default("1m").Duration()
+	cacheDisable    = kingpin.Flag("cache.disable", "Disable the probe result cache, including for probes with a cache_ttl parameter.").Default("false").Bool()
+
+	backoffInitial = kingpin.Flag("cache.failure-backoff", "How long a failed test is reported again instead of retried, doubling with every consecutive failure (disabled if zero).").Default("0s").Duration()
+	backoffMax     = kingpin.Flag("cache.failure-backoff-max", "Longest window a failed test is reported again instead of retried.").Default("10m").Duration()
+
+	admissionMaxLoad   = kingpin.Flag("admission.max-load", "1-minute load average per CPU above which the exporter host is too busy to run tests (disabled if zero).").Default("0").Float64()
+	admissionMinMemory = kingpin.Flag("admission.min-available-memory", "Available memory below which the exporter host is too busy to run tests, e.g. 256MB (disabled if zero).").Default("0").Bytes()
+	admissionMaxNIC    = kingpin.Flag("admission.max-nic-utilization", "Utilization of the interface to the target, between 0 and 1, above which tests are not run (disabled if zero).").Default("0").Float64()
+	admissionAction    = kingpin.Flag("admission.action", "What happens to the tests of an overloaded exporter host: defer them or shorten them to iperf3.min-period.").Default("defer").Enum("defer", "shorten")
+	admissionMaxDelay  = kingpin.Flag("admission.max-delay", "Longest time a test is deferred before being skipped.").Default("10s").Duration()
+
+	grafanaURL    = kingpin.Flag("grafana.url", "Grafana URL to create annotations of failures, recoveries, skipped tests and suspected duplex mismatches on (disabled if empty).").Default("").String()
+	grafanaAPIKey = kingpin.Flag("grafana.api-key", "Grafana API key or service account token.").Default("").String()
+	grafanaSecret = kingpin.Flag("grafana.api-key-secret", "Secret reference of the Grafana API key or service account token, e.g. vault:secret/data/grafana#token.").Default("").String()
+	grafanaTags   = kingpin.Flag("grafana.tag", "Tag of the Grafana annotations (repeatable).").Default("iperf3").Strings()
+
+	replayDirectory = kingpin.Flag("replay.directory", "Directory of recorded iperf3 JSON results to serve instead of running iperf3 (disabled if empty).").Default("").String()
+
+	statsFile     = kingpin.Flag("stats.file", "File to persist exporter statistics to across restarts (disabled if empty).").Default("").String()
+	statsInterval = kingpin.Flag("stats.persist-interval", "Interval between writes of the exporter statistics file.").Default("1m").Duration()
+
+	probeRateLimit = kingpin.Flag("probe.rate-limit", "Probes per second accepted from each client IP address, refused with a 429 above (disabled if zero).").Default("0").Float64()
+	probeRateBurst = kingpin.Flag("probe.rate-burst", "Probes accepted at once from each client IP address within the probe rate limit.").Default("5").Int()
+
+	cachedTimestamps = kingpin.Flag("probe.cached-timestamps", "Attach the time they were measured to the metrics of cached results, and serve OpenMetrics to the scrapers accepting it.").Default("false").Bool()
+	multiConcurrency = kingpin.Flag("probe.multi-concurrency", "Targets of a /probe_multi request probed at once.").Default("4").Int()
+
+	topologyFile     = kingpin.Flag("topology.signal-file", "File whose modification signals a topology change, e.g. a failover, for the targets it lists one per line or for every target if empty (disabled if empty).").Default("").String()
+	topologyInterval = kingpin.Flag("topology.poll-interval", "Interval between checks of the topology signal file.").Default("5s").Duration()
+
+	pprofEnable  = kingpin.Flag("debug.pprof", "Serve the pprof profiling endpoints under /debug/pprof/.").Default("false").Bool()
+	debugAddress = kingpin.Flag("debug.listen-address", "Separate address to serve the pprof endpoints on, e.g. localhost:6060 (the web listen address if empty).").Default("").String()
+	historySize  = kingpin.Flag("debug.probe-history", "Number of the latest iperf3 runs shown on /debug/probes (disabled if zero).").Default("100").Int()
+
+	registerAddress  = kingpin.Flag("register.address", "Address Prometheus scrapes the exporter at, announced when registering (the host name and the port of web.listen-address if empty).").Default("").String()
+	registerLabels   = kingpin.Flag("register.label", "Label of the exporter instance announced when registering, name=value (repeatable).").Strings()
+	registerConsul   = kingpin.Flag("register.consul-server", "Consul agent URL to register the exporter instance with on start and to deregister it from on shutdown (disabled if empty).").Default("").String()
+	registerService  = kingpin.Flag("register.consul-service", "Consul service name the exporter instance is registered as.").Default("iperf3_exporter").String()
+	registerHTTP     = kingpin.Flag("register.http-url", "HTTP service discovery bridge URL to POST the exporter instance to on start, and to DELETE it from on shutdown (disabled if empty).").Default("").String()
+	registerInterval = kingpin.Flag("register.interval", "Interval between registrations of the exporter instance, which expire on some bridges.").Default("1m").Duration()
+
+	shutdownGrace = kingpin.Flag("web.shutdown-grace", "Time the running scrapes are given to complete on SIGTERM or SIGINT before their iperf3 tests are canceled.").Default("5s").Duration()
+
+	targetsFile = kingpin.Flag("targets.file", "File the targets added and removed through /api/v1/targets are persisted to and loaded from on start (kept in memory if empty).").Default("").String()
+
+	logLevel  = kingpin.Flag("log.level", "Only log messages with the given severity or above: debug, info, warn or error.").Default("info").Enum("debug", "info", "warn", "error")
+	logFormat = kingpin.Flag("log.format", "Format of the log messages: logfmt or json.").Default("logfmt").Enum("logfmt", "json")
+
+	slaWindow         = kingpin.Flag("sla.window", "Window of the tests the SLA compliance of the targets with an expected bandwidth is computed over.").Default("24h").Duration()
+	slaCompliantRatio = kingpin.Flag("sla.compliant-ratio", "Ratio of the expected bandwidth of a target from which a test is SLA compliant.").Default("0.9").Float64()
+
+	historyFile      = kingpin.Flag("history.file", "SQLite database storing the results of the probe tests for /api/v1/history (disabled if empty).").Default("").String()
+	historyRetention = kingpin.Flag("history.retention", "How long the results of the history are kept.").Default("720h").Duration()
+
+	pushURL             = kingpin.Flag("push.remote-write-url", "Prometheus remote write URL to push the results of the configured and discovered targets to, probed every push interval (disabled if empty).").Default("").String()
+	pushInterval        = kingpin.Flag("push.interval", "Interval between probes of the targets pushed to the remote write URL.").Default("5m").Duration()
+	pushJob             = kingpin.Flag("push.job", "Job label of the pushed series.").Default("iperf3").String()
+	pushInstance        = kingpin.Flag("push.instance", "Instance label of the pushed series (the host name if empty).").Default("").String()
+	pushBearerTokenFile = kingpin.Flag("push.bearer-token-file", "File with the bearer token of the remote write requests (none if empty).").Default("").String()
+
+	influxURL         = kingpin.Flag("influx.url", "InfluxDB write URL, e.g. http://influxdb:8086/api/v2/write?org=example&bucket=iperf3, or udp, tcp or unix socket URL, e.g. udp://telegraf:8094, the result of every test is written to in line protocol (disabled if empty).").Default("").String()
+	influxTokenFile   = kingpin.Flag("influx.token-file", "File with the InfluxDB API token of the HTTP writes (none if empty).").Default("").String()
+	influxMeasurement = kingpin.Flag("influx.measurement", "Measurement of the lines written to the InfluxDB output.").Default("iperf3").String()
+
+	kafkaBrokers          = kingpin.Flag("kafka.broker", "Kafka broker address, host:port, the result of every test is published to (repeatable, disabled if none).").Strings()
+	kafkaTopic            = kingpin.Flag("kafka.topic", "Kafka topic the results are published to.").Default("iperf3-results").String()
+	kafkaTLS              = kingpin.Flag("kafka.tls", "Connect to the Kafka brokers over TLS.").Default("false").Bool()
+	kafkaSASLUsername     = kingpin.Flag("kafka.sasl-username", "SASL PLAIN username of the Kafka brokers (no authentication if empty).").Default("").String()
+	kafkaSASLPasswordFile = kingpin.Flag("kafka.sasl-password-file", "File with the SASL PLAIN password of the Kafka brokers.").Default("").String()
+
+	mqttBroker       = kingpin.Flag("mqtt.broker", "MQTT broker URL, e.g. tcp://broker:1883 or ssl://broker:8883, the result of every test is published to (disabled if empty).").Default("").String()
+	mqttTopic        = kingpin.Flag("mqtt.topic", "MQTT topic prefix the results are published under, each on the topic of its target.").Default("iperf3/results").String()
+	mqttQoS          = kingpin.Flag("mqtt.qos", "MQTT quality of service of the published results: 0, 1 or 2.").Default("1").Enum("0", "1", "2")
+	mqttRetain       = kingpin.Flag("mqtt.retain", "Have the MQTT broker retain the latest result of every target.").Default("false").Bool()
+	mqttClientID     = kingpin.Flag("mqtt.client-id", "MQTT client identifier (iperf3_exporter- and the host name if empty).").Default("").String()
+	mqttUsername     = kingpin.Flag("mqtt.username", "MQTT username (no authentication if empty).").Default("").String()
+	mqttPasswordFile = kingpin.Flag("mqtt.password-file", "File with the MQTT password.").Default("").String()
+
+	janitorInterval = kingpin.Flag("janitor.interval", "Interval between sweeps of the janitor directories of the configuration file.").Default("10m").Duration()
+
+	sc = &config.SafeConfig{C: &config.Config{}, ResolveSecret: resolveSecret}
+
+	// runContext is the parent of the contexts of the tests, canceled on
+	// shutdown so that no iperf3 process outlives the exporter.
+	runContext, cancelRuns = context.WithCancel(context.Background())
 
 	// Metrics about the iperf3 exporter itself.
 	iperfDuration = prometheus.NewSummary(prometheus.SummaryOpts{Name: prometheus.BuildFQName(namespace, "exporter", "duration_seconds"), Help: "Duration of collections by the iperf3 exporter."})
 	iperfErrors   = prometheus.NewCounter(prometheus.CounterOpts{Name: prometheus.BuildFQName(namespace, "exporter", "errors_total"), Help: "Errors raised by the iperf3 exporter."})
+	iperfTests    = prometheus.NewCounter(prometheus.CounterOpts{Name: prometheus.BuildFQName(namespace, "exporter", "tests_total"), Help: "iperf3 tests run by the iperf3 exporter."})
+
+	iperfTransferredBytes = prometheus.NewCounter(prometheus.CounterOpts{Name: prometheus.BuildFQName(namespace, "exporter", "transferred_bytes_total"), Help: "Bytes sent by the iperf3 tests run by the exporter."})
+	busyRetryCount        = prometheus.NewCounter(prometheus.CounterOpts{Name: prometheus.BuildFQName(namespace, "exporter", "busy_retries_total"), Help: "Tests retried because the iperf3 server was busy."})
+	portFallbacks         = prometheus.NewCounter(prometheus.CounterOpts{Name: prometheus.BuildFQName(namespace, "exporter", "port_fallbacks_total"), Help: "Tests moved to the next port of their target because the iperf3 server was busy."})
+
+	startTime    = prometheus.NewGauge(prometheus.GaugeOpts{Name: prometheus.BuildFQName(namespace, "exporter", "start_time_seconds"), Help: "Start time of the iperf3 exporter."})
+	shuttingDown = prometheus.NewGauge(prometheus.GaugeOpts{Name: prometheus.BuildFQName(namespace, "exporter", "shutting_down"), Help: "Whether the iperf3 exporter is shutting down."})
 )
 
-// iperfResult collects the partial result from the iperf3 run
-type iperfResult struct {
-	End struct {
-		SumSent struct {
-			Seconds float64 `json:"seconds"`
-			Bytes   float64 `json:"bytes"`
-		} `json:"sum_sent"`
-		SumReceived struct {
-			Seconds float64 `json:"seconds"`
-			Bytes   float64 `json:"bytes"`
-		} `json:"sum_received"`
-	} `json:"end"`
+// iperfOptions are the parameters of an iperf3 client run.
+type iperfOptions struct {
+	target  string
+	port    int
+	period  time.Duration
+	threads int
+	auth    *config.Auth
+	runner  runner
+
+	// backend is the test client, that of --iperf3.backend if nil.
+	backend backend
+
+	// flowLabel is the IPv6 flow label of the test, if non-zero.
+	flowLabel int
+
+	// labels are extra labels attached to the metrics of the probe.
+	labels map[string]string
+
+	serverOutput bool
+	bidir        bool
+	// udp tests with UDP rather than TCP, and reverse has the server send.
+	udp     bool
+	reverse bool
+
+	// fallbackPorts are tried in turn when the server on port is busy.
+	fallbackPorts []int
+}
+
+// runIperf runs the test against the target with the backend of o.
+func runIperf(ctx context.Context, o iperfOptions) (*iperf.Result, error) {
+	b := o.backend
+	if b == nil {
+		b = backendOf("")
+	}
+	// Recordings are iperf3 JSON output, whatever the backend.
+	if _, ok := b.(nativeBackend); ok && *replayDirectory != "" {
+		b = iperf3Backend{}
+	}
+
+	iperfTests.Inc()
+	stats, err := b.Run(ctx, o)
+	if err != nil {
+		return nil, err
+	}
+
+	iperfTransferredBytes.Add(stats.End.SumSent.Bytes)
+	return stats, nil
+}
+
+// runCommand runs a test client binary with args and env through the runner
+// of o, or replays a recording, and parses its output with parse.
+func runCommand(ctx context.Context, o iperfOptions, args []string, env []string, parse func([]byte) (*iperf.Result, error)) (*iperf.Result, error) {
+	r := o.runner
+	if r == nil {
+		r = localRunner{}
+	}
+	if *replayDirectory != "" {
+		r = replayRunner{dir: *replayDirectory, target: o.target}
+	}
+
+	execCtx, span := tracer.Start(ctx, "exec iperf3", trace.WithAttributes(attribute.StringSlice("iperf3.args", args)))
+	start := time.Now()
+	out, err := r.Output(execCtx, args, env)
+	probeAttempts.Add(newProbeAttempt(o, args, start, err))
+	traceRun(ctx, args, start, out, err)
+	if err != nil {
+		// iperf3 still prints its JSON output, with the error, when it fails.
+		reason := iperf.FailureReason(ctx, out, err)
+		iperfFailures.WithLabelValues(reason).Inc()
+		span.SetAttributes(attribute.String("iperf3.failure_reason", reason))
+		if msg := iperf.ErrorMessage(out); msg != "" {
+			err = &testError{reason: reason, err: fmt.Errorf("failed to run iperf3: %s: %s", err, msg)}
+		} else {
+			err = &testError{reason: reason, err: fmt.Errorf("failed to run iperf3: %s", err)}
+		}
+		endSpan(span, err)
+		return nil, err
+	}
+	endSpan(span, nil)
+
+	_, span = tracer.Start(ctx, "parse result", trace.WithAttributes(attribute.Int("iperf3.output_bytes", len(out))))
+	stats, err := parse(out)
+	if stats != nil {
+		span.SetAttributes(resultAttributes(stats)...)
+	}
+	endSpan(span, err)
+	return stats, err
+}
+
+// runIperfRetrying runs an iperf3 test like runIperf, trying the fallback
+// ports in turn and then retrying when the servers are busy with other tests,
+// as long as the retry still fits in ctx.
+func runIperfRetrying(ctx context.Context, o iperfOptions) (*iperf.Result, error) {
+	ports := append([]int{o.port}, o.fallbackPorts...)
+	delay := *busyDelay
+	for retry := 0; ; retry++ {
+		var (
+			stats *iperf.Result
+			err   error
+		)
+		for i, port := range ports {
+			o.port = port
+			if stats, err = runIperf(ctx, o); err == nil || errorReason(err) != "server_busy" {
+				return stats, err
+			}
+			if i < len(ports)-1 {
+				slog.Debug("iperf3 server is busy, trying the next port", "target", o.target, "port", port, "next_port", ports[i+1])
+				portFallbacks.Inc()
+			}
+		}
+		if retry >= *busyRetries {
+			return stats, err
+		}
+		if d, ok := ctx.Deadline(); ok && time.Until(d) < delay+o.period+periodMargin {
+			return stats, err
+		}
+		slog.Debug("iperf3 server is busy, retrying", "target", o.target, "port", o.port, "delay", delay)
+		busyRetryCount.Inc()
+		select {
+		case <-ctx.Done():
+			return stats, err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
 }
 
 // Exporter collects iperf3 stats from the given address and exports them using
 // the prometheus metrics package.
 type Exporter struct {
-	target  string
-        port	int
-	period  time.Duration
+	opts    iperfOptions
+	module  *config.Module
 	timeout time.Duration
 	mutex   sync.RWMutex
 
+	// logger logs with the target and port of the probe.
+	logger *slog.Logger
+
+	// trace gathers the logs and runs of a probe with debug=true.
+	trace *probeTrace
+
+	// parent is the span of the probe request, the parent of those of the
+	// collect, which runs outside of the request context.
+	parent trace.SpanContext
+
+	// request is the context of the probe request, whose end cancels the
+	// test unless it is a background refresh (none if nil).
+	request context.Context
+
+	key      cache.Key
+	cacheTTL time.Duration
+	force    bool // run the test even if it is backed off
+	fresh    bool // never serve results older than cacheTTL, even stale ones
+
+	// cacheStatus tells how the latest collect got its result: hit, stale,
+	// miss or backoff.
+	cacheStatus string
+
+	// pool is the pool the tested server was selected from, if any.
+	pool       string
+	poolServer *prometheus.Desc
+
+	usedPort *prometheus.Desc
+
+	// target is the configured target of the probe, if any.
+	target     *config.Target
+	targetInfo *prometheus.Desc
+
 	success         *prometheus.Desc
+	periodSeconds   *prometheus.Desc
 	sentSeconds     *prometheus.Desc
 	sentBytes       *prometheus.Desc
 	receivedSeconds *prometheus.Desc
 	receivedBytes   *prometheus.Desc
+	retransmits     *prometheus.Desc
+
+	lastProbeTimestamp *prometheus.Desc
+	resultAge          *prometheus.Desc
+	throughputChange   *prometheus.Desc
+	failureReason      *prometheus.Desc
+
+	perspectiveSeconds *prometheus.Desc
+	perspectiveBytes   *prometheus.Desc
+	clientSender       *prometheus.Desc
+
+	streamsRequested *prometheus.Desc
+	streams          *prometheus.Desc
+	streamsMismatch  *prometheus.Desc
+	configDrift      *prometheus.Desc
+
+	intervalThroughput *prometheus.Desc
+	intervalMin        *prometheus.Desc
+	intervalMax        *prometheus.Desc
+	intervalStddev     *prometheus.Desc
+	intervalCV         *prometheus.Desc
+
+	hookSuccess  *prometheus.Desc
+	hookDuration *prometheus.Desc
+
+	interfaceSpeed *prometheus.Desc
+
+	connectSuccess  *prometheus.Desc
+	connectDuration *prometheus.Desc
+
+	pingLoss *prometheus.Desc
+	pingRTT  *prometheus.Desc
+
+	reverseSentSeconds      *prometheus.Desc
+	reverseSentBytes        *prometheus.Desc
+	reverseReceivedSeconds  *prometheus.Desc
+	reverseReceivedBytes    *prometheus.Desc
+	suspectedDuplexMismatch *prometheus.Desc
+
+	thresholdBreached *prometheus.Desc
+
+	bandwidthRatio *prometheus.Desc
+	slaCompliance  *prometheus.Desc
+
+	// probeSuccess and probeDuration are the blackbox exporter metrics, for
+	// its dashboards and generic alerting rules.
+	probeSuccess  *prometheus.Desc
+	probeDuration *prometheus.Desc
 }
 
-// NewExporter returns an initialized Exporter.
-func NewExporter(target string, port int, period time.Duration, timeout time.Duration) *Exporter {
-	return &Exporter{
-		target:          target,
-                port:            port,
-		period:          period,
+// NewExporter returns an initialized Exporter. It fails when a label of opts
+// clashes with a label of the probe metrics.
+func NewExporter(opts iperfOptions, module *config.Module, timeout time.Duration) (*Exporter, error) {
+	// The port is exported as a label so that several iperf3 servers running on
+	// the same host can be told apart.
+	labels := prometheus.Labels{"port": strconv.Itoa(opts.port)}
+	if opts.flowLabel != 0 {
+		labels["flowlabel"] = strconv.Itoa(opts.flowLabel)
+	}
+	for name, value := range opts.labels {
+		if _, ok := labels[name]; ok {
+			return nil, fmt.Errorf("label %q is reserved", name)
+		}
+		labels[name] = value
+	}
+	variableLabels := map[string]bool{}
+	desc := func(fqName, help string, names []string) *prometheus.Desc {
+		for _, name := range names {
+			variableLabels[name] = true
+		}
+		return prometheus.NewDesc(fqName, help, names, labels)
+	}
+
+	// The upstream naming keeps the dashboards and alerts of the upstream
+	// releases working, which have no server-side metrics.
+	successName, sideLabels := "success", []string{"side"}
+	if upstreamNaming() {
+		successName, sideLabels = "up", nil
+	}
+
+	e := &Exporter{
+		opts:            opts,
+		module:          module,
 		timeout:         timeout,
-		success:         prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "success"), "Was the last iperf3 probe successful.", nil, nil),
-		sentSeconds:     prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "sent_seconds"), "Total seconds spent sending packets.", nil, nil),
-		sentBytes:       prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "sent_bytes"), "Total sent bytes.", nil, nil),
-		receivedSeconds: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "received_seconds"), "Total seconds spent receiving packets.", nil, nil),
-		receivedBytes:   prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "received_bytes"), "Total received bytes.", nil, nil),
+		logger:          probeLogger(slog.Default().Handler(), opts),
+		success:         desc(prometheus.BuildFQName(namespace, "", successName), "Was the last iperf3 probe successful.", nil),
+		periodSeconds:   desc(prometheus.BuildFQName(namespace, "", "period_seconds"), "Test period used by the iperf3 probe.", nil),
+		sentSeconds:     desc(prometheus.BuildFQName(namespace, "", "sent_seconds"), "Total seconds spent sending packets.", sideLabels),
+		sentBytes:       desc(prometheus.BuildFQName(namespace, "", "sent_bytes"), "Total sent bytes.", sideLabels),
+		receivedSeconds: desc(prometheus.BuildFQName(namespace, "", "received_seconds"), "Total seconds spent receiving packets.", sideLabels),
+		receivedBytes:   desc(prometheus.BuildFQName(namespace, "", "received_bytes"), "Total received bytes.", sideLabels),
+		retransmits:     desc(prometheus.BuildFQName(namespace, "", "retransmits"), "Total TCP retransmits of the sender.", nil),
+
+		lastProbeTimestamp: desc(prometheus.BuildFQName(namespace, "", "last_probe_timestamp_seconds"), "Time of the latest iperf3 test of the probe configuration, cached or not.", nil),
+		resultAge:          desc(prometheus.BuildFQName(namespace, "", "result_age_seconds"), "Time since the exported result was produced, non-zero when it comes from the cache.", nil),
+		throughputChange:   desc(prometheus.BuildFQName(namespace, "", "throughput_change_ratio"), "Relative change of the received throughput from the previous test of the probe configuration, e.g. -0.5 when it halved.", nil),
+		failureReason:      desc(prometheus.BuildFQName(namespace, "", "failure_reason"), "Reason of the failure of the latest iperf3 test of the probe configuration.", []string{"reason"}),
+
+		perspectiveSeconds: desc(prometheus.BuildFQName(namespace, "", "perspective_seconds"), "Test duration as measured by the sender or the receiver of the streams.", []string{"perspective"}),
+		perspectiveBytes:   desc(prometheus.BuildFQName(namespace, "", "perspective_bytes"), "Total bytes as counted by the sender or the receiver of the streams.", []string{"perspective"}),
+		clientSender:       desc(prometheus.BuildFQName(namespace, "", "client_sender"), "Whether the exporter host was the sender of the streams.", nil),
+
+		streamsRequested: desc(prometheus.BuildFQName(namespace, "", "streams_requested"), "Number of parallel streams requested from iperf3.", nil),
+		streams:          desc(prometheus.BuildFQName(namespace, "", "streams"), "Number of parallel streams actually run by iperf3.", nil),
+		streamsMismatch:  desc(prometheus.BuildFQName(namespace, "", "streams_mismatch"), "Whether iperf3 ran a different number of streams than requested.", nil),
+		configDrift:      desc(prometheus.BuildFQName(namespace, "", "config_drift"), "Whether the test parameter iperf3 reported differs from the requested one.", []string{"parameter"}),
+
+		intervalThroughput: desc(prometheus.BuildFQName(namespace, "interval", "bits_per_second"), "Throughput of the intervals of the test.", nil),
+		intervalMin:        desc(prometheus.BuildFQName(namespace, "interval", "min_bits_per_second"), "Lowest throughput of the intervals of the test.", nil),
+		intervalMax:        desc(prometheus.BuildFQName(namespace, "interval", "max_bits_per_second"), "Highest throughput of the intervals of the test.", nil),
+		intervalStddev:     desc(prometheus.BuildFQName(namespace, "interval", "stddev_bits_per_second"), "Standard deviation of the throughput of the intervals of the test.", nil),
+		intervalCV:         desc(prometheus.BuildFQName(namespace, "interval", "throughput_cv"), "Coefficient of variation of the throughput of the intervals of the test, its standard deviation relative to its mean.", nil),
+
+		hookSuccess:  desc(prometheus.BuildFQName(namespace, "hook", "success"), "Whether the hook command of the module succeeded.", []string{"hook"}),
+		hookDuration: desc(prometheus.BuildFQName(namespace, "hook", "duration_seconds"), "Duration of the hook command of the module.", []string{"hook"}),
+
+		interfaceSpeed: desc(prometheus.BuildFQName(namespace, "", "interface_speed_bits_per_second"), "Link speed of the exporter host interface used to reach the target.", []string{"interface"}),
+
+		connectSuccess:  desc(prometheus.BuildFQName(namespace, "", "connect_success"), "Whether the iperf3 server accepted a TCP connection before the test.", nil),
+		connectDuration: desc(prometheus.BuildFQName(namespace, "", "connect_duration_seconds"), "Duration of the TCP connection to the iperf3 server before the test.", nil),
+
+		pingLoss: desc(prometheus.BuildFQName(namespace, "ping", "loss_ratio"), "Ratio of the ICMP echo requests of the pre-probe left unanswered.", nil),
+		pingRTT:  desc(prometheus.BuildFQName(namespace, "ping", "rtt_seconds"), "Min, average and max round-trip time of the ICMP echo requests of the pre-probe.", []string{"stat"}),
+
+		reverseSentSeconds:      desc(prometheus.BuildFQName(namespace, "", "reverse_sent_seconds"), "Total seconds spent sending packets in the reverse direction of a bidirectional test.", nil),
+		reverseSentBytes:        desc(prometheus.BuildFQName(namespace, "", "reverse_sent_bytes"), "Total sent bytes in the reverse direction of a bidirectional test.", nil),
+		reverseReceivedSeconds:  desc(prometheus.BuildFQName(namespace, "", "reverse_received_seconds"), "Total seconds spent receiving packets in the reverse direction of a bidirectional test.", nil),
+		reverseReceivedBytes:    desc(prometheus.BuildFQName(namespace, "", "reverse_received_bytes"), "Total received bytes in the reverse direction of a bidirectional test.", nil),
+		suspectedDuplexMismatch: desc(prometheus.BuildFQName(namespace, "", "suspected_duplex_mismatch"), "Whether the bidirectional throughput collapsed far below the unidirectional throughput.", nil),
+
+		thresholdBreached: desc(prometheus.BuildFQName(namespace, "", "threshold_breached"), "Whether the probe breached the threshold of its module.", []string{"threshold"}),
+
+		bandwidthRatio: desc(prometheus.BuildFQName(namespace, "", "bandwidth_ratio"), "Received throughput of the test over the expected bandwidth of the target.", nil),
+		slaCompliance:  desc(prometheus.BuildFQName(namespace, "", "sla_compliance_ratio"), "Ratio of the tests of the target over the SLA window that reached the compliant ratio of its expected bandwidth.", nil),
+
+		probeSuccess:  desc("probe_success", "Displays whether or not the probe was a success.", nil),
+		probeDuration: desc(probeDurationName, probeDurationHelp, nil),
+
+		targetInfo: desc(prometheus.BuildFQName(namespace, "", "target_info"), "Notes and runbook URL of the configured target.", []string{"notes", "runbook_url"}),
+
+		usedPort: desc(prometheus.BuildFQName(namespace, "", "used_port_info"), "The port of the target that ran the test, for targets with several ports.", []string{"used_port"}),
+
+		poolServer: desc(prometheus.BuildFQName(namespace, "pool", "server_info"), "The pool server selected for the probe.", []string{"target"}),
+	}
+	for name := range opts.labels {
+		if variableLabels[name] {
+			return nil, fmt.Errorf("label %q is reserved", name)
+		}
+	}
+	return e, nil
+}
+
+const (
+	probeDurationName = "probe_duration_seconds"
+	probeDurationHelp = "Returns how long the probe took to complete in seconds."
+)
+
+// appendDuration returns mfs with probe_duration_seconds, which is only known
+// once the metrics of the probe are gathered.
+func (e *Exporter) appendDuration(mfs []*dto.MetricFamily, seconds float64) ([]*dto.MetricFamily, error) {
+	m := &dto.Metric{}
+	if err := prometheus.MustNewConstMetric(e.probeDuration, prometheus.GaugeValue, seconds).Write(m); err != nil {
+		return mfs, err
 	}
+	mfs = append(mfs, &dto.MetricFamily{
+		Name:   strPtr(probeDurationName),
+		Help:   strPtr(probeDurationHelp),
+		Type:   dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{m},
+	})
+	sort.Slice(mfs, func(i, j int) bool { return mfs[i].GetName() < mfs[j].GetName() })
+	return mfs, nil
+}
+
+// probeLogger returns the logger of the probe of opts, writing to h.
+func probeLogger(h slog.Handler, opts iperfOptions) *slog.Logger {
+	return slog.New(h).With("target", config.RedactTarget(opts.target), "port", opts.port)
 }
 
 // Describe describes all the metrics exported by the iperf3 exporter. It
 // implements prometheus.Collector.
 func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 	ch <- e.success
+	ch <- e.lastProbeTimestamp
+	ch <- e.resultAge
+	ch <- e.throughputChange
+	ch <- e.failureReason
+	ch <- e.periodSeconds
 	ch <- e.sentSeconds
 	ch <- e.sentBytes
 	ch <- e.receivedSeconds
 	ch <- e.receivedBytes
+	ch <- e.perspectiveSeconds
+	ch <- e.perspectiveBytes
+	ch <- e.clientSender
+	ch <- e.streamsRequested
+	ch <- e.streams
+	ch <- e.streamsMismatch
+	ch <- e.configDrift
+	ch <- e.intervalThroughput
+	ch <- e.intervalMin
+	ch <- e.intervalMax
+	ch <- e.intervalStddev
+	ch <- e.intervalCV
+	ch <- e.hookSuccess
+	ch <- e.hookDuration
+	ch <- e.interfaceSpeed
+	ch <- e.connectSuccess
+	ch <- e.connectDuration
+	ch <- e.pingLoss
+	ch <- e.pingRTT
+	ch <- e.reverseSentSeconds
+	ch <- e.reverseSentBytes
+	ch <- e.reverseReceivedSeconds
+	ch <- e.reverseReceivedBytes
+	ch <- e.suspectedDuplexMismatch
+	ch <- e.thresholdBreached
+	ch <- e.bandwidthRatio
+	ch <- e.slaCompliance
+	ch <- e.probeSuccess
+	ch <- e.probeDuration
+	ch <- e.poolServer
+	ch <- e.usedPort
+	ch <- e.targetInfo
+	ch <- e.retransmits
 }
 
 // Collect probes the configured iperf3 server and delivers them as Prometheus
@@ -107,55 +646,489 @@ func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
 	e.mutex.Lock() // To protect metrics from concurrent collects.
 	defer e.mutex.Unlock()
 
-	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	ctx, cancel := context.WithTimeout(withTrace(runContext, e.trace), e.timeout)
 	defer cancel()
+	if e.request != nil {
+		defer context.AfterFunc(e.request, cancel)()
+	}
+	ctx, span := tracer.Start(trace.ContextWithSpanContext(ctx, e.parent), "collect")
+	defer span.End()
+
+	ch <- prometheus.MustNewConstMetric(e.periodSeconds, prometheus.GaugeValue, e.opts.period.Seconds())
+	if t := e.target; t != nil && (t.Notes != "" || t.RunbookURL != "") {
+		ch <- prometheus.MustNewConstMetric(e.targetInfo, prometheus.GaugeValue, 1, t.Notes, t.RunbookURL)
+	}
+	ch <- prometheus.MustNewConstMetric(e.streamsRequested, prometheus.GaugeValue, float64(e.requestedStreams()))
+	var ping *pingResult
+	if e.module.Ping != nil && *replayDirectory == "" {
+		ping = e.collectPing(ctx, ch)
+	}
+
+	// A cached result is still exported when later tests failed, but the
+	// success metric and timestamp are those of the latest test.
+	stats, produced, outcome := e.probe(ctx, ch)
+	ch <- prometheus.MustNewConstMetric(e.success, prometheus.GaugeValue, boolToFloat(outcome.OK))
+	ch <- prometheus.MustNewConstMetric(e.probeSuccess, prometheus.GaugeValue, boolToFloat(outcome.OK))
+	ch <- prometheus.MustNewConstMetric(e.lastProbeTimestamp, prometheus.GaugeValue, float64(outcome.Time.UnixNano())/1e9)
+	if !outcome.OK && outcome.Reason != "" {
+		ch <- prometheus.MustNewConstMetric(e.failureReason, prometheus.GaugeValue, 1, outcome.Reason)
+	}
+	if e.pool != "" {
+		ch <- prometheus.MustNewConstMetric(e.poolServer, prometheus.GaugeValue, 1, e.opts.target)
+		recordPoolOutcome(e.pool, e.opts.target, e.opts.port, outcome)
+	}
+	if e.module.Thresholds != nil {
+		e.collectThresholds(ch, stats, ping)
+	}
+	e.collectSLA(ch, stats)
+	if stats == nil {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(e.resultAge, prometheus.GaugeValue, time.Since(produced).Seconds())
+	if ratio, ok := throughputChange(e.key, stats); ok {
+		ch <- prometheus.MustNewConstMetric(e.throughputChange, prometheus.GaugeValue, ratio)
+	}
+
+	// The metrics of a result served again are those of the time it was
+	// measured, rather than of the scrape.
+	if *cachedTimestamps && e.cacheStatus != "miss" {
+		out, timestamped, done := ch, make(chan prometheus.Metric), make(chan struct{})
+		go func() {
+			for m := range timestamped {
+				out <- prometheus.NewMetricWithTimestamp(produced, m)
+			}
+			close(done)
+		}()
+		defer func() {
+			close(timestamped)
+			<-done
+		}()
+		ch = timestamped
+	}
+
+	if hostNetwork(e.opts.runner) {
+		e.collectInterfaceSpeed(ch)
+	}
+	if port := stats.RemotePort(); port != 0 && len(e.opts.fallbackPorts) > 0 {
+		ch <- prometheus.MustNewConstMetric(e.usedPort, prometheus.GaugeValue, 1, strconv.Itoa(port))
+	}
+	e.collectSums(ch, stats, "client")
+	if stats.ServerOutput != nil {
+		e.collectSums(ch, stats.ServerOutput, "server")
+	}
+	if e.opts.bidir {
+		e.collectBidir(ch, stats)
+	} else {
+		recordUnidir(e.key, stats)
+	}
+
+	e.collectDrift(ch, stats)
+	if !isDegraded() {
+		e.collectIntervals(ch, stats)
+	}
+
+	// Series derived from every stream are the first to go when the exporter
+	// has too many series.
+	if len(stats.End.Streams) > 0 && !isDegraded() {
+		sender, receiver, clientSender := stats.Perspectives()
+		ch <- prometheus.MustNewConstMetric(e.perspectiveSeconds, prometheus.GaugeValue, sender.Seconds, "sender")
+		ch <- prometheus.MustNewConstMetric(e.perspectiveBytes, prometheus.GaugeValue, sender.Bytes, "sender")
+		ch <- prometheus.MustNewConstMetric(e.perspectiveSeconds, prometheus.GaugeValue, receiver.Seconds, "receiver")
+		ch <- prometheus.MustNewConstMetric(e.perspectiveBytes, prometheus.GaugeValue, receiver.Bytes, "receiver")
+		ch <- prometheus.MustNewConstMetric(e.clientSender, prometheus.GaugeValue, boolToFloat(clientSender))
+
+		// The server may cap the number of parallel streams below the requested
+		// value, which silently skews comparisons between targets.
+		streams, requested := len(stats.End.Streams), e.requestedStreams()
+		ch <- prometheus.MustNewConstMetric(e.streams, prometheus.GaugeValue, float64(streams))
+		ch <- prometheus.MustNewConstMetric(e.streamsMismatch, prometheus.GaugeValue, boolToFloat(streams != requested))
+		if streams != requested {
+			e.logger.Warn("iperf3 ran another number of streams than requested", "streams", streams, "requested", requested)
+		}
+	}
+}
+
+// probe returns the cached result of the test if there is one at most
+// e.cacheTTL old, or runs the test, along with the time the result was
+// produced.
+func (e *Exporter) probe(ctx context.Context, ch chan<- prometheus.Metric) (*iperf.Result, time.Time, cache.Outcome) {
+	if !e.force {
+		if last, ok := probeBackoff.Active(e.key); ok {
+			backoffSkips.Inc()
+			e.logger.Debug("Not testing again yet, the latest test failed")
+			e.cacheStatus = "backoff"
+			stats, produced := probeCache.Get(e.key, e.cacheTTL)
+			return stats, produced, last
+		}
+	}
+	e.cacheStatus = "miss"
+	if !probeCache.Enabled() && e.cacheTTL == 0 {
+		stats, err := e.run(ctx, ch)
+		outcome := outcomeOf(err)
+		return stats, outcome.Time, outcome
+	}
+	// With a zero TTL the test always runs, but its result still refreshes
+	// the cache for the other probes.
+	ctx, span := tracer.Start(ctx, "cache")
+	defer func() {
+		span.SetAttributes(attribute.String("iperf3.cache", e.cacheStatus))
+		span.End()
+	}()
+	ran := false
+	stats, produced, outcome := probeCache.Do(e.key, e.cacheTTL, !e.fresh, func() (*iperf.Result, error) {
+		ran = true
+		return e.run(ctx, ch)
+	}, func() (*iperf.Result, error) {
+		// Background refreshes outlive the collect, so their hook metrics
+		// are dropped.
+		ctx, cancel := context.WithTimeout(runContext, e.timeout)
+		defer cancel()
+		discard := make(chan prometheus.Metric)
+		go func() {
+			for range discard {
+			}
+		}()
+		defer close(discard)
+		return e.run(ctx, discard)
+	})
+	switch {
+	case ran:
+	case e.cacheTTL > 0 && stats != nil && time.Since(produced) > e.cacheTTL:
+		e.cacheStatus = "stale"
+	default:
+		e.cacheStatus = "hit"
+	}
+	return stats, produced, outcome
+}
 
-	out, err := exec.CommandContext(ctx, iperfCmd, "-J", "-t", strconv.FormatFloat(e.period.Seconds(), 'f', 0, 64), "-c", e.target, "-p", strconv.Itoa(e.port)).Output()
+// run runs the test with the module hooks around it, once the exporter host
+// admits it.
+func (e *Exporter) run(ctx context.Context, ch chan<- prometheus.Metric) (*iperf.Result, error) {
+	opts, err := admit(ctx, e.opts)
 	if err != nil {
-		ch <- prometheus.MustNewConstMetric(e.success, prometheus.GaugeValue, 0)
+		e.logger.Warn("Skipped the iperf3 test", "err", err)
+		annotate(e.opts.target, "skip", fmt.Sprintf("iperf3 test to %s:%d skipped: %s", e.opts.target, e.opts.port, err))
+		return nil, &testError{reason: "admission", err: err}
+	}
+	if e.module.PreHook != nil {
+		if !e.collectHook(ctx, ch, "pre", e.module.PreHook) {
+			annotate(e.opts.target, "skip", fmt.Sprintf("iperf3 test to %s:%d skipped: the pre hook failed", e.opts.target, e.opts.port))
+			return nil, &testError{reason: "pre_hook", err: errors.New("the pre hook failed")}
+		}
+	}
+	if e.module.PostHook != nil {
+		// The post hook runs even if the test used up the probe timeout, as it
+		// usually reverts what the pre hook did.
+		defer e.collectHook(context.Background(), ch, "post", e.module.PostHook)
+	}
+
+	// The connection check is made from the exporter host, so it does not
+	// apply to clients run elsewhere.
+	var stats *iperf.Result
+	start := time.Now()
+	if *connectCheck && hostNetwork(opts.runner) && *replayDirectory == "" {
+		err = e.checkConnect(ctx, ch, opts)
+	}
+	if err == nil {
+		stats, err = runIperfRetrying(ctx, opts)
+	}
+	if stats != nil {
+		stats.RequestedPeriod = opts.period.Seconds()
+	}
+	annotateOutcome(e.key, err)
+	probeBackoff.Record(e.key, outcomeOf(err))
+	history.Record(e.opts.target, opts.port, stats, err)
+	recordSLA(e.target, e.opts.port, stats, err)
+	influx.Record(e.target, e.opts.target, opts.port, e.key.Module, stats, err)
+	publishResult(e.target, e.opts.target, opts.port, e.key.Module, start, stats, err)
+	if err != nil {
+		iperfErrors.Inc()
+		e.logger.Error("Failed to probe", "err", err)
+		return nil, err
+	}
+	return stats, nil
+}
+
+// collectHook runs a hook of the module and delivers its outcome, reporting
+// whether it succeeded.
+func (e *Exporter) collectHook(ctx context.Context, ch chan<- prometheus.Metric, name string, h *config.Hook) bool {
+	r := runHook(ctx, h, e.opts)
+	ch <- prometheus.MustNewConstMetric(e.hookDuration, prometheus.GaugeValue, r.duration.Seconds(), name)
+	ch <- prometheus.MustNewConstMetric(e.hookSuccess, prometheus.GaugeValue, boolToFloat(r.err == nil), name)
+	if r.err != nil {
 		iperfErrors.Inc()
-		log.Errorf("Failed to run iperf3: %s", err)
+		e.logger.Error("Hook failed", "hook", name, "err", r.err, "output", r.output)
+		return false
+	}
+	e.logger.Debug("Hook succeeded", "hook", name, "output", r.output)
+	return true
+}
+
+// collectInterfaceSpeed delivers the speed of the local interface used to reach
+// the target, so that results limited by the exporter host link are obvious.
+func (e *Exporter) collectInterfaceSpeed(ch chan<- prometheus.Metric) {
+	iface, err := host.EgressInterface(e.opts.target, e.opts.port)
+	if err != nil {
+		e.logger.Debug("Failed to find the interface used to reach the target", "err", err)
+		return
+	}
+	speed, err := host.InterfaceSpeed(iface)
+	if err != nil {
+		e.logger.Debug("Failed to read the speed of the interface", "interface", iface, "err", err)
 		return
 	}
+	ch <- prometheus.MustNewConstMetric(e.interfaceSpeed, prometheus.GaugeValue, speed, iface)
+}
 
-	stats := iperfResult{}
-	if err := json.Unmarshal(out, &stats); err != nil {
-		ch <- prometheus.MustNewConstMetric(e.success, prometheus.GaugeValue, 0)
+// collectPing sends the ICMP pre-probe of the module and delivers its loss
+// and round-trip times. It runs on every collect, even when the test result
+// comes from the cache, as it is cheap. It returns the ping result, nil if
+// ping failed.
+func (e *Exporter) collectPing(ctx context.Context, ch chan<- prometheus.Metric) *pingResult {
+	var prefix []string
+	if lr, ok := e.opts.runner.(localRunner); ok {
+		prefix = lr.prefix
+	}
+	r, err := runPing(ctx, e.module.Ping, prefix, e.opts.target)
+	if err != nil {
 		iperfErrors.Inc()
-		log.Errorf("Failed to parse iperf3 result: %s", err)
+		e.logger.Error("Failed to ping", "err", err)
+		return nil
+	}
+	ch <- prometheus.MustNewConstMetric(e.pingLoss, prometheus.GaugeValue, r.loss())
+	if r.received > 0 {
+		ch <- prometheus.MustNewConstMetric(e.pingRTT, prometheus.GaugeValue, r.rttMin.Seconds(), "min")
+		ch <- prometheus.MustNewConstMetric(e.pingRTT, prometheus.GaugeValue, r.rttAvg.Seconds(), "avg")
+		ch <- prometheus.MustNewConstMetric(e.pingRTT, prometheus.GaugeValue, r.rttMax.Seconds(), "max")
+	}
+	return &r
+}
+
+// collectDrift delivers whether the parameters iperf3 reports having tested
+// with differ from the requested ones, which invalidates comparisons between
+// targets.
+func (e *Exporter) collectDrift(ch chan<- prometheus.Metric, stats *iperf.Result) {
+	ts := stats.Start.TestStart
+	if ts.NumStreams == 0 {
+		// Clients other than iperf3 do not report their parameters.
 		return
 	}
+	// Results cached before the requested period was recorded were run with
+	// that of the probe.
+	period := stats.RequestedPeriod
+	if period == 0 {
+		period = e.opts.period.Seconds()
+	}
+	params := []struct {
+		name      string
+		tested    float64
+		requested float64
+	}{
+		{"streams", float64(ts.NumStreams), float64(e.opts.threads)},
+		{"blksize", float64(ts.Blksize), iperf.BlockSize},
+		{"duration", ts.Duration, math.Round(period)},
+	}
+	for _, p := range params {
+		if p.name == "blksize" && e.opts.udp {
+			// iperf3 sizes UDP datagrams after the path MTU.
+			continue
+		}
+		drift := p.tested != p.requested
+		ch <- prometheus.MustNewConstMetric(e.configDrift, prometheus.GaugeValue, boolToFloat(drift), p.name)
+		if drift {
+			e.logger.Warn("iperf3 tested with other parameters than requested", "parameter", p.name, "tested", p.tested, "requested", p.requested)
+		}
+	}
+}
+
+// collectIntervals delivers the distribution of the interval throughput,
+// which shows the microbursts and stalls that the average of the test hides.
+func (e *Exporter) collectIntervals(ch chan<- prometheus.Metric, stats *iperf.Result) {
+	s, ok := summarizeIntervals(stats)
+	if !ok {
+		return
+	}
+	ch <- prometheus.MustNewConstSummary(e.intervalThroughput, uint64(s.count), s.sum, s.quantiles)
+	ch <- prometheus.MustNewConstMetric(e.intervalMin, prometheus.GaugeValue, s.min)
+	ch <- prometheus.MustNewConstMetric(e.intervalMax, prometheus.GaugeValue, s.max)
+	ch <- prometheus.MustNewConstMetric(e.intervalStddev, prometheus.GaugeValue, s.stddev)
+	if cv, ok := s.cv(); ok {
+		ch <- prometheus.MustNewConstMetric(e.intervalCV, prometheus.GaugeValue, cv)
+	}
+}
+
+// requestedStreams returns the number of streams iperf3 should run: a
+// bidirectional test runs the requested threads in both directions.
+func (e *Exporter) requestedStreams() int {
+	if e.opts.bidir {
+		return 2 * e.opts.threads
+	}
+	return e.opts.threads
+}
+
+// collectBidir delivers the reverse direction of a bidirectional test and the
+// duplex mismatch heuristic, once a unidirectional test of the same target
+// gives a baseline.
+func (e *Exporter) collectBidir(ch chan<- prometheus.Metric, stats *iperf.Result) {
+	ch <- prometheus.MustNewConstMetric(e.reverseSentSeconds, prometheus.GaugeValue, stats.End.SumSentBidirReverse.Seconds)
+	ch <- prometheus.MustNewConstMetric(e.reverseSentBytes, prometheus.GaugeValue, stats.End.SumSentBidirReverse.Bytes)
+	ch <- prometheus.MustNewConstMetric(e.reverseReceivedSeconds, prometheus.GaugeValue, stats.End.SumReceivedBidirReverse.Seconds)
+	ch <- prometheus.MustNewConstMetric(e.reverseReceivedBytes, prometheus.GaugeValue, stats.End.SumReceivedBidirReverse.Bytes)
+	if mismatch, ok := suspectedDuplexMismatch(e.key, stats); ok {
+		ch <- prometheus.MustNewConstMetric(e.suspectedDuplexMismatch, prometheus.GaugeValue, boolToFloat(mismatch))
+		if mismatch {
+			e.logger.Warn("Suspected duplex mismatch: bidirectional throughput collapsed")
+			annotate(e.opts.target, "duplex_mismatch", fmt.Sprintf("Suspected duplex mismatch to %s:%d: bidirectional throughput collapsed", e.opts.target, e.opts.port))
+		}
+	}
+}
+
+// collectSums delivers the end summary of the result reported by side.
+func (e *Exporter) collectSums(ch chan<- prometheus.Metric, stats *iperf.Result, side string) {
+	labelValues := []string{side}
+	if upstreamNaming() {
+		if side != "client" {
+			return
+		}
+		labelValues = nil
+		ch <- prometheus.MustNewConstMetric(e.retransmits, prometheus.GaugeValue, stats.End.SumSent.Retransmits)
+	}
+	ch <- prometheus.MustNewConstMetric(e.sentSeconds, prometheus.GaugeValue, stats.End.SumSent.Seconds, labelValues...)
+	ch <- prometheus.MustNewConstMetric(e.sentBytes, prometheus.GaugeValue, stats.End.SumSent.Bytes, labelValues...)
+	ch <- prometheus.MustNewConstMetric(e.receivedSeconds, prometheus.GaugeValue, stats.End.SumReceived.Seconds, labelValues...)
+	ch <- prometheus.MustNewConstMetric(e.receivedBytes, prometheus.GaugeValue, stats.End.SumReceived.Bytes, labelValues...)
+}
+
+// upstreamNaming reports whether the probe metrics are named after the
+// upstream releases.
+func upstreamNaming() bool {
+	return *metricNaming == "upstream"
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
 
-	ch <- prometheus.MustNewConstMetric(e.success, prometheus.GaugeValue, 1)
-	ch <- prometheus.MustNewConstMetric(e.sentSeconds, prometheus.GaugeValue, stats.End.SumSent.Seconds)
-	ch <- prometheus.MustNewConstMetric(e.sentBytes, prometheus.GaugeValue, stats.End.SumSent.Bytes)
-	ch <- prometheus.MustNewConstMetric(e.receivedSeconds, prometheus.GaugeValue, stats.End.SumReceived.Seconds)
-	ch <- prometheus.MustNewConstMetric(e.receivedBytes, prometheus.GaugeValue, stats.End.SumReceived.Bytes)
+// allowedLabelNames returns the names of the labels allowed by the flags and
+// by the configuration file.
+func allowedLabelNames() []string {
+	return append(append([]string(nil), *allowedLabels...), sc.Get().AllowedLabels...)
+}
+
+// urlLabels returns the labels passed as label_<name>=<value> parameters. Only
+// label names in the allowlist are accepted.
+func urlLabels(params url.Values) (map[string]string, error) {
+	labels := map[string]string{}
+	for param, values := range params {
+		if !strings.HasPrefix(param, labelParamPrefix) {
+			continue
+		}
+		name := strings.TrimPrefix(param, labelParamPrefix)
+		allowed := false
+		for _, a := range allowedLabelNames() {
+			allowed = allowed || a == name
+		}
+		if !allowed {
+			return nil, fmt.Errorf("label %q is not allowed", name)
+		}
+		labels[name] = values[0]
+	}
+	return labels, nil
+}
+
+// probeTimeout returns the timeout of the probe request r: the scrape timeout
+// of the Prometheus header, or else --iperf3.timeout, at most
+// maxTimeout.
+func probeTimeout(r *http.Request) (time.Duration, error) {
+	var timeoutSeconds float64
+	if v := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); v != "" {
+		var err error
+		timeoutSeconds, err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if timeoutSeconds == 0 {
+		if timeout.Seconds() > 0 {
+			timeoutSeconds = timeout.Seconds()
+		} else {
+			timeoutSeconds = maxTimeout.Seconds()
+		}
+	}
+
+	if timeoutSeconds > maxTimeout.Seconds() {
+		timeoutSeconds = maxTimeout.Seconds()
+	}
+	return time.Duration(timeoutSeconds * float64(time.Second)), nil
 }
 
 func handler(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header)), "probe",
+		trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+	// The parameters span ends with the first invalid parameter, or once the
+	// probe is set up.
+	_, paramsSpan := tracer.Start(ctx, "parse parameters")
+	defer paramsSpan.End()
+
 	target := r.URL.Query().Get("target")
-	if target == "" {
+	pool := r.URL.Query().Get("pool")
+	if target == "" && pool == "" {
 		http.Error(w, "'target' parameter must be specified", http.StatusBadRequest)
 		iperfErrors.Inc()
 		return
 	}
-        
-        var targetPort int
-        port := r.URL.Query().Get("port")
-        if port != "" {
-                var err error 
-                targetPort, err = strconv.Atoi(port)
-                if err != nil {
-                        http.Error(w, fmt.Sprintf("'port' parameter must be an integer: %s", err), http.StatusBadRequest)
-                        iperfErrors.Inc()
-                        return
-                }
-        } 
-        if targetPort == 0 {
-                targetPort = 5201
-        }
-        
+	if config.HasCredentials(target) {
+		http.Error(w, "'target' parameter "+config.ErrCredentials, http.StatusBadRequest)
+		iperfErrors.Inc()
+		return
+	}
+	// Targets are passed to commands, ping among them, which would read them
+	// as options.
+	if strings.HasPrefix(target, "-") {
+		http.Error(w, fmt.Sprintf("'target' parameter must not start with '-': %q", target), http.StatusBadRequest)
+		iperfErrors.Inc()
+		return
+	}
+	if target != "" && pool != "" {
+		http.Error(w, "'target' and 'pool' parameters are mutually exclusive", http.StatusBadRequest)
+		iperfErrors.Inc()
+		return
+	}
+
+	var targetPort int
+	port := r.URL.Query().Get("port")
+	if port != "" {
+		var err error
+		targetPort, err = strconv.Atoi(port)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("'port' parameter must be an integer: %s", err), http.StatusBadRequest)
+			iperfErrors.Inc()
+			return
+		}
+	}
+	if targetPort == 0 {
+		targetPort = config.DefaultPort
+	}
+
+	if pool != "" {
+		if port != "" {
+			http.Error(w, "'port' parameter does not apply to pools", http.StatusBadRequest)
+			iperfErrors.Inc()
+			return
+		}
+		s, err := pickPoolServer(r.Context(), sc.Get(), pool)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to select a pool server: %s", err), http.StatusBadRequest)
+			iperfErrors.Inc()
+			return
+		}
+		target, targetPort = s.Target, s.Port
+	}
+
 	var runPeriod time.Duration
 	period := r.URL.Query().Get("period")
 	if period != "" {
@@ -171,80 +1144,773 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		runPeriod = time.Second * 5
 	}
 
-	// If a timeout is configured via the Prometheus header, add it to the request.
-	var timeoutSeconds float64
-	if v := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); v != "" {
+	threads := 1
+	if v := r.URL.Query().Get("thread"); v != "" {
 		var err error
-		timeoutSeconds, err = strconv.ParseFloat(v, 64)
+		threads, err = strconv.Atoi(v)
+		if err != nil || threads < 1 || threads > maxThreads {
+			http.Error(w, fmt.Sprintf("'thread' parameter must be an integer between 1 and %d", maxThreads), http.StatusBadRequest)
+			iperfErrors.Inc()
+			return
+		}
+	}
+
+	runTimeout, err := probeTimeout(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to parse timeout from Prometheus header: %s", err), http.StatusInternalServerError)
+		iperfErrors.Inc()
+		return
+	}
+
+	// Shorten the test so that it completes before the probe times out.
+	if maxPeriod := (runTimeout - periodMargin).Truncate(time.Second); runPeriod > maxPeriod {
+		runPeriod = maxPeriod
+		if runPeriod < *minPeriod {
+			runPeriod = *minPeriod
+		}
+		slog.Debug("Shortened iperf3 test period to fit the timeout", "target", target, "period", runPeriod, "timeout", runTimeout)
+	}
+
+	start := time.Now()
+	registry := prometheus.NewRegistry()
+	var serverOutput bool
+	if v := r.URL.Query().Get("server_output"); v != "" {
+		var err error
+		serverOutput, err = strconv.ParseBool(v)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to parse timeout from Prometheus header: %s", err), http.StatusInternalServerError)
+			http.Error(w, fmt.Sprintf("'server_output' parameter must be a boolean: %s", err), http.StatusBadRequest)
 			iperfErrors.Inc()
 			return
 		}
 	}
-	if timeoutSeconds == 0 {
-		if timeout.Seconds() > 0 {
-			timeoutSeconds = timeout.Seconds()
-		} else {
-			timeoutSeconds = 30
+
+	var flowLabel int
+	if v := r.URL.Query().Get("flowlabel"); v != "" {
+		var err error
+		flowLabel, err = strconv.Atoi(v)
+		if err != nil || flowLabel < 0 || flowLabel > maxFlowLabel {
+			http.Error(w, fmt.Sprintf("'flowlabel' parameter must be an integer between 0 and %d", maxFlowLabel), http.StatusBadRequest)
+			iperfErrors.Inc()
+			return
+		}
+	}
+
+	var bidir bool
+	if v := r.URL.Query().Get("bidir"); v != "" {
+		var err error
+		bidir, err = strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("'bidir' parameter must be a boolean: %s", err), http.StatusBadRequest)
+			iperfErrors.Inc()
+			return
 		}
 	}
 
-	if timeoutSeconds > 30 {
-		timeoutSeconds = 30
+	var udp bool
+	if v := r.URL.Query().Get("udp"); v != "" {
+		var err error
+		udp, err = strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("'udp' parameter must be a boolean: %s", err), http.StatusBadRequest)
+			iperfErrors.Inc()
+			return
+		}
 	}
 
-	runTimeout := time.Duration(timeoutSeconds * float64(time.Second))
+	var reverse bool
+	if v := r.URL.Query().Get("reverse"); v != "" {
+		var err error
+		reverse, err = strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("'reverse' parameter must be a boolean: %s", err), http.StatusBadRequest)
+			iperfErrors.Inc()
+			return
+		}
+	}
+	if reverse && bidir {
+		http.Error(w, "'reverse' and 'bidir' parameters are mutually exclusive", http.StatusBadRequest)
+		iperfErrors.Inc()
+		return
+	}
 
-	start := time.Now()
-	registry := prometheus.NewRegistry()
-	exporter := NewExporter(target, targetPort, runPeriod, runTimeout)
+	var debug bool
+	if v := r.URL.Query().Get("debug"); v != "" {
+		var err error
+		debug, err = strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("'debug' parameter must be a boolean: %s", err), http.StatusBadRequest)
+			iperfErrors.Inc()
+			return
+		}
+	}
+
+	probeLabels, err := urlLabels(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		iperfErrors.Inc()
+		return
+	}
+
+	opts := iperfOptions{target: target, port: targetPort, period: runPeriod, threads: threads, serverOutput: serverOutput, flowLabel: flowLabel, bidir: bidir, udp: udp, reverse: reverse, labels: probeLabels}
+	configured := sc.Get().LookupTarget(target, targetPort)
+	if configured == nil && apiTargets != nil {
+		configured = apiTargets.lookup(target, targetPort)
+	}
+	if t := configured; t != nil {
+		opts.auth = t.Auth
+		if ports := t.PortList(); port == "" && len(ports) > 0 {
+			opts.port, opts.fallbackPorts = ports[0], ports[1:]
+			targetPort = opts.port
+		}
+	}
+	module := &config.Module{}
+	if name := r.URL.Query().Get("module"); name != "" {
+		var ok bool
+		if module, ok = sc.Get().Modules[name]; !ok {
+			http.Error(w, fmt.Sprintf("Unknown module %q", name), http.StatusBadRequest)
+			iperfErrors.Inc()
+			return
+		}
+	}
+
+	netns := module.NetNS
+	if v := r.URL.Query().Get("netns"); v != "" {
+		if !config.ValidNetNS(v) || module.SSH != nil {
+			http.Error(w, fmt.Sprintf("Invalid 'netns' parameter %q", v), http.StatusBadRequest)
+			iperfErrors.Inc()
+			return
+		}
+		if !containsString(sc.Get().AllowedNetNS, v) {
+			http.Error(w, fmt.Sprintf("'netns' parameter %q is not an allowed network namespace", v), http.StatusBadRequest)
+			iperfErrors.Inc()
+			return
+		}
+		netns = v
+	}
+	switch {
+	case module.SSH != nil:
+		opts.runner = sshRunner{cfg: module.SSH}
+	case netns != "":
+		opts.runner = localRunner{prefix: netnsPrefix(netns), binary: module.Binary}
+	case module.Binary != "":
+		opts.runner = localRunner{binary: module.Binary}
+	}
+
+	opts.backend = backendOf(module.Backend)
+	if err := opts.backend.Check(opts); err != nil {
+		http.Error(w, fmt.Sprintf("Unsupported parameters: %s", err), http.StatusBadRequest)
+		iperfErrors.Inc()
+		return
+	}
+	if bidir && module.SSH == nil {
+		if err := requireFeature(module.Binary, "bidir"); err != nil {
+			http.Error(w, fmt.Sprintf("'bidir' parameter is not supported: %s", err), http.StatusBadRequest)
+			iperfErrors.Inc()
+			return
+		}
+	}
+
+	cacheTTL, force := probeCache.TTL(), false
+	if v := r.URL.Query().Get("cache_ttl"); v != "" && !*cacheDisable {
+		var err error
+		if cacheTTL, err = time.ParseDuration(v); err != nil || cacheTTL < 0 {
+			http.Error(w, fmt.Sprintf("'cache_ttl' parameter must be a non-negative duration: %s", v), http.StatusBadRequest)
+			iperfErrors.Inc()
+			return
+		}
+	}
+	// max_age only ever shortens the TTL, so that a scrape job can demand
+	// fresher results than the other probes of the same target.
+	var fresh bool
+	if v := r.URL.Query().Get("max_age"); v != "" {
+		maxAge, err := time.ParseDuration(v)
+		if err != nil || maxAge <= 0 {
+			http.Error(w, fmt.Sprintf("'max_age' parameter must be a positive duration: %s", v), http.StatusBadRequest)
+			iperfErrors.Inc()
+			return
+		}
+		if maxAge < cacheTTL {
+			cacheTTL = maxAge
+		}
+		fresh = true
+	}
+	if v := r.URL.Query().Get("cache"); v != "" {
+		useCache, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("'cache' parameter must be a boolean: %s", err), http.StatusBadRequest)
+			iperfErrors.Inc()
+			return
+		}
+		if !useCache {
+			cacheTTL = 0
+			force = true
+		}
+	}
+
+	exporter, err := NewExporter(opts, module, runTimeout)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		iperfErrors.Inc()
+		return
+	}
+	exporter.cacheTTL = cacheTTL
+	exporter.force = force
+	exporter.fresh = fresh
+	exporter.pool = pool
+	exporter.target = configured
+	if debug {
+		exporter.trace = newProbeTrace()
+		exporter.logger = probeLogger(exporter.trace.handler(), opts)
+	}
+	exporter.key = cache.Key{
+		Target:       target,
+		Port:         targetPort,
+		Period:       runPeriod,
+		Threads:      threads,
+		FlowLabel:    flowLabel,
+		ServerOutput: serverOutput,
+		Bidir:        bidir,
+		UDP:          udp,
+		Reverse:      reverse,
+		Module:       r.URL.Query().Get("module"),
+		NetNS:        netns,
+	}
+	exporter.parent = span.SpanContext()
+	exporter.request = r.Context()
+	span.SetAttributes(attribute.String("iperf3.target", target), attribute.Int("iperf3.port", targetPort), attribute.String("iperf3.module", exporter.key.Module))
+	paramsSpan.End()
 	registry.MustRegister(exporter)
 
-	// Delegate http serving to Prometheus client library, which will call collector.Collect.
-	h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+	// The probe runs before anything is written, so that the response headers
+	// can tell how it went.
+	mfs, err := registry.Gather()
+	series := 0
+	for _, mf := range mfs {
+		series += len(mf.Metric)
+	}
+	recordProbeSeries(exporter.key, series)
+	duration := time.Since(start).Seconds()
+	if err == nil {
+		mfs, err = exporter.appendDuration(mfs, duration)
+	}
+	id := probeID()
+	exporter.logger.Debug("Probe done", "id", id, "cache", exporter.cacheStatus, "duration", duration)
+	span.SetAttributes(attribute.String("iperf3.probe_id", id), attribute.String("iperf3.cache", exporter.cacheStatus))
+	w.Header().Set("X-Iperf3-Probe-Id", id)
+	w.Header().Set("X-Iperf3-Cache", exporter.cacheStatus)
+	w.Header().Set("X-Iperf3-Duration", strconv.FormatFloat(duration, 'f', 3, 64))
+
+	if debug {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := writeDebug(w, exporter.trace, exporter.cacheStatus, time.Duration(duration*float64(time.Second)), mfs); err != nil {
+			slog.Warn("Failed to write to HTTP client", "err", err)
+		}
+		iperfDuration.Observe(duration)
+		return
+	}
+
+	// Delegate http serving to Prometheus client library.
+	h := promhttp.HandlerFor(prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) { return mfs, err }), promhttp.HandlerOpts{EnableOpenMetrics: *cachedTimestamps})
 	h.ServeHTTP(w, r)
 
-	duration := time.Since(start).Seconds()
 	iperfDuration.Observe(duration)
 }
 
+// probeID returns a random identifier of a probe, to correlate a response
+// with the exporter logs.
+func probeID() string {
+	b := make([]byte, 8)
+	if _, err := cryptorand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
+// registerPprof registers the pprof profiling endpoints on mux.
+func registerPprof(mux *http.ServeMux, prefix string) {
+	mux.HandleFunc(prefix+"/debug/pprof/", pprof.Index)
+	mux.HandleFunc(prefix+"/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc(prefix+"/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc(prefix+"/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc(prefix+"/debug/pprof/trace", pprof.Trace)
+}
+
 func main() {
-	log.AddFlags(kingpin.CommandLine)
 	kingpin.Version(version.Print("iperf3_exporter"))
 	kingpin.HelpFlag.Short('h')
 	kingpin.Parse()
+	slog.SetDefault(newLogger(os.Stderr, *logLevel, *logFormat))
+
+	slog.Info("Starting iperf3 exporter", "version", version.Info())
+	slog.Info("Build context", "build_context", version.BuildContext())
+
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		fatal("Error setting up tracing", "err", err)
+	}
+
+	if err := sc.ReloadConfig(*configFile); err != nil {
+		fatal("Error loading config", "err", err)
+	}
+	configReloadSuccess.Set(1)
+	configReloadTime.Set(float64(time.Now().UnixNano()) / 1e9)
+	for _, name := range *allowedLabels {
+		if !config.ValidAllowedLabel(name) {
+			fatal("Invalid allowed label name", "label", name)
+		}
+	}
 
-	log.Info("Starting iperf3 exporter", version.Info())
-	log.Info("Build context", version.BuildContext())
+	// CACHE_TIME, in minutes, predates the cache.ttl flag and is still
+	// honoured when the flag is not set.
+	ttl := *cacheTTLFlag
+	if v := os.Getenv("CACHE_TIME"); v != "" && ttl == 0 {
+		minutes, err := strconv.Atoi(v)
+		if err != nil || minutes < 0 {
+			fatal("Invalid CACHE_TIME, must be a number of minutes", "value", v)
+		}
+		ttl = time.Duration(minutes) * time.Minute
+	}
+	if ttl < 0 {
+		fatal("Invalid cache TTL", "ttl", ttl)
+	}
+	if *multiConcurrency < 1 {
+		fatal("Invalid multi-target probe concurrency, must be at least 1", "concurrency", *multiConcurrency)
+	}
+	if *cacheDisable {
+		ttl = 0
+	}
+	probeCache = cache.New(ttl, *cacheStale, *cacheMaxEntries, errorReason)
+	probeAttempts = newProbeHistory(*historySize)
+	probeBackoff = cache.NewBackoff(*backoffInitial, *backoffMax)
+	if *cacheFile != "" && probeCache.Enabled() {
+		if err := loadCache(probeCache, *cacheFile); err != nil {
+			fatal("Error loading the result cache", "err", err)
+		}
+		go persistCache(probeCache, *cacheFile, *cacheInterval)
+	}
+
+	if *replayDirectory != "" {
+		slog.Warn("Replaying recorded results, no test will be run", "directory", *replayDirectory)
+	} else {
+		if *iperfBackend != "native" {
+			if err := checkIperfBinary(context.Background()); err != nil {
+				fatal("Error checking the iperf3 binary", "err", err)
+			}
+		}
+		// Modules with a binary run it whatever the backend.
+		detectModuleVersions(context.Background(), sc.Get())
+	}
+	if *replayDirectory == "" && *minVersion != "" {
+		if !regexp.MustCompile(`^\d+(\.\d+)*$`).MatchString(*minVersion) {
+			fatal("Invalid minimum iperf3 version", "version", *minVersion)
+		}
+		if err := checkIperfVersions(context.Background(), sc.Get(), *minVersion); err != nil {
+			fatal("Error checking the iperf3 version", "err", err)
+		}
+		// Reloaded configurations are held to the same minimum.
+		sc.Check = func(c *config.Config) error {
+			return checkIperfVersions(context.Background(), c, *minVersion)
+		}
+	}
+
+	if *agentExporter != "" {
+		name := *agentName
+		if name == "" {
+			name, _ = os.Hostname()
+		}
+		token, err := readTokenFile(*agentTokenFile)
+		if err != nil {
+			fatal("Error reading the agent token", "err", err)
+		}
+		opts, err := agentDialOptions(*agentTLS, *agentCAFile, *agentCertFile, *agentKeyFile, *agentServer, token)
+		if err != nil {
+			fatal("Error loading the agent TLS configuration", "err", err)
+		}
+		slog.Info("Running as agent", "name", name, "exporter", *agentExporter)
+		runAgent(context.Background(), name, *agentExporter, opts, *agentInterval, *agentPeriod)
+		return
+	}
 
 	prometheus.MustRegister(version.NewCollector("iperf3_exporter"))
 	prometheus.MustRegister(iperfDuration)
 	prometheus.MustRegister(iperfErrors)
+	prometheus.MustRegister(iperfTests)
+	prometheus.MustRegister(iperfTransferredBytes)
+	prometheus.MustRegister(busyRetryCount)
+	prometheus.MustRegister(portFallbacks)
+	prometheus.MustRegister(discoveryErrors)
+	prometheus.MustRegister(annotationErrors)
+	prometheus.MustRegister(webhookErrors)
+	prometheus.MustRegister(iperfVersionCheck)
+	prometheus.MustRegister(iperfVersionInfo)
+	prometheus.MustRegister(startTime)
+	prometheus.MustRegister(shuttingDown)
+	prometheus.MustRegister(poolServerHealth)
+	prometheus.MustRegister(parseWarnings)
+	prometheus.MustRegister(iperfFailures)
+	prometheus.MustRegister(admissionDecisions)
+	prometheus.MustRegister(admissionOverloads)
+	startTime.Set(float64(time.Now().UnixNano()) / 1e9)
+	prometheus.MustRegister(cacheHits)
+	prometheus.MustRegister(cacheStaleHits)
+	prometheus.MustRegister(cacheMisses)
+	prometheus.MustRegister(backoffSkips)
+	prometheus.MustRegister(probeAuthFailures)
+	prometheus.MustRegister(rateLimited)
+	prometheus.MustRegister(topologyChanges)
+	prometheus.MustRegister(configReloadSuccess)
+	prometheus.MustRegister(configReloadTime)
+	go reloadOnSIGHUP()
+	prometheus.MustRegister(topologyChangeTime)
+	if *topologyFile != "" {
+		go watchTopologyFile(*topologyFile, *topologyInterval)
+	}
+	if *maxSeries > 0 {
+		prometheus.MustRegister(seriesCount)
+		prometheus.MustRegister(degradedMode)
+		go monitorSeries(*maxSeries)
+	}
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: prometheus.BuildFQName(namespace, "exporter", "cache_entries"), Help: "Results in the probe result cache."}, func() float64 { return float64(probeCache.Len()) }))
+
+	if *statsFile != "" {
+		if err := loadStats(*statsFile); err != nil {
+			fatal("Error loading exporter statistics", "err", err)
+		}
+		go persistStats(*statsFile, *statsInterval)
+	}
+
+	if len(sc.Get().Janitor) > 0 {
+		prometheus.MustRegister(janitorReclaimedBytes)
+		prometheus.MustRegister(janitorRemovedFiles)
+		prometheus.MustRegister(janitorDirectoryBytes)
+		prometheus.MustRegister(janitorErrors)
+		go runJanitor(sc, *janitorInterval)
+	}
+
+	if *historyFile != "" {
+		var err error
+		if history, err = openHistory(*historyFile, *historyRetention); err != nil {
+			fatal("Error opening the history database", "err", err)
+		}
+		prometheus.MustRegister(historyErrors)
+		go history.Run(runContext)
+	}
+	if *reaperInterval > 0 && runtime.GOOS == "linux" {
+		prometheus.MustRegister(orphanedProcesses)
+		go runReaper(*reaperInterval)
+	}
+	if *influxURL != "" {
+		if influx, err = newInfluxOutput(*influxURL, *influxTokenFile, *influxMeasurement); err != nil {
+			fatal("Error setting up the InfluxDB output", "err", err)
+		}
+		prometheus.MustRegister(influxErrors)
+		go influx.Run(runContext)
+	}
+	if len(*kafkaBrokers) > 0 {
+		p, err := newKafkaPublisher(*kafkaBrokers, *kafkaTopic, *kafkaTLS, *kafkaSASLUsername, *kafkaSASLPasswordFile)
+		if err != nil {
+			fatal("Error setting up the Kafka publisher", "err", err)
+		}
+		prometheus.MustRegister(kafkaErrors)
+		publishers = append(publishers, p)
+	}
+	if *mqttBroker != "" {
+		clientID := *mqttClientID
+		if clientID == "" {
+			host, err := os.Hostname()
+			if err != nil {
+				fatal("Error getting the host name", "err", err)
+			}
+			clientID = "iperf3_exporter-" + host
+		}
+		qos, _ := strconv.Atoi(*mqttQoS)
+		p, err := newMQTTPublisher(*mqttBroker, clientID, *mqttUsername, *mqttPasswordFile, *mqttTopic, byte(qos), *mqttRetain)
+		if err != nil {
+			fatal("Error setting up the MQTT publisher", "err", err)
+		}
+		prometheus.MustRegister(mqttErrors)
+		publishers = append(publishers, p)
+	}
+
+	if *serverEnable {
+		prometheus.MustRegister(serverUp)
+		prometheus.MustRegister(serverStartTime)
+		prometheus.MustRegister(serverRestarts)
+		go superviseServer(runContext, *serverPort, *serverRestartDelay)
+	}
 
-	http.Handle(*metricsPath, promhttp.Handler())
-	http.HandleFunc("/probe", handler)
+	if m := sc.Get().Mesh; m != nil {
+		self := *meshName
+		if self == "" {
+			self, _ = os.Hostname()
+		}
+		mc := newMeshCollector(self, m)
+		prometheus.MustRegister(mc)
+		go mc.Run(runContext)
+	}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	if *grpcAddress != "" {
+		if *grpcTokenFile == "" && *grpcClientCA == "" {
+			fatal("Agents must be authenticated by grpc.token-file or grpc.tls-client-ca-file")
+		}
+		token, err := readTokenFile(*grpcTokenFile)
+		if err != nil {
+			fatal("Error reading the agent token", "err", err)
+		}
+		tlsConfig, err := agentServerTLS(*grpcCertFile, *grpcKeyFile, *grpcClientCA)
+		if err != nil {
+			fatal("Error loading the agent listener TLS configuration", "err", err)
+		}
+		if tlsConfig == nil {
+			slog.Warn("Agent tokens are sent in plaintext, set grpc.tls-cert-file to protect them")
+		}
+		l, err := net.Listen("tcp", *grpcAddress)
+		if err != nil {
+			fatal("Error listening for agents", "err", err)
+		}
+		ac := newAgentCollector(token)
+		prometheus.MustRegister(ac, agentAuthFailures)
+		slog.Info("Listening for agents", "address", l.Addr(), "tls", tlsConfig != nil)
+		go func() {
+			fatal("Error serving agents", "err", ac.Serve(l, tlsConfig))
+		}()
+	}
+
+	if *consulSecret != "" && (*consulServer != "" || *registerConsul != "") {
+		token, err := resolveSecret(context.Background(), *consulSecret)
+		if err != nil {
+			fatal("Error resolving Consul token", "err", err)
+		}
+		*consulToken = token
+	}
+	if *grafanaSecret != "" && *grafanaURL != "" {
+		key, err := resolveSecret(context.Background(), *grafanaSecret)
+		if err != nil {
+			fatal("Error resolving Grafana API key", "err", err)
+		}
+		*grafanaAPIKey = key
+	}
+
+	if apiTargets, err = newTargetStore(*targetsFile); err != nil {
+		fatal("Error loading the targets file", "err", err)
+	}
+	discoverers := []discoverer{apiTargets}
+	if *consulServer != "" {
+		d := newRefreshDiscoverer("consul", *consulRefresh, func(ctx context.Context) ([]config.Target, time.Duration, error) {
+			targets, err := consulTargets(ctx, *consulServer, *consulToken, *consulServices)
+			return targets, 0, err
+		})
+		go d.Run(context.Background())
+		discoverers = append(discoverers, d)
+	}
+	if *kubernetesSelector != "" {
+		k, err := newKubernetesClient()
+		if err != nil {
+			fatal("Error creating Kubernetes client", "err", err)
+		}
+		d := newRefreshDiscoverer("kubernetes", *kubernetesRefresh, func(ctx context.Context) ([]config.Target, time.Duration, error) {
+			targets, err := k.Targets(ctx, *kubernetesRole, *kubernetesNamespace, *kubernetesSelector, *kubernetesPort)
+			return targets, 0, err
+		})
+		go d.Run(context.Background())
+		discoverers = append(discoverers, d)
+	}
+	if len(*dnsSDNames) > 0 {
+		d := newRefreshDiscoverer("dns", *dnsSDRefresh, func(ctx context.Context) ([]config.Target, time.Duration, error) {
+			return srvTargets(ctx, *dnsSDNames)
+		})
+		go d.Run(context.Background())
+		discoverers = append(discoverers, d)
+	}
+
+	if *pushURL != "" {
+		instance := *pushInstance
+		if instance == "" {
+			if instance, err = os.Hostname(); err != nil {
+				fatal("Error getting the host name", "err", err)
+			}
+		}
+		p, err := newPusher(*pushURL, *pushJob, instance, *pushBearerTokenFile, discoverers)
+		if err != nil {
+			fatal("Error setting up the remote write push", "err", err)
+		}
+		prometheus.MustRegister(pushErrors)
+		slog.Info("Pushing the probe results", "url", *pushURL, "interval", *pushInterval)
+		go p.Run(runContext, *pushInterval)
+	}
+
+	// Links of the landing page go through the external URL, while handlers
+	// are registered under the route prefix that the reverse proxy forwards.
+	linkPrefix := ""
+	if *externalURL != "" {
+		u, err := url.Parse(*externalURL)
+		if err != nil {
+			fatal("Invalid external URL", "url", *externalURL, "err", err)
+		}
+		linkPrefix = strings.TrimRight(u.Path, "/")
+	}
+	prefix := linkPrefix
+	if *routePrefix != "" {
+		prefix = "/" + strings.Trim(*routePrefix, "/")
+		if prefix == "/" {
+			prefix = ""
+		}
+	}
+
+	// The exporter has its own mux, as net/http/pprof registers its handlers
+	// on the default one.
+	mux := http.NewServeMux()
+	mux.Handle(prefix+*metricsPath, promhttp.Handler())
+	var limiter *rateLimiter
+	if *probeRateLimit > 0 {
+		limiter = newRateLimiter(*probeRateLimit, *probeRateBurst)
+	}
+	mux.HandleFunc(prefix+"/probe", rateLimit(limiter, requireProbeAuth(handler)))
+	mux.HandleFunc(prefix+"/probe/raw", requireProbeAuth(rawHandler))
+	mux.HandleFunc(prefix+"/probe_multi", rateLimit(limiter, requireProbeAuth(multiHandler(discoverers))))
+	mux.HandleFunc(prefix+"/sd", requireProbeAuth(sdHandler(sc, discoverers)))
+	mux.HandleFunc(prefix+"/capabilities", requireProbeAuth(capabilitiesHandler))
+	mux.HandleFunc(prefix+"/cache", requireProbeAuth(cacheHandler))
+	mux.HandleFunc(prefix+"/-/flush-cache", requireProbeAuth(flushCacheHandler))
+	mux.HandleFunc(prefix+"/-/reload", requireProbeAuth(reloadHandler))
+	mux.HandleFunc(prefix+"/api/v1/targets", requireProbeAuth(apiTargets.ServeHTTP))
+	mux.HandleFunc(prefix+"/api/v1/history", requireProbeAuth(historyHandler))
+	mux.HandleFunc(prefix+"/-/topology-change", requireProbeAuth(topologyChangeHandler))
+	mux.HandleFunc(prefix+"/benchmark", requireProbeAuth(benchmarkHandler))
+	mux.HandleFunc(prefix+"/debug/probes", requireProbeAuth(debugProbesHandler))
+	if prefix != "" {
+		mux.Handle("/", http.RedirectHandler(prefix+"/", http.StatusFound))
+	}
+
+	mux.HandleFunc(prefix+"/", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html")
 		_, err := w.Write([]byte(`<html>
     <head><title>iPerf3 Exporter</title></head>
     <body>
     <h1>iPerf3 Exporter</h1>
-    <p><a href="/probe?target=prometheus.io">Probe prometheus.io</a></p>
-    <p><a href='` + *metricsPath + `'>Metrics</a></p>
+    ` + probeForm(sc.Get().Modules, linkPrefix) + `
+    <p><a href='` + linkPrefix + *metricsPath + `'>Metrics</a></p>
+    <p><a href="` + linkPrefix + `/sd">Service discovery</a></p>
+    <p><a href="` + linkPrefix + `/capabilities">Capabilities</a></p>
+    <p><a href="` + linkPrefix + `/cache">Result cache</a></p>
+    <p><a href="` + linkPrefix + `/debug/probes">Latest probes</a></p>
+    ` + targetsTable(sc.Get().Targets, linkPrefix) + `
     </html>`))
 		if err != nil {
-			log.Warnf("Failed to write to HTTP client: %s", err)
+			slog.Warn("Failed to write to HTTP client", "err", err)
 		}
 	})
 
+	if *pprofEnable {
+		if *debugAddress == "" {
+			registerPprof(mux, prefix)
+		} else {
+			debugMux := http.NewServeMux()
+			registerPprof(debugMux, "")
+			slog.Info("Serving pprof", "address", *debugAddress)
+			go func() {
+				fatal("Error serving pprof", "err", http.ListenAndServe(*debugAddress, debugMux))
+			}()
+		}
+	}
+
+	var reg *registration
+	registerCtx, stopRegistering := context.WithCancel(context.Background())
+	if *registerConsul != "" || *registerHTTP != "" {
+		var err error
+		reg, err = newRegistration(*registerAddress, *listenAddress, *registerLabels)
+		if err != nil {
+			fatal("Error registering the exporter", "err", err)
+		}
+		reg.consulServer, reg.consulToken, reg.service = *registerConsul, *consulToken, *registerService
+		reg.httpURL = *registerHTTP
+		slog.Info("Registering the exporter", "address", reg.address)
+		go reg.Run(registerCtx, *registerInterval)
+	}
+
 	srv := &http.Server{
 		Addr:         *listenAddress,
+		Handler:      mux,
 		ReadTimeout:  60 * time.Second,
 		WriteTimeout: 60 * time.Second,
 	}
 
-	log.Infof("Listening on %s", srv.Addr)
-	log.Fatal(srv.ListenAndServe())
+	// On SIGTERM or SIGINT, stop accepting connections and let the running
+	// scrapes complete, which see iperf3_exporter_shutting_down at 1. Tests
+	// still running after the grace period are canceled, which kills their
+	// iperf3 processes, and the scrapes complete with failures.
+	done := make(chan struct{})
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+		sig := <-sigs
+		slog.Info("Shutting down", "signal", sig.String())
+		shuttingDown.Set(1)
+		if err := sdNotify("STOPPING=1"); err != nil {
+			slog.Warn("Failed to notify systemd", "err", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), maxTimeout+periodMargin)
+		defer cancel()
+		// Prometheus stops scraping the instance before it goes away.
+		stopRegistering()
+		if reg != nil {
+			if err := reg.Deregister(ctx); err != nil {
+				slog.Error("Error deregistering the exporter", "err", err)
+			}
+		}
+		shutdown := make(chan error, 1)
+		go func() {
+			shutdown <- srv.Shutdown(ctx)
+		}()
+		var err error
+		select {
+		case err = <-shutdown:
+		case <-time.After(*shutdownGrace):
+			slog.Warn("Canceling the running tests after the grace period", "grace", *shutdownGrace)
+			cancelRuns()
+			err = <-shutdown
+		}
+		cancelRuns()
+		if err != nil {
+			slog.Error("Failed to complete the running scrapes", "err", err)
+		}
+		if *cacheFile != "" && probeCache.Enabled() {
+			if err := saveCache(probeCache, *cacheFile); err != nil {
+				slog.Error("Failed to save the result cache", "err", err)
+			}
+		}
+		if *statsFile != "" {
+			if err := saveStats(*statsFile); err != nil {
+				slog.Error("Failed to save exporter statistics", "err", err)
+			}
+		}
+		closePublishers()
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Error("Failed to export the pending spans", "err", err)
+		}
+		close(done)
+	}()
+
+	// The listener is bound before serving so that systemd is only told the
+	// exporter is ready once it accepts connections. With socket activation,
+	// systemd binds it instead.
+	if err := web.Validate(*webConfigFile); err != nil {
+		fatal("Invalid web configuration file", "file", *webConfigFile, "err", err)
+	}
+	l, err := sdListener("web")
+	if err != nil {
+		fatal("Error using the socket passed by systemd", "err", err)
+	}
+	if l == nil {
+		l, err = net.Listen("tcp", srv.Addr)
+		if err != nil {
+			fatal("Error listening", "address", srv.Addr, "err", err)
+		}
+	}
+	slog.Info("Listening", "address", l.Addr())
+	go notifyReady(l.Addr())
+	if err := web.Serve(l, srv, *webConfigFile, toolkitLogger{}); err != http.ErrServerClosed {
+		fatal("Error serving HTTP", "err", err)
+	}
+	<-done
 }
@@ -0,0 +1,172 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/edgard/iperf3_exporter/internal/config"
+	"github.com/edgard/iperf3_exporter/internal/iperf"
+)
+
+// testResult returns the iperf3 result of the JSON output s.
+func testResult(t *testing.T, s string) *iperf.Result {
+	t.Helper()
+	var r iperf.Result
+	if err := json.Unmarshal([]byte(s), &r); err != nil {
+		t.Fatalf("Unmarshal: %s", err)
+	}
+	return &r
+}
+
+var variableLabelsRE = regexp.MustCompile(`variableLabels: \[(.*)\]}$`)
+
+// describe returns the descriptors of e.
+func describe(e *Exporter) []*prometheus.Desc {
+	ch := make(chan *prometheus.Desc)
+	go func() {
+		e.Describe(ch)
+		close(ch)
+	}()
+	var descs []*prometheus.Desc
+	for d := range ch {
+		descs = append(descs, d)
+	}
+	return descs
+}
+
+// TestVariableLabelsReserved fails when a probe metric gets a variable label
+// that could also be allowed as a probe label, which would break its scrapes.
+func TestVariableLabelsReserved(t *testing.T) {
+	e, err := NewExporter(iperfOptions{port: 5201}, nil, 0)
+	if err != nil {
+		t.Fatalf("NewExporter: %s", err)
+	}
+	for _, d := range describe(e) {
+		m := variableLabelsRE.FindStringSubmatch(d.String())
+		if m == nil {
+			t.Fatalf("unexpected descriptor %s", d)
+		}
+		for _, name := range strings.Fields(m[1]) {
+			if config.ValidAllowedLabel(name) {
+				t.Errorf("variable label %q of %s is not reserved", name, d)
+			}
+		}
+	}
+}
+
+func TestNewExporterLabels(t *testing.T) {
+	for name, ok := range map[string]bool{"site": true, "port": false, "flowlabel": false, "side": false, "runbook_url": false} {
+		opts := iperfOptions{port: 5201, flowLabel: 1, labels: map[string]string{name: "x"}}
+		if _, err := NewExporter(opts, nil, 0); (err == nil) != ok {
+			t.Errorf("NewExporter with label %q: got error %v", name, err)
+		}
+	}
+}
+
+func TestHandlerParameters(t *testing.T) {
+	saved := sc
+	defer func() { sc = saved }()
+	// stat is not a valid allowed label, this only checks that the handler
+	// refuses it rather than breaking the scrape.
+	sc = &config.SafeConfig{C: &config.Config{AllowedLabels: []string{"site", "stat"}, AllowedNetNS: []string{"blue"}}}
+
+	for _, tc := range []struct {
+		query string
+		want  string
+	}{
+		{"cache_ttl=soon", "'cache_ttl' parameter must be a non-negative duration"},
+		{"cache_ttl=-1s", "'cache_ttl' parameter must be a non-negative duration"},
+		{"max_age=soon", "'max_age' parameter must be a positive duration"},
+		{"max_age=0s", "'max_age' parameter must be a positive duration"},
+		{"cache_ttl=1m&max_age=-1s", "'max_age' parameter must be a positive duration"},
+		{"netns=red", "'netns' parameter \"red\" is not an allowed network namespace"},
+		{"netns=../blue", "Invalid 'netns' parameter"},
+		{"netns=blue&max_age=0s", "'max_age' parameter must be a positive duration"},
+		{"udp=maybe", "'udp' parameter must be a boolean"},
+		{"reverse=maybe", "'reverse' parameter must be a boolean"},
+		{"reverse=true&bidir=true", "'reverse' and 'bidir' parameters are mutually exclusive"},
+		{"label_region=eu", "label \"region\" is not allowed"},
+		{"label_stat=x", "label \"stat\" is reserved"},
+		{"label_site=x&max_age=0s", "'max_age' parameter must be a positive duration"},
+	} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/probe?target=127.0.0.1&"+tc.query, nil))
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), tc.want) {
+			t.Errorf("%s: got %d %q, want %d %q", tc.query, w.Code, w.Body.String(), http.StatusBadRequest, tc.want)
+		}
+	}
+}
+
+func TestCollectDrift(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		output string
+		want   map[string]float64
+	}{
+		{
+			name:   "as requested",
+			output: `{"start": {"test_start": {"num_streams": 2, "blksize": 131072, "duration": 5}}}`,
+			want:   map[string]float64{"streams": 0, "blksize": 0, "duration": 0},
+		},
+		{
+			name:   "drifted",
+			output: `{"start": {"test_start": {"num_streams": 1, "blksize": 8192, "duration": 10}}}`,
+			want:   map[string]float64{"streams": 1, "blksize": 1, "duration": 1},
+		},
+		{
+			name:   "requested period of the cached result",
+			output: `{"start": {"test_start": {"num_streams": 2, "blksize": 131072, "duration": 3}}, "requested_period_seconds": 3}`,
+			want:   map[string]float64{"streams": 0, "blksize": 0, "duration": 0},
+		},
+		{
+			name:   "not reported",
+			output: `{"start": {"test_start": {}}}`,
+			want:   map[string]float64{},
+		},
+	} {
+		e, err := NewExporter(iperfOptions{port: 5201, threads: 2, period: 5 * time.Second}, nil, 0)
+		if err != nil {
+			t.Fatalf("NewExporter: %s", err)
+		}
+		ch := make(chan prometheus.Metric, 10)
+		e.collectDrift(ch, testResult(t, tc.output))
+		close(ch)
+		got := map[string]float64{}
+		for m := range ch {
+			var pb dto.Metric
+			if err := m.Write(&pb); err != nil {
+				t.Fatalf("Write: %s", err)
+			}
+			for _, l := range pb.GetLabel() {
+				if l.GetName() == "parameter" {
+					got[l.GetValue()] = pb.GetGauge().GetValue()
+				}
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -11,8 +11,53 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+//go:build !windows
 // +build !windows
 
 package main
 
+import (
+	"context"
+	"os/exec"
+	"syscall"
+)
+
 const iperfCmd = "iperf3"
+
+// iperfSearchDirs returns the directories searched for the iperf3 binary when
+// it is not in the PATH. It is always in the PATH once installed on Unix.
+func iperfSearchDirs() []string {
+	return nil
+}
+
+// runKillable runs cmd, started with ctx, in its own process group, which
+// is killed when ctx is done: killing the process alone leaves its children
+// running, e.g. those of a wrapper, still holding the iperf3 server.
+func runKillable(ctx context.Context, cmd *exec.Cmd) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	pgid := cmd.Process.Pid
+	testGroups.Start(pgid)
+	defer testGroups.Finish(pgid)
+
+	// Until it is waited for, the process keeps the group ID from being
+	// reused even once it exited.
+	exited, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-pgid, syscall.SIGKILL)
+		case <-exited:
+		}
+	}()
+	err := cmd.Wait()
+	close(exited)
+	<-stopped
+	return err
+}
@@ -11,8 +11,86 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+//go:build windows
 // +build windows
 
 package main
 
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
 const iperfCmd = "iperf3.exe"
+
+// iperfSearchDirs returns the directories searched for the iperf3 binary when
+// it is not in the PATH: that of the exporter, where the iperf3 archive is
+// usually extracted, and those of the usual installers.
+func iperfSearchDirs() []string {
+	var dirs []string
+	if exe, err := os.Executable(); err == nil {
+		dirs = append(dirs, filepath.Dir(exe))
+	}
+	for _, v := range []string{"ProgramFiles", "ProgramFiles(x86)"} {
+		if dir := os.Getenv(v); dir != "" {
+			dirs = append(dirs, filepath.Join(dir, "iperf3"))
+		}
+	}
+	choco := os.Getenv("ChocolateyInstall")
+	if choco == "" {
+		choco = `C:\ProgramData\chocolatey`
+	}
+	dirs = append(dirs, filepath.Join(choco, "bin"))
+	if home := os.Getenv("USERPROFILE"); home != "" {
+		dirs = append(dirs, filepath.Join(home, "scoop", "shims"))
+	}
+	return dirs
+}
+
+// runKillable runs cmd, started with ctx. Killing the process when ctx is
+// done leaves its children running on Windows, e.g. those of a wrapper or the
+// cygwin processes of some iperf3 builds, so cmd runs in a job object that is
+// terminated instead. The job also kills the processes left behind once cmd
+// exits.
+func runKillable(ctx context.Context, cmd *exec.Cmd) error {
+	job, err := windows.CreateJobObject(nil, nil)
+	if err != nil {
+		return err
+	}
+	defer windows.CloseHandle(job)
+	info := windows.JOBOBJECT_EXTENDED_LIMIT_INFORMATION{
+		BasicLimitInformation: windows.JOBOBJECT_BASIC_LIMIT_INFORMATION{LimitFlags: windows.JOB_OBJECT_LIMIT_KILL_ON_JOB_CLOSE},
+	}
+	if _, err := windows.SetInformationJobObject(job, windows.JobObjectExtendedLimitInformation, uintptr(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info))); err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// The children started before the process is assigned to the job are
+	// not in it, which is unlikely as iperf3 starts none on its own.
+	if p, err := windows.OpenProcess(windows.PROCESS_SET_QUOTA|windows.PROCESS_TERMINATE, false, uint32(cmd.Process.Pid)); err == nil {
+		windows.AssignProcessToJobObject(job, p)
+		windows.CloseHandle(p)
+	}
+
+	exited, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			windows.TerminateJobObject(job, 1)
+		case <-exited:
+		}
+	}()
+	err = cmd.Wait()
+	close(exited)
+	<-stopped
+	return err
+}
@@ -0,0 +1,125 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/edgard/iperf3_exporter/internal/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	janitorReclaimedBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prometheus.BuildFQName(namespace, "janitor", "reclaimed_bytes_total"),
+			Help: "Bytes reclaimed by the janitor by removing files from the directory.",
+		},
+		[]string{"path"},
+	)
+	janitorRemovedFiles = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prometheus.BuildFQName(namespace, "janitor", "removed_files_total"),
+			Help: "Files removed by the janitor from the directory.",
+		},
+		[]string{"path"},
+	)
+	janitorDirectoryBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: prometheus.BuildFQName(namespace, "janitor", "directory_bytes"),
+			Help: "Size of the files of the directory matched by the janitor after its last sweep.",
+		},
+		[]string{"path"},
+	)
+	janitorErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prometheus.BuildFQName(namespace, "janitor", "errors_total"),
+			Help: "Errors listing or removing the files of the directory.",
+		},
+		[]string{"path"},
+	)
+)
+
+// janitorFile is a file subject to the quotas of a janitor directory.
+type janitorFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// runJanitor sweeps the janitor directories of the configuration every
+// interval. The configuration is read again for every sweep so that reloads
+// apply.
+func runJanitor(sc *config.SafeConfig, interval time.Duration) {
+	for {
+		for _, d := range sc.Get().Janitor {
+			sweepDirectory(d, time.Now())
+		}
+		time.Sleep(interval)
+	}
+}
+
+// sweepDirectory removes the files of d older than its maximum age, then the
+// oldest ones until the directory fits in its maximum size.
+func sweepDirectory(d config.JanitorDirectory, now time.Time) {
+	matches, err := filepath.Glob(filepath.Join(d.Path, d.Pattern))
+	if err != nil {
+		janitorErrors.WithLabelValues(d.Path).Inc()
+		slog.Error("Error listing the files of the janitor directory", "path", d.Path, "err", err)
+		return
+	}
+	var files []janitorFile
+	for _, m := range matches {
+		fi, err := os.Lstat(m)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				janitorErrors.WithLabelValues(d.Path).Inc()
+				slog.Error("Error listing the files of the janitor directory", "path", d.Path, "err", err)
+			}
+			continue
+		}
+		// Directories and links are never removed.
+		if fi.Mode().IsRegular() {
+			files = append(files, janitorFile{path: m, size: fi.Size(), modTime: fi.ModTime()})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+	for _, f := range files {
+		expired := d.MaxAge != 0 && now.Sub(f.modTime) > time.Duration(d.MaxAge)
+		oversize := d.MaxBytes != 0 && total > d.MaxBytes
+		if !expired && !oversize {
+			// Files are sorted by age, so the remaining ones are kept as well.
+			break
+		}
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			janitorErrors.WithLabelValues(d.Path).Inc()
+			slog.Error("Error removing a file", "file", f.path, "err", err)
+			continue
+		}
+		total -= f.size
+		janitorReclaimedBytes.WithLabelValues(d.Path).Add(float64(f.size))
+		janitorRemovedFiles.WithLabelValues(d.Path).Inc()
+		slog.Debug("Removed a file", "file", f.path, "bytes", f.size)
+	}
+	janitorDirectoryBytes.WithLabelValues(d.Path).Set(float64(total))
+}
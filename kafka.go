@@ -0,0 +1,141 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+)
+
+const (
+	// kafkaQueueSize is the number of results waiting to be published, past
+	// which new results are dropped.
+	kafkaQueueSize = 1000
+
+	// kafkaTimeout bounds every batch of results published.
+	kafkaTimeout = 10 * time.Second
+)
+
+var kafkaErrors = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: prometheus.BuildFQName(namespace, "exporter", "kafka_errors_total"),
+	Help: "Probe results that could not be published to Kafka.",
+})
+
+// kafkaPublisher publishes the results to a Kafka topic, keyed by target so
+// that the results of a target are kept in order. Results are queued and
+// published in batches, so that unavailable brokers do not hold up the
+// probes.
+type kafkaPublisher struct {
+	w     *kafka.Writer
+	queue chan kafka.Message
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// newKafkaPublisher returns the publisher to topic on brokers, over TLS if
+// useTLS, and authenticating with SASL PLAIN if username is not empty, with
+// the password of passwordFile.
+func newKafkaPublisher(brokers []string, topic string, useTLS bool, username, passwordFile string) (*kafkaPublisher, error) {
+	transport := &kafka.Transport{ClientID: "iperf3_exporter"}
+	if useTLS {
+		transport.TLS = &tls.Config{}
+	}
+	if username != "" {
+		var password string
+		if passwordFile != "" {
+			b, err := ioutil.ReadFile(passwordFile)
+			if err != nil {
+				return nil, err
+			}
+			password = strings.TrimSpace(string(b))
+		}
+		transport.SASL = plain.Mechanism{Username: username, Password: password}
+	}
+	p := &kafkaPublisher{
+		w: &kafka.Writer{
+			Addr:         kafka.TCP(brokers...),
+			Topic:        topic,
+			Balancer:     &kafka.Hash{},
+			BatchTimeout: 10 * time.Millisecond,
+			RequiredAcks: kafka.RequireAll,
+			Transport:    transport,
+		},
+		queue: make(chan kafka.Message, kafkaQueueSize),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go p.run()
+	return p, nil
+}
+
+func (p *kafkaPublisher) Publish(env *resultEnvelope, payload []byte) {
+	select {
+	case p.queue <- kafka.Message{Key: []byte(env.Target), Value: payload}:
+	default:
+		kafkaErrors.Inc()
+		slog.Warn("Dropped a result, the Kafka publisher is falling behind", "topic", p.w.Topic)
+	}
+}
+
+// run publishes the queued results until stopped, batching those queued
+// while the previous batch was published.
+func (p *kafkaPublisher) run() {
+	defer close(p.done)
+	for {
+		var batch []kafka.Message
+		select {
+		case <-p.stop:
+			// The results queued so far are still published.
+			select {
+			case m := <-p.queue:
+				batch = append(batch, m)
+			default:
+				return
+			}
+		case m := <-p.queue:
+			batch = append(batch, m)
+		}
+	collect:
+		for {
+			select {
+			case m := <-p.queue:
+				batch = append(batch, m)
+			default:
+				break collect
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), kafkaTimeout)
+		if err := p.w.WriteMessages(ctx, batch...); err != nil {
+			kafkaErrors.Add(float64(len(batch)))
+			slog.Error("Failed to publish the results to Kafka", "topic", p.w.Topic, "results", len(batch), "err", err)
+		}
+		cancel()
+	}
+}
+
+// Close publishes the queued results and closes the connections to the
+// brokers.
+func (p *kafkaPublisher) Close() error {
+	close(p.stop)
+	<-p.done
+	return p.w.Close()
+}
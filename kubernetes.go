@@ -0,0 +1,190 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/edgard/iperf3_exporter/internal/config"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+	zoneLabel       = "topology.kubernetes.io/zone"
+	legacyZoneLabel = "failure-domain.beta.kubernetes.io/zone"
+
+	// iperfPortName is the name of the container port used to override the
+	// default iperf3 port of a pod.
+	iperfPortName = "iperf3"
+)
+
+// kubernetesClient is a minimal in-cluster client of the Kubernetes API.
+type kubernetesClient struct {
+	server string
+	token  string
+	client *http.Client
+}
+
+// newKubernetesClient returns a client using the service account of the pod.
+func newKubernetesClient() (*kubernetesClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes cluster")
+	}
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("failed to parse the cluster CA certificate")
+	}
+
+	return &kubernetesClient{
+		server: "https://" + net.JoinHostPort(host, port),
+		token:  strings.TrimSpace(string(token)),
+		client: &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}},
+	}, nil
+}
+
+func (k *kubernetesClient) get(ctx context.Context, path string, query url.Values, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, k.server+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+k.token)
+
+	resp, err := k.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status for %s: %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+type kubernetesMetadata struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels"`
+}
+
+type kubernetesNodeList struct {
+	Items []struct {
+		Metadata kubernetesMetadata `json:"metadata"`
+		Status   struct {
+			Addresses []struct {
+				Type    string `json:"type"`
+				Address string `json:"address"`
+			} `json:"addresses"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+type kubernetesPodList struct {
+	Items []struct {
+		Metadata kubernetesMetadata `json:"metadata"`
+		Spec     struct {
+			NodeName   string `json:"nodeName"`
+			Containers []struct {
+				Ports []struct {
+					Name          string `json:"name"`
+					ContainerPort int    `json:"containerPort"`
+				} `json:"ports"`
+			} `json:"containers"`
+		} `json:"spec"`
+		Status struct {
+			Phase string `json:"phase"`
+			PodIP string `json:"podIP"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+func nodeZone(labels map[string]string) string {
+	if zone, ok := labels[zoneLabel]; ok {
+		return zone
+	}
+	return labels[legacyZoneLabel]
+}
+
+// Targets returns the pods (or nodes, depending on role) matching selector as
+// targets labeled with their node and zone.
+func (k *kubernetesClient) Targets(ctx context.Context, role string, namespace string, selector string, port int) ([]config.Target, error) {
+	nodeQuery := url.Values{}
+	if role == "node" {
+		nodeQuery.Set("labelSelector", selector)
+	}
+	nodes := kubernetesNodeList{}
+	if err := k.get(ctx, "/api/v1/nodes", nodeQuery, &nodes); err != nil {
+		return nil, err
+	}
+	zones := map[string]string{}
+	for _, n := range nodes.Items {
+		zones[n.Metadata.Name] = nodeZone(n.Metadata.Labels)
+	}
+
+	var targets []config.Target
+	if role == "node" {
+		for _, n := range nodes.Items {
+			for _, a := range n.Status.Addresses {
+				if a.Type == "InternalIP" {
+					targets = append(targets, config.Target{Target: a.Address, Port: port, Labels: map[string]string{"node": n.Metadata.Name, "zone": zones[n.Metadata.Name]}})
+					break
+				}
+			}
+		}
+		return targets, nil
+	}
+
+	path := "/api/v1/pods"
+	if namespace != "" {
+		path = "/api/v1/namespaces/" + url.PathEscape(namespace) + "/pods"
+	}
+	pods := kubernetesPodList{}
+	if err := k.get(ctx, path, url.Values{"labelSelector": []string{selector}}, &pods); err != nil {
+		return nil, err
+	}
+	for _, p := range pods.Items {
+		if p.Status.Phase != "Running" || p.Status.PodIP == "" {
+			continue
+		}
+		podPort := port
+		for _, c := range p.Spec.Containers {
+			for _, cp := range c.Ports {
+				if cp.Name == iperfPortName {
+					podPort = cp.ContainerPort
+				}
+			}
+		}
+		targets = append(targets, config.Target{Target: p.Status.PodIP, Port: podPort, Labels: map[string]string{"node": p.Spec.NodeName, "zone": zones[p.Spec.NodeName]}})
+	}
+	return targets, nil
+}
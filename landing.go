@@ -0,0 +1,113 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"html"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/edgard/iperf3_exporter/internal/config"
+)
+
+// targetsTable renders the configured targets for the landing page, with
+// their notes and runbooks, or nothing without targets.
+func targetsTable(targets []config.Target, linkPrefix string) string {
+	if len(targets) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("<h2>Targets</h2>\n    <table>\n    <tr><th>Target</th><th>Port</th><th>Notes</th><th>Runbook</th></tr>\n")
+	for _, t := range targets {
+		params := url.Values{"target": {t.Target}}
+		port := t.Ports
+		if port == "" {
+			port = strconv.Itoa(config.DefaultPort)
+		}
+		if t.Port != 0 {
+			params.Set("port", strconv.Itoa(t.Port))
+			port = strconv.Itoa(t.Port)
+		}
+		b.WriteString(`    <tr><td><a href="` + html.EscapeString(linkPrefix+"/probe?"+params.Encode()) + `">` + html.EscapeString(t.Target) + `</a></td>`)
+		b.WriteString("<td>" + html.EscapeString(port) + "</td><td>" + html.EscapeString(t.Notes) + "</td><td>")
+		if t.RunbookURL != "" {
+			b.WriteString(`<a href="` + html.EscapeString(t.RunbookURL) + `">Runbook</a>`)
+		}
+		b.WriteString("</td></tr>\n")
+	}
+	b.WriteString("    </table>")
+	return b.String()
+}
+
+// probeForm renders the form of the landing page running a probe, whose
+// metrics are shown in a table below it. Without JavaScript, the form shows
+// the metrics as returned by /probe.
+func probeForm(modules map[string]*config.Module, linkPrefix string) string {
+	names := make([]string, 0, len(modules))
+	for name := range modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString(`<h2>Probe</h2>
+    <form id="probe" action="` + html.EscapeString(linkPrefix+"/probe") + `">
+    <p><label>Target <input name="target" required></label>
+    <label>Port <input name="port" type="number" min="1" max="65535" placeholder="` + strconv.Itoa(config.DefaultPort) + `"></label>
+    <label>Period <input name="period" placeholder="5s"></label>
+    <label>Streams <input name="thread" type="number" min="1" max="` + strconv.Itoa(maxThreads) + `" placeholder="1"></label>
+    <label><input name="bidir" type="checkbox" value="true"> Bidirectional</label>
+    <label><input name="udp" type="checkbox" value="true"> UDP</label>
+    <label><input name="reverse" type="checkbox" value="true"> Reverse</label>
+    <label><input name="cache" type="checkbox" value="false"> Bypass the cache</label>
+`)
+	if len(names) > 0 {
+		b.WriteString(`    <label>Module <select name="module"><option value="">none</option>`)
+		for _, name := range names {
+			b.WriteString(`<option>` + html.EscapeString(name) + `</option>`)
+		}
+		b.WriteString("</select></label>\n")
+	}
+	b.WriteString(`    <button>Run</button></p>
+    </form>
+    <p id="probe-status"></p>
+    <table id="probe-results"></table>
+    <script>
+    document.getElementById("probe").addEventListener("submit", function(ev) {
+      ev.preventDefault();
+      var form = ev.target, params = new URLSearchParams();
+      new FormData(form).forEach(function(v, k) { if (v !== "") params.append(k, v); });
+      var status = document.getElementById("probe-status"), table = document.getElementById("probe-results");
+      status.textContent = "Running...";
+      table.textContent = "";
+      fetch(form.action + "?" + params.toString()).then(function(resp) {
+        return resp.text().then(function(body) {
+          if (!resp.ok) { throw new Error(body); }
+          status.textContent = "Probe " + resp.headers.get("X-Iperf3-Probe-Id") + ", cache " + resp.headers.get("X-Iperf3-Cache") + ", " + resp.headers.get("X-Iperf3-Duration") + "s";
+          var header = table.insertRow();
+          ["Metric", "Labels", "Value"].forEach(function(h) { header.appendChild(document.createElement("th")).textContent = h; });
+          body.split("\n").forEach(function(line) {
+            var m = line.match(/^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{.*\})? (\S+)/);
+            if (!m) { return; }
+            var row = table.insertRow();
+            [m[1], m[2] || "", m[3]].forEach(function(v) { row.insertCell().textContent = v; });
+          });
+        });
+      }).catch(function(err) { status.textContent = "Probe failed: " + err.message; });
+    });
+    </script>`)
+	return b.String()
+}
@@ -0,0 +1,200 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/edgard/iperf3_exporter/internal/config"
+	"github.com/edgard/iperf3_exporter/internal/iperf"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// meshResult is the outcome of the last test against a mesh peer.
+type meshResult struct {
+	stats *iperf.Result
+	time  time.Time
+
+	// previous is the throughput of the previous successful test.
+	previous float64
+}
+
+// throughputWindow aggregates the throughput of the tests run between two
+// scrapes.
+type throughputWindow struct {
+	min, max, sum float64
+	count         int
+}
+
+func (w *throughputWindow) add(v float64) {
+	if w.count == 0 || v < w.min {
+		w.min = v
+	}
+	if w.count == 0 || v > w.max {
+		w.max = v
+	}
+	w.sum += v
+	w.count++
+}
+
+// meshCollector periodically probes every peer of the mesh but itself and
+// exports the results with source and destination labels.
+type meshCollector struct {
+	self string
+	mesh *config.Mesh
+
+	mutex   sync.Mutex
+	results map[string]meshResult
+
+	// windows are filled by the tests and moved to aggregates by every
+	// collect when downsampling is enabled.
+	windows    map[string]*throughputWindow
+	aggregates map[string]throughputWindow
+
+	success         *prometheus.Desc
+	sentSeconds     *prometheus.Desc
+	sentBytes       *prometheus.Desc
+	receivedSeconds *prometheus.Desc
+	receivedBytes   *prometheus.Desc
+	timestamp       *prometheus.Desc
+	throughput      *prometheus.Desc
+	windowTests     *prometheus.Desc
+	change          *prometheus.Desc
+}
+
+func newMeshCollector(self string, mesh *config.Mesh) *meshCollector {
+	labels := []string{"source", "destination"}
+	return &meshCollector{
+		self:            self,
+		mesh:            mesh,
+		results:         map[string]meshResult{},
+		windows:         map[string]*throughputWindow{},
+		aggregates:      map[string]throughputWindow{},
+		success:         prometheus.NewDesc(prometheus.BuildFQName(namespace, "mesh", "success"), "Was the last iperf3 test to the mesh peer successful.", labels, nil),
+		sentSeconds:     prometheus.NewDesc(prometheus.BuildFQName(namespace, "mesh", "sent_seconds"), "Total seconds spent sending packets to the mesh peer.", labels, nil),
+		sentBytes:       prometheus.NewDesc(prometheus.BuildFQName(namespace, "mesh", "sent_bytes"), "Total bytes sent to the mesh peer.", labels, nil),
+		receivedSeconds: prometheus.NewDesc(prometheus.BuildFQName(namespace, "mesh", "received_seconds"), "Total seconds spent receiving packets on the mesh peer.", labels, nil),
+		receivedBytes:   prometheus.NewDesc(prometheus.BuildFQName(namespace, "mesh", "received_bytes"), "Total bytes received by the mesh peer.", labels, nil),
+		timestamp:       prometheus.NewDesc(prometheus.BuildFQName(namespace, "mesh", "last_test_timestamp_seconds"), "Time of the last iperf3 test to the mesh peer.", labels, nil),
+		throughput:      prometheus.NewDesc(prometheus.BuildFQName(namespace, "mesh", "throughput_bytes_per_second"), "Min, max and mean received throughput of the tests to the mesh peer since the previous scrape.", append(labels, "stat"), nil),
+		windowTests:     prometheus.NewDesc(prometheus.BuildFQName(namespace, "mesh", "window_tests"), "Number of tests to the mesh peer aggregated in the throughput metrics.", labels, nil),
+		change:          prometheus.NewDesc(prometheus.BuildFQName(namespace, "mesh", "throughput_change_ratio"), "Relative change of the received throughput from the previous successful test to the mesh peer.", labels, nil),
+	}
+}
+
+// Run tests every peer in turn, then waits for the mesh interval, until ctx
+// is done. Peers are tested one at a time as an iperf3 server only accepts a
+// single test at once.
+func (m *meshCollector) Run(ctx context.Context) {
+	for {
+		for _, peer := range m.mesh.Peers {
+			if peer.Name == m.self {
+				continue
+			}
+			m.test(ctx, peer)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(m.mesh.Interval)):
+		}
+	}
+}
+
+func (m *meshCollector) test(ctx context.Context, peer config.MeshPeer) {
+	period := time.Duration(m.mesh.Period)
+	runTimeout := *timeout
+	if runTimeout < period+periodMargin {
+		runTimeout = period + periodMargin
+	}
+	ctx, cancel := context.WithTimeout(ctx, runTimeout)
+	defer cancel()
+
+	stats, err := runIperfRetrying(ctx, iperfOptions{target: peer.Target, port: peer.Port, period: period, threads: 1})
+	if err != nil {
+		iperfErrors.Inc()
+		slog.Error("Failed to test mesh peer", "peer", peer.Name, "err", err)
+	}
+
+	m.mutex.Lock()
+	previous := m.results[peer.Name].previous
+	if old := m.results[peer.Name].stats; old != nil {
+		previous = throughput(old.End.SumReceived.Bytes, old.End.SumReceived.Seconds)
+	}
+	m.results[peer.Name] = meshResult{stats: stats, time: time.Now(), previous: previous}
+	if m.mesh.Downsample && stats != nil && stats.End.SumReceived.Seconds > 0 {
+		w := m.windows[peer.Name]
+		if w == nil {
+			w = &throughputWindow{}
+			m.windows[peer.Name] = w
+		}
+		w.add(stats.End.SumReceived.Bytes / stats.End.SumReceived.Seconds)
+	}
+	m.mutex.Unlock()
+}
+
+// Describe implements prometheus.Collector.
+func (m *meshCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- m.success
+	ch <- m.sentSeconds
+	ch <- m.sentBytes
+	ch <- m.receivedSeconds
+	ch <- m.receivedBytes
+	ch <- m.timestamp
+	ch <- m.throughput
+	ch <- m.windowTests
+	ch <- m.change
+}
+
+// Collect implements prometheus.Collector.
+func (m *meshCollector) Collect(ch chan<- prometheus.Metric) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// Tests run since the previous scrape start a new aggregate; without any,
+	// the previous aggregate is exported again.
+	for peer, w := range m.windows {
+		m.aggregates[peer] = *w
+		delete(m.windows, peer)
+	}
+
+	for peer, r := range m.results {
+		ch <- prometheus.MustNewConstMetric(m.timestamp, prometheus.GaugeValue, float64(r.time.UnixNano())/1e9, m.self, peer)
+		if r.stats == nil {
+			ch <- prometheus.MustNewConstMetric(m.success, prometheus.GaugeValue, 0, m.self, peer)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(m.success, prometheus.GaugeValue, 1, m.self, peer)
+		if ratio, ok := changeRatio(r.previous, throughput(r.stats.End.SumReceived.Bytes, r.stats.End.SumReceived.Seconds)); ok {
+			ch <- prometheus.MustNewConstMetric(m.change, prometheus.GaugeValue, ratio, m.self, peer)
+		}
+		if m.mesh.Downsample {
+			if w, ok := m.aggregates[peer]; ok {
+				ch <- prometheus.MustNewConstMetric(m.throughput, prometheus.GaugeValue, w.min, m.self, peer, "min")
+				ch <- prometheus.MustNewConstMetric(m.throughput, prometheus.GaugeValue, w.max, m.self, peer, "max")
+				ch <- prometheus.MustNewConstMetric(m.throughput, prometheus.GaugeValue, w.sum/float64(w.count), m.self, peer, "mean")
+				ch <- prometheus.MustNewConstMetric(m.windowTests, prometheus.GaugeValue, float64(w.count), m.self, peer)
+			}
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(m.sentSeconds, prometheus.GaugeValue, r.stats.End.SumSent.Seconds, m.self, peer)
+		ch <- prometheus.MustNewConstMetric(m.sentBytes, prometheus.GaugeValue, r.stats.End.SumSent.Bytes, m.self, peer)
+		ch <- prometheus.MustNewConstMetric(m.receivedSeconds, prometheus.GaugeValue, r.stats.End.SumReceived.Seconds, m.self, peer)
+		ch <- prometheus.MustNewConstMetric(m.receivedBytes, prometheus.GaugeValue, r.stats.End.SumReceived.Bytes, m.self, peer)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// mqttQueueSize is the number of results waiting to be published, past
+	// which new results are dropped.
+	mqttQueueSize = 100
+
+	// mqttTimeout bounds the publication of every result.
+	mqttTimeout = 10 * time.Second
+)
+
+var mqttErrors = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: prometheus.BuildFQName(namespace, "exporter", "mqtt_errors_total"),
+	Help: "Probe results that could not be published to the MQTT broker.",
+})
+
+// mqttTopicEscaper replaces the characters of a target that have a meaning
+// in MQTT topics.
+var mqttTopicEscaper = strings.NewReplacer("/", "_", "+", "_", "#", "_")
+
+// mqttMessage is a result waiting to be published.
+type mqttMessage struct {
+	topic   string
+	payload []byte
+}
+
+// mqttPublisher publishes the results to an MQTT broker, each on the topic of
+// its target under the topic prefix. Results are queued and published one at
+// a time, and dropped while the broker is unreachable, so that an edge
+// exporter does not pile them up in memory.
+type mqttPublisher struct {
+	client mqtt.Client
+	topic  string
+	qos    byte
+	retain bool
+
+	queue chan mqttMessage
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// newMQTTPublisher returns the publisher to broker, e.g. tcp://broker:1883 or
+// ssl://broker:8883, authenticating with username, if not empty, and the
+// password of passwordFile. The connection is made, and made again when
+// lost, in the background.
+func newMQTTPublisher(broker, clientID, username, passwordFile, topic string, qos byte, retain bool) (*mqttPublisher, error) {
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(clientID).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(10 * time.Second).
+		SetWriteTimeout(mqttTimeout).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			slog.Warn("Lost the connection to the MQTT broker", "broker", broker, "err", err)
+		}).
+		SetOnConnectHandler(func(mqtt.Client) {
+			slog.Info("Connected to the MQTT broker", "broker", broker)
+		})
+	if username != "" {
+		opts.SetUsername(username)
+		if passwordFile != "" {
+			b, err := ioutil.ReadFile(passwordFile)
+			if err != nil {
+				return nil, err
+			}
+			opts.SetPassword(strings.TrimSpace(string(b)))
+		}
+	}
+	p := &mqttPublisher{
+		client: mqtt.NewClient(opts),
+		topic:  strings.TrimSuffix(topic, "/"),
+		qos:    qos,
+		retain: retain,
+		queue:  make(chan mqttMessage, mqttQueueSize),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	// With connect retries, the connection is only attempted here.
+	p.client.Connect()
+	go p.run()
+	return p, nil
+}
+
+func (p *mqttPublisher) Publish(env *resultEnvelope, payload []byte) {
+	select {
+	case p.queue <- mqttMessage{topic: p.topic + "/" + mqttTopicEscaper.Replace(env.Target), payload: payload}:
+	default:
+		mqttErrors.Inc()
+		slog.Warn("Dropped a result, the MQTT publisher is falling behind", "topic", p.topic)
+	}
+}
+
+// run publishes the queued results until stopped.
+func (p *mqttPublisher) run() {
+	defer close(p.done)
+	for {
+		var m mqttMessage
+		select {
+		case <-p.stop:
+			// The results queued so far are still published.
+			select {
+			case m = <-p.queue:
+			default:
+				return
+			}
+		case m = <-p.queue:
+		}
+		if err := p.publish(m); err != nil {
+			mqttErrors.Inc()
+			slog.Error("Failed to publish the result to the MQTT broker", "topic", m.topic, "err", err)
+		}
+	}
+}
+
+func (p *mqttPublisher) publish(m mqttMessage) error {
+	if !p.client.IsConnectionOpen() {
+		return errors.New("not connected to the broker")
+	}
+	t := p.client.Publish(m.topic, p.qos, p.retain, m.payload)
+	if !t.WaitTimeout(mqttTimeout) {
+		return errors.New("timeout waiting for the broker")
+	}
+	return t.Error()
+}
+
+// Close publishes the queued results and disconnects from the broker.
+func (p *mqttPublisher) Close() error {
+	close(p.stop)
+	<-p.done
+	p.client.Disconnect(uint(time.Second / time.Millisecond))
+	return nil
+}
@@ -0,0 +1,242 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/edgard/iperf3_exporter/internal/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+// multiTarget is a target of /probe_multi.
+type multiTarget struct {
+	target string
+	port   string // empty for the default or configured ports
+
+	// labels are added to the metrics of the target.
+	labels map[string]string
+}
+
+// parseMultiTargets parses a comma-separated list of targets, each with an
+// optional port, e.g. "a,b:5202,[2001:db8::1]:5203".
+func parseMultiTargets(s string) []multiTarget {
+	var targets []multiTarget
+	for _, t := range strings.Split(s, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		if host, port, err := net.SplitHostPort(t); err == nil {
+			targets = append(targets, multiTarget{target: host, port: port})
+			continue
+		}
+		targets = append(targets, multiTarget{target: t})
+	}
+	return targets
+}
+
+// multiHandler probes several targets, those of the targets parameter or else
+// every configured and discovered target, and serves their metrics in a
+// single exposition with target and port labels. The other parameters apply
+// to every probe.
+func multiHandler(discoverers []discoverer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var targets []multiTarget
+		if v := r.URL.Query().Get("targets"); v != "" {
+			targets = parseMultiTargets(v)
+		} else {
+			targets = configuredMultiTargets(discoverers)
+		}
+		if len(targets) == 0 {
+			http.Error(w, "'targets' parameter must be specified when no target is configured", http.StatusBadRequest)
+			iperfErrors.Inc()
+			return
+		}
+
+		timeout, err := batchTimeout(r, len(targets))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			iperfErrors.Inc()
+			return
+		}
+		mfs := probeTargets(r, targets, timeout)
+		h := promhttp.HandlerFor(prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) { return mfs, nil }), promhttp.HandlerOpts{EnableOpenMetrics: *cachedTimestamps})
+		h.ServeHTTP(w, r)
+	}
+}
+
+// configuredMultiTargets returns every configured and discovered target, with
+// the labels service discovery would give the scraped series.
+func configuredMultiTargets(discoverers []discoverer) []multiTarget {
+	var targets []multiTarget
+	for _, t := range discoveredTargets(sc.Get(), discoverers) {
+		mt := multiTarget{target: t.Target, labels: map[string]string{}}
+		if t.Port != 0 {
+			mt.port = strconv.Itoa(t.Port)
+		}
+		for name, value := range t.Labels {
+			if !strings.HasPrefix(name, model.ReservedLabelPrefix) {
+				mt.labels[name] = value
+			}
+		}
+		targets = append(targets, mt)
+	}
+	return targets
+}
+
+// batchTimeout splits the timeout of r between the successive batches of n
+// probes of /probe_multi, refusing the probes which cannot fit in it.
+func batchTimeout(r *http.Request, n int) (time.Duration, error) {
+	v := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+	if v == "" {
+		// Without a scrape timeout, every probe gets the default one.
+		return probeTimeout(r)
+	}
+	seconds, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse timeout from Prometheus header: %s", err)
+	}
+	total := time.Duration(seconds * float64(time.Second))
+	batches := (n + *multiConcurrency - 1) / *multiConcurrency
+	timeout := total / time.Duration(batches)
+	if min := *minPeriod + periodMargin; timeout < min {
+		return 0, fmt.Errorf("%d targets in batches of %d do not fit in the %s timeout, each batch needing at least %s", n, *multiConcurrency, total, min)
+	}
+	return timeout, nil
+}
+
+// probeTargets probes targets, --probe.multi-concurrency at once, like /probe
+// with the parameters of r and within timeout each, and returns their merged
+// metrics.
+func probeTargets(r *http.Request, targets []multiTarget, timeout time.Duration) []*dto.MetricFamily {
+	results := make([][]*dto.MetricFamily, len(targets))
+	sem := make(chan struct{}, *multiConcurrency)
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, t multiTarget) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = probeOne(r, t, timeout)
+		}(i, t)
+	}
+	wg.Wait()
+	return mergeFamilies(results)
+}
+
+// probeOne probes t like /probe with the parameters of r within timeout, and
+// returns its metrics with a target label, or a probe error metric if the
+// probe was refused.
+func probeOne(r *http.Request, t multiTarget, timeout time.Duration) []*dto.MetricFamily {
+	q := r.URL.Query()
+	q.Del("targets")
+	q.Set("target", t.target)
+	q.Del("port")
+	if t.port != "" {
+		q.Set("port", t.port)
+	}
+	sub := r.Clone(r.Context())
+	sub.URL.RawQuery = q.Encode()
+	sub.Header.Set("Accept", string(expfmt.FmtText))
+	sub.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", strconv.FormatFloat(timeout.Seconds(), 'f', -1, 64))
+
+	rec := httptest.NewRecorder()
+	handler(rec, sub)
+	target := &dto.LabelPair{Name: strPtr("target"), Value: strPtr(config.RedactTarget(t.target))}
+	if rec.Code != http.StatusOK {
+		slog.Warn("Failed to probe a target of a multi-target probe", "target", config.RedactTarget(t.target), "port", t.port, "err", strings.TrimSpace(rec.Body.String()))
+		port := t.port
+		if port == "" {
+			port = strconv.Itoa(config.DefaultPort)
+		}
+		return []*dto.MetricFamily{{
+			Name: strPtr(prometheus.BuildFQName(namespace, "", "probe_error")),
+			Help: strPtr("Whether the probe of the target of a multi-target probe was refused, e.g. for an invalid parameter."),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{
+				Label: []*dto.LabelPair{{Name: strPtr("port"), Value: strPtr(port)}, target},
+				Gauge: &dto.Gauge{Value: float64Ptr(1)},
+			}},
+		}}
+	}
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(rec.Body)
+	if err != nil {
+		slog.Error("Failed to parse the metrics of a target of a multi-target probe", "target", config.RedactTarget(t.target), "err", err)
+		return nil
+	}
+	mfs := make([]*dto.MetricFamily, 0, len(families))
+	for _, mf := range families {
+		for _, m := range mf.Metric {
+			m.Label = append(m.Label, target)
+			for name, value := range t.labels {
+				if !hasLabel(m, name) {
+					m.Label = append(m.Label, &dto.LabelPair{Name: strPtr(name), Value: strPtr(value)})
+				}
+			}
+			sort.Slice(m.Label, func(i, j int) bool { return m.Label[i].GetName() < m.Label[j].GetName() })
+		}
+		mfs = append(mfs, mf)
+	}
+	return mfs
+}
+
+func hasLabel(m *dto.Metric, name string) bool {
+	for _, l := range m.Label {
+		if l.GetName() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeFamilies merges the metric families of several probes by name.
+func mergeFamilies(results [][]*dto.MetricFamily) []*dto.MetricFamily {
+	byName := map[string]*dto.MetricFamily{}
+	for _, mfs := range results {
+		for _, mf := range mfs {
+			if merged, ok := byName[mf.GetName()]; ok {
+				merged.Metric = append(merged.Metric, mf.Metric...)
+				continue
+			}
+			byName[mf.GetName()] = mf
+		}
+	}
+	mfs := make([]*dto.MetricFamily, 0, len(byName))
+	for _, mf := range byName {
+		mfs = append(mfs, mf)
+	}
+	sort.Slice(mfs, func(i, j int) bool { return mfs[i].GetName() < mfs[j].GetName() })
+	return mfs
+}
+
+func strPtr(s string) *string { return &s }
+
+func float64Ptr(f float64) *float64 { return &f }
@@ -0,0 +1,40 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log/slog"
+
+	"github.com/edgard/iperf3_exporter/internal/iperf"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var parseWarnings = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(namespace, "exporter", "parse_warnings_total"),
+		Help: "iperf3 results accepted by the lenient parse mode despite a problem.",
+	},
+	[]string{"reason"},
+)
+
+// parseResult decodes the JSON output of iperf3, counting and logging the
+// problems accepted in lenient mode.
+func parseResult(out []byte, strict bool) (*iperf.Result, error) {
+	r, warnings, err := iperf.Parse(out, strict)
+	for _, w := range warnings {
+		parseWarnings.WithLabelValues(w.Reason).Inc()
+		slog.Warn("Ignoring a problem of the iperf3 result", "reason", w.Reason, "problem", w.Message)
+	}
+	return r, err
+}
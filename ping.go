@@ -0,0 +1,109 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/edgard/iperf3_exporter/internal/config"
+)
+
+const (
+	defaultPingCount    = 5
+	defaultPingInterval = 200 * time.Millisecond
+	defaultPingTimeout  = 2 * time.Second
+)
+
+var (
+	// pingPacketsRE matches the packet summary of the iputils and busybox
+	// ping commands.
+	pingPacketsRE = regexp.MustCompile(`(\d+) packets transmitted, (\d+) (?:packets )?received`)
+
+	// pingRTTRE matches the round-trip summary, "rtt min/avg/max/mdev" for
+	// iputils and "round-trip min/avg/max" for busybox.
+	pingRTTRE = regexp.MustCompile(`min/avg/max[^=]*= ([\d.]+)/([\d.]+)/([\d.]+)`)
+)
+
+// pingResult is the outcome of a burst of ICMP echo requests.
+type pingResult struct {
+	sent     int
+	received int
+
+	// The round-trip times are only known when a reply was received.
+	rttMin, rttAvg, rttMax time.Duration
+}
+
+// loss returns the ratio of echo requests left unanswered.
+func (r pingResult) loss() float64 {
+	if r.sent == 0 {
+		return 1
+	}
+	return float64(r.sent-r.received) / float64(r.sent)
+}
+
+// runPing sends a burst of echo requests to the target with the ping command,
+// in front of prefix, e.g. to run it in a network namespace.
+func runPing(ctx context.Context, p *config.Ping, prefix []string, target string) (pingResult, error) {
+	count, interval, wait := p.Count, time.Duration(p.Interval), time.Duration(p.Timeout)
+	if count == 0 {
+		count = defaultPingCount
+	}
+	if interval == 0 {
+		interval = defaultPingInterval
+	}
+	if wait == 0 {
+		wait = defaultPingTimeout
+	}
+	// The deadline covers the whole burst and the wait for the last reply.
+	deadline := time.Duration(count-1)*interval + wait
+	ctx, cancel := context.WithTimeout(ctx, deadline+time.Second)
+	defer cancel()
+
+	argv := append(append([]string(nil), prefix...), "ping", "-n", "-q",
+		"-c", strconv.Itoa(count),
+		"-i", strconv.FormatFloat(interval.Seconds(), 'f', 3, 64),
+		"-w", strconv.Itoa(int(math.Ceil(deadline.Seconds()))),
+		"--", target)
+	out, err := exec.CommandContext(ctx, argv[0], argv[1:]...).Output()
+	// ping exits with 1 when no reply was received, which is a result rather
+	// than a failure as long as the summary was printed.
+	m := pingPacketsRE.FindSubmatch(out)
+	if m == nil {
+		if err == nil {
+			err = errors.New("no packet summary in the ping output")
+		}
+		return pingResult{}, fmt.Errorf("failed to run ping: %s", err)
+	}
+	r := pingResult{}
+	r.sent, _ = strconv.Atoi(string(m[1]))
+	r.received, _ = strconv.Atoi(string(m[2]))
+	if m := pingRTTRE.FindSubmatch(out); m != nil {
+		r.rttMin = pingMillis(m[1])
+		r.rttAvg = pingMillis(m[2])
+		r.rttMax = pingMillis(m[3])
+	}
+	return r, nil
+}
+
+func pingMillis(b []byte) time.Duration {
+	ms, _ := strconv.ParseFloat(string(b), 64)
+	return time.Duration(ms * float64(time.Millisecond))
+}
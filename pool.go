@@ -0,0 +1,178 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/edgard/iperf3_exporter/internal/cache"
+	"github.com/edgard/iperf3_exporter/internal/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// poolHealthDecay is the weight of the latest test in the health of a
+	// pool server.
+	poolHealthDecay = 0.3
+
+	// poolHealthyThreshold is the health under which servers of a lower
+	// priority are no longer preferred.
+	poolHealthyThreshold = 0.5
+
+	// poolMinHealth keeps failing servers selected once in a while, so that
+	// they are noticed when they recover.
+	poolMinHealth = 0.05
+)
+
+var poolServerHealth = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: prometheus.BuildFQName(namespace, "pool", "server_health"),
+		Help: "Recent success ratio of the tests to the pool server, between 0 and 1.",
+	},
+	[]string{"pool", "target", "port"},
+)
+
+type poolServerKey struct {
+	pool   string
+	target string
+	port   int
+}
+
+// poolHealth is the health of a pool server, an exponentially weighted moving
+// average of the outcome of its tests.
+type poolHealth struct {
+	score float64
+	last  time.Time
+}
+
+var (
+	poolMutex  sync.Mutex
+	poolStates = map[poolServerKey]*poolHealth{}
+)
+
+// serverHealth returns the health of a pool server, unknown servers being
+// healthy. It must be called with poolMutex held.
+func serverHealth(k poolServerKey) *poolHealth {
+	h, ok := poolStates[k]
+	if !ok {
+		h = &poolHealth{score: 1}
+		poolStates[k] = h
+		poolServerHealth.WithLabelValues(k.pool, k.target, strconv.Itoa(k.port)).Set(h.score)
+	}
+	return h
+}
+
+// poolServers returns the static servers of a pool and those of its SRV
+// records.
+func poolServers(ctx context.Context, p *config.Pool) ([]config.PoolServer, error) {
+	servers := append([]config.PoolServer(nil), p.Servers...)
+	for _, name := range p.SRV {
+		srvs, _, err := lookupSRV(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %q: %s", name, err)
+		}
+		for _, srv := range srvs {
+			servers = append(servers, config.PoolServer{
+				Target:   strings.TrimSuffix(srv.Target, "."),
+				Port:     int(srv.Port),
+				Priority: int(srv.Priority),
+				Weight:   int(srv.Weight),
+			})
+		}
+	}
+	return servers, nil
+}
+
+// pickPoolServer selects the server of the named pool to test. The healthy
+// servers of the lowest priority are preferred, and a server is selected in
+// proportion to its weight times its health.
+func pickPoolServer(ctx context.Context, c *config.Config, name string) (config.PoolServer, error) {
+	p, ok := c.Pools[name]
+	if !ok {
+		return config.PoolServer{}, fmt.Errorf("unknown pool %q", name)
+	}
+	servers, err := poolServers(ctx, p)
+	if err != nil {
+		return config.PoolServer{}, fmt.Errorf("pool %q: %s", name, err)
+	}
+	if len(servers) == 0 {
+		return config.PoolServer{}, fmt.Errorf("pool %q: no servers", name)
+	}
+	sort.SliceStable(servers, func(i, j int) bool { return servers[i].Priority < servers[j].Priority })
+
+	poolMutex.Lock()
+	defer poolMutex.Unlock()
+
+	candidates := servers
+	for i := 0; i < len(servers); {
+		j := i
+		healthy := false
+		for ; j < len(servers) && servers[j].Priority == servers[i].Priority; j++ {
+			if serverHealth(poolServerKey{name, servers[j].Target, servers[j].Port}).score >= poolHealthyThreshold {
+				healthy = true
+			}
+		}
+		if healthy {
+			candidates = servers[i:j]
+			break
+		}
+		i = j
+	}
+
+	weights := make([]float64, len(candidates))
+	var total float64
+	for i, s := range candidates {
+		w := float64(s.Weight)
+		if w == 0 {
+			w = 1
+		}
+		score := serverHealth(poolServerKey{name, s.Target, s.Port}).score
+		if score < poolMinHealth {
+			score = poolMinHealth
+		}
+		weights[i] = w * score
+		total += weights[i]
+	}
+	n := rand.Float64() * total
+	for i, w := range weights {
+		if n < w {
+			return candidates[i], nil
+		}
+		n -= w
+	}
+	return candidates[len(candidates)-1], nil
+}
+
+// recordPoolOutcome updates the health of a pool server with the outcome of a
+// probe. Outcomes served again from the cache are only counted once.
+func recordPoolOutcome(pool string, target string, port int, outcome cache.Outcome) {
+	poolMutex.Lock()
+	defer poolMutex.Unlock()
+
+	k := poolServerKey{pool, target, port}
+	h := serverHealth(k)
+	if !outcome.Time.After(h.last) {
+		return
+	}
+	h.last = outcome.Time
+	h.score = (1-poolHealthDecay)*h.score + poolHealthDecay*boolToFloat(outcome.OK)
+	poolServerHealth.WithLabelValues(pool, target, strconv.Itoa(port)).Set(h.score)
+}
@@ -0,0 +1,129 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/edgard/iperf3_exporter/internal/config"
+	"github.com/edgard/iperf3_exporter/internal/iperf"
+	"github.com/prometheus/common/model"
+)
+
+// resultEnvelope is the document published for the result of every test.
+type resultEnvelope struct {
+	Time          time.Time         `json:"time"`
+	Target        string            `json:"target"`
+	Port          int               `json:"port"`
+	Module        string            `json:"module,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	Success       bool              `json:"success"`
+	FailureReason string            `json:"failure_reason,omitempty"`
+	Error         string            `json:"error,omitempty"`
+	Summary       *resultSummary    `json:"summary,omitempty"`
+
+	// Result is the iperf3 JSON output of the test, if it ran iperf3.
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+// resultSummary sums up a successful test.
+type resultSummary struct {
+	SentBytes             float64 `json:"sent_bytes"`
+	SentSeconds           float64 `json:"sent_seconds"`
+	ReceivedBytes         float64 `json:"received_bytes"`
+	ReceivedSeconds       float64 `json:"received_seconds"`
+	SentBitsPerSecond     float64 `json:"sent_bits_per_second"`
+	ReceivedBitsPerSecond float64 `json:"received_bits_per_second"`
+	Retransmits           float64 `json:"retransmits"`
+	Streams               int     `json:"streams"`
+}
+
+// resultPublisher publishes the results of the tests to a message broker.
+type resultPublisher interface {
+	// Publish publishes payload, the JSON encoding of env, without waiting
+	// for the broker.
+	Publish(env *resultEnvelope, payload []byte)
+
+	// Close flushes the pending results.
+	Close() error
+}
+
+// publishers are the configured result publishers.
+var publishers []resultPublisher
+
+// publishResult publishes the outcome of a test of target and port started at
+// start, either its result stats or its failure err, to every publisher. t is
+// the configured target, if any.
+func publishResult(t *config.Target, target string, port int, module string, start time.Time, stats *iperf.Result, err error) {
+	if len(publishers) == 0 {
+		return
+	}
+	env := &resultEnvelope{
+		Time:    time.Now().UTC(),
+		Target:  config.RedactTarget(target),
+		Port:    port,
+		Module:  module,
+		Success: err == nil,
+	}
+	if t != nil {
+		for name, value := range t.Labels {
+			if !strings.HasPrefix(name, model.ReservedLabelPrefix) {
+				if env.Labels == nil {
+					env.Labels = map[string]string{}
+				}
+				env.Labels[name] = value
+			}
+		}
+	}
+	if err != nil {
+		env.FailureReason = errorReason(err)
+		env.Error = err.Error()
+	} else if stats != nil {
+		env.Summary = &resultSummary{
+			SentBytes:             stats.End.SumSent.Bytes,
+			SentSeconds:           stats.End.SumSent.Seconds,
+			ReceivedBytes:         stats.End.SumReceived.Bytes,
+			ReceivedSeconds:       stats.End.SumReceived.Seconds,
+			SentBitsPerSecond:     throughput(stats.End.SumSent.Bytes, stats.End.SumSent.Seconds) * 8,
+			ReceivedBitsPerSecond: throughput(stats.End.SumReceived.Bytes, stats.End.SumReceived.Seconds) * 8,
+			Retransmits:           stats.End.SumSent.Retransmits,
+			Streams:               len(stats.End.Streams),
+		}
+		// The raw output of the test is that stored since it started, on
+		// any port as the test may have fallen back to another one.
+		if raw, ok := rawResults.Get(target, 0); ok && !raw.time.Before(start) {
+			env.Result = raw.doc
+		}
+	}
+	payload, jsonErr := json.Marshal(env)
+	if jsonErr != nil {
+		slog.Error("Failed to encode the result to publish", "err", jsonErr)
+		return
+	}
+	for _, p := range publishers {
+		p.Publish(env, payload)
+	}
+}
+
+// closePublishers flushes the pending results of every publisher.
+func closePublishers() {
+	for _, p := range publishers {
+		if err := p.Close(); err != nil {
+			slog.Error("Failed to flush the published results", "err", err)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/version"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// pushTimeout bounds every remote write request.
+const pushTimeout = 30 * time.Second
+
+var pushErrors = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: prometheus.BuildFQName(namespace, "exporter", "push_errors_total"),
+	Help: "Errors pushing the probe results to the remote write endpoint.",
+})
+
+// pushLabel is a label of a remote write series.
+type pushLabel struct {
+	name, value string
+}
+
+// pushSeries is a remote write series with a single sample.
+type pushSeries struct {
+	labels    []pushLabel
+	value     float64
+	timestamp int64 // in milliseconds
+}
+
+// pusher periodically probes every configured and discovered target, and
+// pushes their metrics to a Prometheus remote write endpoint, for exporters
+// that cannot be scraped.
+type pusher struct {
+	url         string
+	bearerToken string
+	labels      []pushLabel
+	discoverers []discoverer
+	client      *http.Client
+}
+
+// newPusher returns the pusher to url, adding the job and instance labels to
+// every series like a scrape would. The token, if any, is read from the bearer
+// token file.
+func newPusher(url, job, instance, bearerTokenFile string, discoverers []discoverer) (*pusher, error) {
+	p := &pusher{
+		url:         url,
+		labels:      []pushLabel{{"instance", instance}, {"job", job}},
+		discoverers: discoverers,
+		client:      &http.Client{Timeout: pushTimeout},
+	}
+	if bearerTokenFile != "" {
+		b, err := ioutil.ReadFile(bearerTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		p.bearerToken = strings.TrimSpace(string(b))
+	}
+	return p, nil
+}
+
+// Run probes and pushes the targets every interval, until ctx is done.
+func (p *pusher) Run(ctx context.Context, interval time.Duration) {
+	for {
+		p.push(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (p *pusher) push(ctx context.Context) {
+	targets := configuredMultiTargets(p.discoverers)
+	if len(targets) == 0 {
+		slog.Debug("No target to probe and push")
+		return
+	}
+	r := httptest.NewRequest(http.MethodGet, "/probe", nil).WithContext(ctx)
+	// Without a scrape timeout header, every probe gets --iperf3.timeout.
+	timeout, _ := probeTimeout(r)
+	series := familiesSeries(probeTargets(r, targets, timeout), p.labels, time.Now())
+	if err := p.write(ctx, series); err != nil {
+		pushErrors.Inc()
+		slog.Error("Failed to push the probe results", "url", p.url, "err", err)
+		return
+	}
+	slog.Debug("Pushed the probe results", "targets", len(targets), "series", len(series))
+}
+
+// write sends series to the remote write endpoint.
+func (p *pusher) write(ctx context.Context, series []pushSeries) error {
+	req, err := http.NewRequest(http.MethodPost, p.url, bytes.NewReader(snappy.Encode(nil, encodeWriteRequest(series))))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "iperf3_exporter/"+version.Version)
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if p.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+p.bearerToken)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// familiesSeries flattens metric families into remote write series with the
+// extra labels they do not have, the way Prometheus stores the samples of a
+// scrape. Samples without a timestamp are given now.
+func familiesSeries(mfs []*dto.MetricFamily, extra []pushLabel, now time.Time) []pushSeries {
+	var series []pushSeries
+	for _, mf := range mfs {
+		name := mf.GetName()
+		for _, m := range mf.Metric {
+			ts := now.UnixNano() / int64(time.Millisecond)
+			if m.TimestampMs != nil {
+				ts = m.GetTimestampMs()
+			}
+			add := func(name string, value float64, labels ...pushLabel) {
+				ls := []pushLabel{{"__name__", name}}
+				for _, l := range m.Label {
+					ls = append(ls, pushLabel{l.GetName(), l.GetValue()})
+				}
+				ls = append(ls, labels...)
+				// The labels of the metric, e.g. those of the target, win
+				// over the extra labels.
+				for _, l := range extra {
+					if !hasLabel(m, l.name) {
+						ls = append(ls, l)
+					}
+				}
+				sort.Slice(ls, func(i, j int) bool { return ls[i].name < ls[j].name })
+				series = append(series, pushSeries{labels: ls, value: value, timestamp: ts})
+			}
+			switch {
+			case m.Gauge != nil:
+				add(name, m.Gauge.GetValue())
+			case m.Counter != nil:
+				add(name, m.Counter.GetValue())
+			case m.Untyped != nil:
+				add(name, m.Untyped.GetValue())
+			case m.Summary != nil:
+				for _, q := range m.Summary.Quantile {
+					add(name, q.GetValue(), pushLabel{"quantile", formatFloat(q.GetQuantile())})
+				}
+				add(name+"_sum", m.Summary.GetSampleSum())
+				add(name+"_count", float64(m.Summary.GetSampleCount()))
+			case m.Histogram != nil:
+				for _, b := range m.Histogram.Bucket {
+					add(name+"_bucket", float64(b.GetCumulativeCount()), pushLabel{"le", formatFloat(b.GetUpperBound())})
+				}
+				if n := len(m.Histogram.Bucket); n == 0 || !math.IsInf(m.Histogram.Bucket[n-1].GetUpperBound(), 1) {
+					add(name+"_bucket", float64(m.Histogram.GetSampleCount()), pushLabel{"le", "+Inf"})
+				}
+				add(name+"_sum", m.Histogram.GetSampleSum())
+				add(name+"_count", float64(m.Histogram.GetSampleCount()))
+			}
+		}
+	}
+	return series
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// encodeWriteRequest encodes series as a remote write WriteRequest protobuf
+// message:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(series []pushSeries) []byte {
+	var b, ts, msg []byte
+	for _, s := range series {
+		ts = ts[:0]
+		for _, l := range s.labels {
+			msg = protowire.AppendTag(msg[:0], 1, protowire.BytesType)
+			msg = protowire.AppendString(msg, l.name)
+			msg = protowire.AppendTag(msg, 2, protowire.BytesType)
+			msg = protowire.AppendString(msg, l.value)
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, msg)
+		}
+		msg = protowire.AppendTag(msg[:0], 1, protowire.Fixed64Type)
+		msg = protowire.AppendFixed64(msg, math.Float64bits(s.value))
+		msg = protowire.AppendTag(msg, 2, protowire.VarintType)
+		msg = protowire.AppendVarint(msg, uint64(s.timestamp))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, msg)
+
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, ts)
+	}
+	return b
+}
@@ -0,0 +1,61 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(1, 2)
+	start := time.Now()
+	for _, tc := range []struct {
+		client string
+		after  time.Duration
+		ok     bool
+		wait   time.Duration
+	}{
+		{"10.0.0.1", 0, true, 0},
+		{"10.0.0.1", 0, true, 0},
+		{"10.0.0.1", 0, false, time.Second},
+		{"10.0.0.2", 0, true, 0},
+		{"10.0.0.1", 500 * time.Millisecond, false, 500 * time.Millisecond},
+		{"10.0.0.1", time.Second, true, 0},
+		{"10.0.0.1", time.Second, false, time.Second},
+		// The bucket refills up to the burst only.
+		{"10.0.0.1", time.Minute, true, 0},
+		{"10.0.0.1", time.Minute, true, 0},
+		{"10.0.0.1", time.Minute, false, time.Second},
+		// Idle clients are forgotten, with a full bucket.
+		{"10.0.0.1", time.Minute + 2*rateLimitIdle, true, 0},
+	} {
+		ok, wait := l.allow(tc.client, start.Add(tc.after))
+		if ok != tc.ok || wait != tc.wait {
+			t.Errorf("%s after %s: got %t, %s, want %t, %s", tc.client, tc.after, ok, wait, tc.ok, tc.wait)
+		}
+	}
+}
+
+func TestRateLimiterBurst(t *testing.T) {
+	// A burst below one still lets a probe through.
+	l := newRateLimiter(0.5, 0)
+	now := time.Now()
+	if ok, _ := l.allow("10.0.0.1", now); !ok {
+		t.Fatal("first probe refused")
+	}
+	if ok, wait := l.allow("10.0.0.1", now); ok || wait != 2*time.Second {
+		t.Errorf("got %t, %s, want false, 2s", ok, wait)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/edgard/iperf3_exporter/internal/config"
+)
+
+// maxRawResults bounds the raw results kept, as probes can name any target.
+const maxRawResults = 1000
+
+type rawKey struct {
+	target string
+	port   int
+}
+
+// rawResult is the JSON document of the latest iperf3 test of a target.
+type rawResult struct {
+	doc  []byte
+	time time.Time
+}
+
+// rawStore keeps the latest iperf3 JSON document of every target and port
+// for /probe/raw.
+type rawStore struct {
+	mutex   sync.Mutex
+	results map[rawKey]rawResult
+}
+
+var rawResults = &rawStore{results: map[rawKey]rawResult{}}
+
+// Set records doc as the latest document of target and port, dropping the
+// oldest document when full.
+func (s *rawStore) Set(target string, port int, doc []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	k := rawKey{target, port}
+	if _, ok := s.results[k]; !ok && len(s.results) >= maxRawResults {
+		var oldest rawKey
+		var first time.Time
+		for k, r := range s.results {
+			if first.IsZero() || r.time.Before(first) {
+				oldest, first = k, r.time
+			}
+		}
+		delete(s.results, oldest)
+	}
+	s.results[k] = rawResult{doc: doc, time: time.Now()}
+}
+
+// Get returns the latest document of target and port, or of any port of the
+// target if port is zero.
+func (s *rawStore) Get(target string, port int) (rawResult, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if port != 0 {
+		r, ok := s.results[rawKey{target, port}]
+		return r, ok
+	}
+	var latest rawResult
+	found := false
+	for k, r := range s.results {
+		if k.target == target && (!found || r.time.After(latest.time)) {
+			latest, found = r, true
+		}
+	}
+	return latest, found
+}
+
+// rawHandler serves the latest iperf3 JSON document of the target parameter,
+// as iperf3 printed it, so that other tools can use the fields the exporter
+// does not export.
+func rawHandler(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "'target' parameter must be specified", http.StatusBadRequest)
+		return
+	}
+	if config.HasCredentials(target) {
+		http.Error(w, "'target' parameter "+config.ErrCredentials, http.StatusBadRequest)
+		return
+	}
+	var port int
+	if v := r.URL.Query().Get("port"); v != "" {
+		var err error
+		if port, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "'port' parameter must be an integer: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	res, ok := rawResults.Get(target, port)
+	if !ok {
+		http.Error(w, "No iperf3 result for the target yet", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Last-Modified", res.time.UTC().Format(http.TimeFormat))
+	if _, err := w.Write(res.doc); err != nil {
+		slog.Warn("Failed to write to HTTP client", "err", err)
+	}
+}
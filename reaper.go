@@ -0,0 +1,121 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/edgard/iperf3_exporter/internal/host"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxFinishedGroups bounds the process groups of finished tests watched for
+// leftover processes.
+const maxFinishedGroups = 10000
+
+var orphanedProcesses = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: prometheus.BuildFQName(namespace, "exporter", "orphaned_processes"),
+	Help: "Processes left running by finished iperf3 tests at the latest sweep of the reaper.",
+})
+
+// processGroups tracks the process groups the iperf3 clients run in, so that
+// the processes left in the group of a finished test can be told apart from
+// those of the running tests.
+type processGroups struct {
+	mutex    sync.Mutex
+	running  map[int]bool
+	finished map[int]time.Time
+}
+
+// testGroups are the process groups of the tests.
+var testGroups = &processGroups{running: map[int]bool{}, finished: map[int]time.Time{}}
+
+// Start records the group of a test that started.
+func (g *processGroups) Start(pgid int) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.running[pgid] = true
+	delete(g.finished, pgid)
+}
+
+// Finish records that the test of a group finished, the processes still in
+// the group being leftovers from then on.
+func (g *processGroups) Finish(pgid int) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	delete(g.running, pgid)
+	if len(g.finished) >= maxFinishedGroups {
+		oldest, oldestTime := 0, time.Time{}
+		for id, t := range g.finished {
+			if oldest == 0 || t.Before(oldestTime) {
+				oldest, oldestTime = id, t
+			}
+		}
+		delete(g.finished, oldest)
+	}
+	g.finished[pgid] = time.Now()
+}
+
+// sweep returns the live processes of procs in the groups of finished tests,
+// and forgets the finished groups left without any. The leader of a finished
+// group was waited for, so a process whose PID is the group ID means the ID
+// was reused by another group, which is forgotten too. Otherwise, the ID
+// cannot be reused while processes are left in the group, whatever their
+// names, e.g. those of a wrapper or of ip netns exec.
+func (g *processGroups) sweep(procs []host.Process) []host.Process {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for _, p := range procs {
+		delete(g.finished, p.PID)
+	}
+	var orphans []host.Process
+	used := map[int]bool{}
+	for _, p := range procs {
+		if _, ok := g.finished[p.PGID]; ok && !p.Zombie {
+			orphans = append(orphans, p)
+			used[p.PGID] = true
+		}
+	}
+	for pgid := range g.finished {
+		if !used[pgid] {
+			delete(g.finished, pgid)
+		}
+	}
+	return orphans
+}
+
+// runReaper looks for the processes left running by the finished tests every
+// interval, e.g. those that escaped the kill of their group on timeout, and
+// kills them.
+func runReaper(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		procs, err := host.Processes()
+		if err != nil {
+			slog.Warn("Stopped looking for orphaned iperf3 processes", "err", err)
+			return
+		}
+		orphans := testGroups.sweep(procs)
+		orphanedProcesses.Set(float64(len(orphans)))
+		for _, p := range orphans {
+			slog.Warn("Killing a process left running by a finished iperf3 test", "pid", p.PID, "name", p.Name, "pgid", p.PGID)
+			if proc, err := os.FindProcess(p.PID); err == nil {
+				proc.Kill()
+			}
+		}
+	}
+}
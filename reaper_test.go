@@ -0,0 +1,55 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/edgard/iperf3_exporter/internal/host"
+)
+
+func TestProcessGroupsSweep(t *testing.T) {
+	g := &processGroups{running: map[int]bool{}, finished: map[int]time.Time{}}
+	for _, pgid := range []int{100, 200, 300, 400} {
+		g.Start(pgid)
+	}
+	for _, pgid := range []int{100, 200, 300} {
+		g.Finish(pgid)
+	}
+
+	procs := []host.Process{
+		// Leftovers of 100, whatever their names.
+		{PID: 101, PGID: 100, Name: "iperf3"},
+		{PID: 102, PGID: 100, Name: "my-iperf3-wrapper"},
+		{PID: 103, PGID: 100, Name: "iperf3", Zombie: true},
+		// The ID of 200 was reused by another group.
+		{PID: 200, PGID: 200, Name: "bash"},
+		{PID: 201, PGID: 200, Name: "iperf3"},
+		// 300 has no processes left, and 400 is still running.
+		{PID: 401, PGID: 400, Name: "iperf3"},
+		{PID: 501, PGID: 500, Name: "iperf3"},
+	}
+	want := []host.Process{procs[0], procs[1]}
+	if got := g.sweep(procs); !reflect.DeepEqual(got, want) {
+		t.Errorf("got orphans %+v, want %+v", got, want)
+	}
+	if _, ok := g.finished[100]; !ok || len(g.finished) != 1 {
+		t.Errorf("got finished groups %v, want only 100 kept", g.finished)
+	}
+	if got := g.sweep(nil); len(got) != 0 || len(g.finished) != 0 {
+		t.Errorf("got orphans %+v and finished groups %v once none is left", got, g.finished)
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// registerTimeout bounds every registration request.
+const registerTimeout = 10 * time.Second
+
+// registration announces the exporter instance to Consul or to an HTTP service
+// discovery bridge, so that Prometheus discovers it as it is deployed.
+type registration struct {
+	address string
+	labels  map[string]string
+	modules []string
+
+	consulServer string
+	consulToken  string
+	service      string
+	httpURL      string
+}
+
+// newRegistration returns the registration of the exporter listening on
+// listen, advertised at address if not empty. labels are name=value pairs.
+func newRegistration(address string, listen string, labels []string) (*registration, error) {
+	if address == "" {
+		_, port, err := net.SplitHostPort(listen)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listen address %q: %s", listen, err)
+		}
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		address = net.JoinHostPort(host, port)
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, fmt.Errorf("invalid advertised address %q: %s", address, err)
+	}
+	r := &registration{address: address, labels: map[string]string{}}
+	for _, l := range labels {
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) != 2 || !model.LabelName(kv[0]).IsValid() {
+			return nil, fmt.Errorf("invalid label %q, must be name=value", l)
+		}
+		r.labels[kv[0]] = kv[1]
+	}
+	for name := range sc.Get().Modules {
+		r.modules = append(r.modules, name)
+	}
+	sort.Strings(r.modules)
+	return r, nil
+}
+
+// consulServiceID identifies the instance among the exporters of the service.
+func (r *registration) consulServiceID() string {
+	return r.service + "-" + r.address
+}
+
+// consulRequest sends a PUT request with body, if any, to the Consul agent.
+func (r *registration) consulRequest(ctx context.Context, path string, body interface{}) error {
+	var b []byte
+	if body != nil {
+		var err error
+		if b, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(http.MethodPut, strings.TrimSuffix(r.consulServer, "/")+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	if r.consulToken != "" {
+		req.Header.Set("X-Consul-Token", r.consulToken)
+	}
+	return doRegisterRequest(ctx, req)
+}
+
+// httpRequest sends the instance to the HTTP service discovery bridge, in the
+// Prometheus HTTP service discovery format.
+func (r *registration) httpRequest(ctx context.Context, method string) error {
+	labels := map[string]string{}
+	for k, v := range r.labels {
+		labels[k] = v
+	}
+	if len(r.modules) > 0 {
+		labels["modules"] = strings.Join(r.modules, ",")
+	}
+	b, err := json.Marshal([]sdTargetGroup{{Targets: []string{r.address}, Labels: labels}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, r.httpURL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return doRegisterRequest(ctx, req)
+}
+
+func doRegisterRequest(ctx context.Context, req *http.Request) error {
+	ctx, cancel := context.WithTimeout(ctx, registerTimeout)
+	defer cancel()
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
+// Register announces the instance. Consul checks the metrics path of the
+// instance and removes it once it has been failing for a while.
+func (r *registration) Register(ctx context.Context) error {
+	if r.consulServer != "" {
+		host, port, _ := net.SplitHostPort(r.address)
+		p, _ := strconv.Atoi(port)
+		tags := []string{}
+		for k, v := range r.labels {
+			tags = append(tags, k+"="+v)
+		}
+		sort.Strings(tags)
+		scheme := "http"
+		if *webConfigFile != "" {
+			scheme = "https"
+		}
+		service := map[string]interface{}{
+			"ID":      r.consulServiceID(),
+			"Name":    r.service,
+			"Address": host,
+			"Port":    p,
+			"Tags":    tags,
+			"Meta":    map[string]string{"modules": strings.Join(r.modules, ",")},
+			"Check": map[string]interface{}{
+				"HTTP":                           (&url.URL{Scheme: scheme, Host: r.address, Path: *metricsPath}).String(),
+				"Interval":                       "30s",
+				"TLSSkipVerify":                  true,
+				"DeregisterCriticalServiceAfter": "10m",
+			},
+		}
+		if err := r.consulRequest(ctx, "/v1/agent/service/register", service); err != nil {
+			return fmt.Errorf("failed to register with Consul: %s", err)
+		}
+	}
+	if r.httpURL != "" {
+		if err := r.httpRequest(ctx, http.MethodPost); err != nil {
+			return fmt.Errorf("failed to register with the HTTP service discovery bridge: %s", err)
+		}
+	}
+	return nil
+}
+
+// Deregister withdraws the instance, e.g. on shutdown.
+func (r *registration) Deregister(ctx context.Context) error {
+	if r.consulServer != "" {
+		if err := r.consulRequest(ctx, "/v1/agent/service/deregister/"+url.PathEscape(r.consulServiceID()), nil); err != nil {
+			return fmt.Errorf("failed to deregister from Consul: %s", err)
+		}
+	}
+	if r.httpURL != "" {
+		if err := r.httpRequest(ctx, http.MethodDelete); err != nil {
+			return fmt.Errorf("failed to deregister from the HTTP service discovery bridge: %s", err)
+		}
+	}
+	return nil
+}
+
+// Run registers the instance again every interval until ctx is done, so that
+// it survives restarts of Consul agents and expirations of bridges.
+func (r *registration) Run(ctx context.Context, interval time.Duration) {
+	for {
+		if err := r.Register(ctx); err != nil {
+			slog.Error("Error registering the exporter", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
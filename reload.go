@@ -0,0 +1,71 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	configReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{Name: prometheus.BuildFQName(namespace, "exporter", "config_last_reload_successful"), Help: "Whether the last configuration reload attempt was successful."})
+	configReloadTime    = prometheus.NewGauge(prometheus.GaugeOpts{Name: prometheus.BuildFQName(namespace, "exporter", "config_last_reload_success_timestamp_seconds"), Help: "Time of the last successful configuration reload."})
+)
+
+// reloadConfig reads the configuration file again, keeping the current
+// configuration if the file is invalid or runs an iperf3 older than
+// --iperf3.min-version, and detects the iperf3 versions of the modules.
+func reloadConfig() error {
+	if err := sc.ReloadConfig(*configFile); err != nil {
+		configReloadSuccess.Set(0)
+		return err
+	}
+	configReloadSuccess.Set(1)
+	configReloadTime.Set(float64(time.Now().UnixNano()) / 1e9)
+	if *replayDirectory == "" {
+		detectModuleVersions(context.Background(), sc.Get())
+	}
+	slog.Info("Reloaded the configuration file", "file", *configFile)
+	return nil
+}
+
+// reloadOnSIGHUP reloads the configuration file on every SIGHUP.
+func reloadOnSIGHUP() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := reloadConfig(); err != nil {
+			slog.Error("Error reloading the configuration", "err", err)
+		}
+	}
+}
+
+// reloadHandler reloads the configuration file on POST requests.
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := reloadConfig(); err != nil {
+		slog.Error("Error reloading the configuration", "err", err)
+		http.Error(w, "Failed to reload the configuration: "+err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+)
+
+// replayCount rotates through the recordings of the replay directory.
+var replayCount uint64
+
+// replayRunner returns recorded iperf3 JSON output instead of running iperf3.
+// The recording of a target is <target>.json in the directory; targets without
+// one get every *.json file of the directory in turn.
+type replayRunner struct {
+	dir    string
+	target string
+}
+
+func (r replayRunner) Output(ctx context.Context, args []string, env []string) ([]byte, error) {
+	out, err := ioutil.ReadFile(filepath.Join(r.dir, filepath.Base(r.target)+".json"))
+	if err == nil || !os.IsNotExist(err) {
+		return out, err
+	}
+
+	files, err := filepath.Glob(filepath.Join(r.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no recording in %s", r.dir)
+	}
+	sort.Strings(files)
+	n := atomic.AddUint64(&replayCount, 1) - 1
+	return ioutil.ReadFile(files[n%uint64(len(files))])
+}
@@ -0,0 +1,141 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/edgard/iperf3_exporter/internal/config"
+)
+
+// runner runs the iperf3 client, locally or elsewhere.
+type runner interface {
+	// Output runs the iperf3 client with args and the extra environment
+	// variables in env, and returns its standard output.
+	Output(ctx context.Context, args []string, env []string) ([]byte, error)
+}
+
+// localRunner runs the iperf3 client on the exporter host, through the
+// --iperf3.wrapper command and prefix, if any. The binary defaults to
+// --iperf3.path.
+type localRunner struct {
+	prefix []string
+	binary string
+}
+
+// netnsPrefix is the prefix running the iperf3 client in a network namespace.
+func netnsPrefix(ns string) []string {
+	return []string{"ip", "netns", "exec", ns}
+}
+
+// hostNetwork reports whether r runs the iperf3 client in the network
+// namespace of the exporter.
+func hostNetwork(r runner) bool {
+	lr, ok := r.(localRunner)
+	return r == nil || ok && len(lr.prefix) == 0
+}
+
+func (r localRunner) Output(ctx context.Context, args []string, env []string) ([]byte, error) {
+	binary := r.binary
+	if binary == "" {
+		binary = *iperfPath
+	}
+	argv := append(strings.Fields(*iperfWrapper), r.prefix...)
+	argv = append(append(argv, binary), args...)
+	traceCommand(ctx, argv)
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	return commandOutput(ctx, cmd)
+}
+
+// commandOutput runs cmd, started with ctx, and returns its standard output
+// like cmd.Output, but stops the processes cmd started along with it when ctx
+// is done.
+func commandOutput(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	captureStderr := cmd.Stderr == nil
+	if captureStderr {
+		cmd.Stderr = &stderr
+	}
+	err := runKillable(ctx, cmd)
+	if ee, ok := err.(*exec.ExitError); ok && captureStderr {
+		ee.Stderr = stderr.Bytes()
+	}
+	return stdout.Bytes(), err
+}
+
+// localeEnv returns the environment variables setting the locale of the
+// iperf3 client to --iperf3.locale.
+func localeEnv() []string {
+	if *iperfLocale == "" {
+		return nil
+	}
+	return []string{"LC_ALL=" + *iperfLocale, "LANG=" + *iperfLocale}
+}
+
+// sshRunner runs the iperf3 client on a remote host through the ssh client.
+// Environment variables are sent on the standard input rather than on the
+// command line so that they do not show up in the remote process list.
+type sshRunner struct {
+	cfg *config.SSH
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func (r sshRunner) Output(ctx context.Context, args []string, env []string) ([]byte, error) {
+	sshArgs := []string{"-o", "BatchMode=yes"}
+	if r.cfg.Port != 0 {
+		sshArgs = append(sshArgs, "-p", strconv.Itoa(r.cfg.Port))
+	}
+	if r.cfg.KeyFile != "" {
+		sshArgs = append(sshArgs, "-i", r.cfg.KeyFile)
+	}
+	if r.cfg.KnownHostsFile != "" {
+		sshArgs = append(sshArgs, "-o", "UserKnownHostsFile="+r.cfg.KnownHostsFile)
+	}
+	host := r.cfg.Host
+	if r.cfg.User != "" {
+		host = r.cfg.User + "@" + host
+	}
+
+	var script []string
+	var stdin strings.Builder
+	for _, kv := range env {
+		name := strings.SplitN(kv, "=", 2)[0]
+		script = append(script, "IFS= read -r "+name+" && export "+name)
+		stdin.WriteString(strings.TrimPrefix(kv, name+"=") + "\n")
+	}
+	command := []string{shellQuote(r.cfg.Command)}
+	for _, arg := range args {
+		command = append(command, shellQuote(arg))
+	}
+	script = append(script, "exec "+strings.Join(command, " "))
+
+	argv := append(sshArgs, host, strings.Join(script, " && "))
+	traceCommand(ctx, append([]string{"ssh"}, argv...))
+	cmd := exec.CommandContext(ctx, "ssh", argv...)
+	cmd.Stdin = strings.NewReader(stdin.String())
+	return commandOutput(ctx, cmd)
+}
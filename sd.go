@@ -0,0 +1,56 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/edgard/iperf3_exporter/internal/config"
+)
+
+// sdTargetGroup is a target group in the Prometheus HTTP SD format.
+type sdTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// sdTargetGroups converts the given targets into HTTP SD target groups.
+// The port is exposed as the __param_port label so it is passed to /probe
+// as-is by Prometheus.
+func sdTargetGroups(targets []config.Target) []sdTargetGroup {
+	groups := make([]sdTargetGroup, 0, len(targets))
+	for _, t := range targets {
+		labels := make(map[string]string, len(t.Labels)+1)
+		for name, value := range t.Labels {
+			labels[name] = value
+		}
+		if t.Port != 0 {
+			labels["__param_port"] = strconv.Itoa(t.Port)
+		}
+		groups = append(groups, sdTargetGroup{Targets: []string{t.Target}, Labels: labels})
+	}
+	return groups
+}
+
+func sdHandler(sc *config.SafeConfig, discoverers []discoverer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(sdTargetGroups(discoveredTargets(sc.Get(), discoverers))); err != nil {
+			slog.Warn("Failed to write to HTTP client", "err", err)
+		}
+	}
+}
@@ -0,0 +1,355 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// secretProvider fetches secrets from an external secret store.
+type secretProvider interface {
+	GetSecret(ctx context.Context, ref string) (string, error)
+}
+
+// secretProviders are the available providers keyed by the prefix used in
+// secret references, e.g. "vault:secret/data/iperf3#password".
+var secretProviders = map[string]secretProvider{
+	"vault": vaultProvider{},
+	"aws":   awsProvider{},
+	"gcp":   gcpProvider{},
+}
+
+// resolveSecret returns the secret a "<provider>:<reference>" string refers to.
+func resolveSecret(ctx context.Context, ref string) (string, error) {
+	kv := strings.SplitN(ref, ":", 2)
+	if len(kv) != 2 {
+		return "", fmt.Errorf("invalid secret reference %q", ref)
+	}
+	p, ok := secretProviders[kv[0]]
+	if !ok {
+		return "", fmt.Errorf("unknown secret provider %q", kv[0])
+	}
+	return p.GetSecret(ctx, kv[1])
+}
+
+// splitSecretKey splits a "<path>#<key>" reference.
+func splitSecretKey(ref string) (string, string) {
+	if i := strings.LastIndex(ref, "#"); i >= 0 {
+		return ref[:i], ref[i+1:]
+	}
+	return ref, ""
+}
+
+// jsonSecretKey extracts key from a JSON object secret, or returns the secret
+// as-is when no key is requested.
+func jsonSecretKey(secret string, key string) (string, error) {
+	if key == "" {
+		return secret, nil
+	}
+	values := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(secret), &values); err != nil {
+		return "", err
+	}
+	v, ok := values[key].(string)
+	if !ok {
+		return "", fmt.Errorf("key %q not found in secret", key)
+	}
+	return v, nil
+}
+
+// readBody returns the body of the response to req, an error unless it is
+// successful.
+func readBody(req *http.Request) ([]byte, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status from %s: %s", req.URL.Host, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func doJSON(req *http.Request, v interface{}) error {
+	body, err := readBody(req)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+// vaultProvider reads secrets from the Vault KV engine at VAULT_ADDR, using
+// the token in VAULT_TOKEN. References are "<path>#<key>".
+type vaultProvider struct{}
+
+func (vaultProvider) GetSecret(ctx context.Context, ref string) (string, error) {
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return "", errors.New("VAULT_ADDR is not set")
+	}
+	path, key := splitSecretKey(ref)
+	if key == "" {
+		return "", errors.New("vault secret references must specify a key")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(addr, "/")+"/v1/"+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+
+	var resp struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := doJSON(req.WithContext(ctx), &resp); err != nil {
+		return "", err
+	}
+	// KV version 2 nests the secret in another data object.
+	data := resp.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+	v, ok := data[key].(string)
+	if !ok {
+		return "", fmt.Errorf("key %q not found in vault secret %q", key, path)
+	}
+	return v, nil
+}
+
+// gcpProvider reads secrets from Google Secret Manager using the credentials
+// of the instance service account. References are secret version names, e.g.
+// "projects/p/secrets/s/versions/latest", optionally followed by "#<key>" for
+// JSON secrets.
+type gcpProvider struct{}
+
+const gcpTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+func (gcpProvider) GetSecret(ctx context.Context, ref string) (string, error) {
+	name, key := splitSecretKey(ref)
+
+	req, err := http.NewRequest(http.MethodGet, gcpTokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := doJSON(req.WithContext(ctx), &token); err != nil {
+		return "", err
+	}
+
+	req, err = http.NewRequest(http.MethodGet, "https://secretmanager.googleapis.com/v1/"+name+":access", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	var resp struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := doJSON(req.WithContext(ctx), &resp); err != nil {
+		return "", err
+	}
+	secret, err := base64.StdEncoding.DecodeString(resp.Payload.Data)
+	if err != nil {
+		return "", err
+	}
+	return jsonSecretKey(string(secret), key)
+}
+
+// awsProvider reads secrets from AWS Secrets Manager in AWS_REGION. The
+// credentials are taken from the standard environment variables, or from the
+// instance role otherwise. References are secret IDs, optionally followed by
+// "#<key>" for JSON secrets.
+type awsProvider struct{}
+
+type awsCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	Token           string `json:"Token"`
+}
+
+var awsMetadataURL = "http://169.254.169.254/latest"
+
+func awsInstanceCredentials(ctx context.Context) (*awsCredentials, error) {
+	req, err := http.NewRequest(http.MethodPut, awsMetadataURL+"/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	token, err := readBody(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	get := func(path string) (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, awsMetadataURL+"/meta-data/iam/security-credentials/"+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-aws-ec2-metadata-token", string(token))
+		return req.WithContext(ctx), nil
+	}
+
+	req, err = get("")
+	if err != nil {
+		return nil, err
+	}
+	role, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err = get(strings.TrimSpace(string(role)))
+	if err != nil {
+		return nil, err
+	}
+	creds := &awsCredentials{}
+	return creds, doJSON(req, creds)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// awsEscape escapes s as signature version 4 requires, spaces included.
+func awsEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+// awsCanonicalQuery returns the parameters of query sorted by name and value.
+func awsCanonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var params []string
+	for _, name := range names {
+		values := append([]string(nil), query[name]...)
+		sort.Strings(values)
+		for _, v := range values {
+			params = append(params, awsEscape(name)+"="+awsEscape(v))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// signAWSRequest signs req with AWS signature version 4, over all its headers
+// and its query.
+func signAWSRequest(req *http.Request, body []byte, creds *awsCredentials, region string, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.Token)
+	}
+
+	// Signed header names must be lowercase and sorted.
+	names := []string{"host"}
+	for name := range req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		value := strings.Join(req.Header.Values(name), ",")
+		if name == "host" {
+			value = req.URL.Host
+		}
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, strings.Join(strings.Fields(value), " "))
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{req.Method, path, awsCanonicalQuery(req.URL.Query()), canonicalHeaders.String(), signedHeaders, sha256Hex(body)}, "\n")
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func (awsProvider) GetSecret(ctx context.Context, ref string) (string, error) {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		return "", errors.New("AWS_REGION is not set")
+	}
+	id, key := splitSecretKey(ref)
+
+	creds := &awsCredentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		Token:           os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.AccessKeyID == "" {
+		var err error
+		if creds, err = awsInstanceCredentials(ctx); err != nil {
+			return "", fmt.Errorf("failed to get instance credentials: %s", err)
+		}
+	}
+
+	body, err := json.Marshal(map[string]string{"SecretId": id})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodPost, "https://secretsmanager."+region+".amazonaws.com/", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	signAWSRequest(req, body, creds, region, "secretsmanager", time.Now())
+
+	var resp struct {
+		SecretString string `json:"SecretString"`
+	}
+	if err := doJSON(req.WithContext(ctx), &resp); err != nil {
+		return "", err
+	}
+	return jsonSecretKey(resp.SecretString, key)
+}
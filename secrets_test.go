@@ -0,0 +1,132 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSignAWSRequest checks the signatures of requests of the AWS signature
+// version 4 test suite and of the IAM example of the AWS documentation.
+func TestSignAWSRequest(t *testing.T) {
+	creds := &awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name    string
+		method  string
+		url     string
+		headers map[string]string
+		service string
+		want    string
+	}{
+		{
+			name:    "get-vanilla",
+			method:  http.MethodGet,
+			url:     "https://example.amazonaws.com/",
+			service: "service",
+			want:    "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			name:    "post-vanilla",
+			method:  http.MethodPost,
+			url:     "https://example.amazonaws.com/",
+			service: "service",
+			want:    "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b",
+		},
+		{
+			name:    "get-vanilla-query-order-key",
+			method:  http.MethodGet,
+			url:     "https://example.amazonaws.com/?Param2=value2&Param1=value1",
+			service: "service",
+			want:    "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+		},
+		{
+			name:    "iam-list-users",
+			method:  http.MethodGet,
+			url:     "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08",
+			headers: map[string]string{"Content-Type": "application/x-www-form-urlencoded; charset=utf-8"},
+			service: "iam",
+			want:    "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7",
+		},
+	} {
+		req, err := http.NewRequest(tc.method, tc.url, nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %s", err)
+		}
+		for name, value := range tc.headers {
+			req.Header.Set(name, value)
+		}
+		signAWSRequest(req, nil, creds, "us-east-1", tc.service, now)
+		if got := req.Header.Get("Authorization"); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+		if got := req.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+			t.Errorf("%s: got X-Amz-Date %q", tc.name, got)
+		}
+	}
+}
+
+func TestAWSInstanceCredentials(t *testing.T) {
+	saved := awsMetadataURL
+	defer func() { awsMetadataURL = saved }()
+
+	for _, tc := range []struct {
+		name      string
+		tokenCode int
+		roleCode  int
+		want      string
+	}{
+		{"ok", http.StatusOK, http.StatusOK, ""},
+		{"token refused", http.StatusForbidden, http.StatusOK, "403 Forbidden"},
+		{"no role", http.StatusOK, http.StatusNotFound, "404 Not Found"},
+	} {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.Method == http.MethodPut && r.URL.Path == "/api/token":
+				w.WriteHeader(tc.tokenCode)
+				w.Write([]byte("token"))
+			case r.Header.Get("X-aws-ec2-metadata-token") != "token":
+				w.WriteHeader(http.StatusUnauthorized)
+			case r.URL.Path == "/meta-data/iam/security-credentials/":
+				w.WriteHeader(tc.roleCode)
+				w.Write([]byte("exporter\n"))
+			case r.URL.Path == "/meta-data/iam/security-credentials/exporter":
+				w.Write([]byte(`{"AccessKeyId": "AKID", "SecretAccessKey": "secret", "Token": "session"}`))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		awsMetadataURL = ts.URL
+		creds, err := awsInstanceCredentials(context.Background())
+		ts.Close()
+		if tc.want != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("%s: got error %v, want %q", tc.name, err, tc.want)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		if *creds != (awsCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret", Token: "session"}) {
+			t.Errorf("%s: got %+v", tc.name, creds)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// maxServerRestartDelay caps the backoff between iperf3 server restarts.
+	maxServerRestartDelay = time.Minute
+)
+
+var (
+	serverUp        = prometheus.NewGauge(prometheus.GaugeOpts{Name: prometheus.BuildFQName(namespace, "server", "up"), Help: "Whether the supervised iperf3 server is running."})
+	serverStartTime = prometheus.NewGauge(prometheus.GaugeOpts{Name: prometheus.BuildFQName(namespace, "server", "start_time_seconds"), Help: "Start time of the supervised iperf3 server process."})
+	serverRestarts  = prometheus.NewCounter(prometheus.CounterOpts{Name: prometheus.BuildFQName(namespace, "server", "restarts_total"), Help: "Restarts of the supervised iperf3 server."})
+)
+
+// superviseServer runs an iperf3 server on port and restarts it whenever it
+// exits, until ctx is done. The restart delay doubles each time the server
+// exits shortly after being started.
+func superviseServer(ctx context.Context, port int, restartDelay time.Duration) {
+	delay := restartDelay
+	for {
+		cmd := exec.CommandContext(ctx, *iperfPath, "-s", "-p", strconv.Itoa(port))
+		start := time.Now()
+		if err := cmd.Start(); err != nil {
+			slog.Error("Failed to start iperf3 server", "err", err)
+		} else {
+			slog.Info("Started iperf3 server", "port", port, "pid", cmd.Process.Pid)
+			serverUp.Set(1)
+			serverStartTime.Set(float64(start.UnixNano()) / 1e9)
+			err := cmd.Wait()
+			serverUp.Set(0)
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Error("iperf3 server exited", "err", err)
+		}
+
+		if time.Since(start) > maxServerRestartDelay {
+			delay = restartDelay
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		serverRestarts.Inc()
+		if delay *= 2; delay > maxServerRestartDelay {
+			delay = maxServerRestartDelay
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/edgard/iperf3_exporter/internal/config"
+	"github.com/edgard/iperf3_exporter/internal/iperf"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type slaKey struct {
+	target string
+	port   int
+}
+
+// slaSample is whether a test met the expected bandwidth of its target.
+type slaSample struct {
+	time      time.Time
+	compliant bool
+}
+
+var (
+	slaMutex   sync.Mutex
+	slaSamples = map[slaKey][]slaSample{}
+)
+
+// recordSLA records whether a test of a target with an expected bandwidth
+// was compliant, failed tests never being, and drops the samples older than
+// --sla.window.
+func recordSLA(t *config.Target, port int, stats *iperf.Result, err error) {
+	if t == nil || t.ExpectedBitsPerSecond == 0 {
+		return
+	}
+	compliant := false
+	if err == nil && stats != nil {
+		compliant = bandwidthRatio(t, stats) >= *slaCompliantRatio
+	}
+
+	slaMutex.Lock()
+	defer slaMutex.Unlock()
+	k := slaKey{t.Target, port}
+	now := time.Now()
+	samples := append(slaSamples[k], slaSample{time: now, compliant: compliant})
+	for len(samples) > 0 && now.Sub(samples[0].time) > *slaWindow {
+		samples = samples[1:]
+	}
+	slaSamples[k] = samples
+}
+
+// slaCompliance returns the ratio of the compliant tests of a target over
+// --sla.window, if it was tested.
+func slaCompliance(target string, port int) (float64, bool) {
+	slaMutex.Lock()
+	defer slaMutex.Unlock()
+	var n, compliant int
+	for _, s := range slaSamples[slaKey{target, port}] {
+		if time.Since(s.time) > *slaWindow {
+			continue
+		}
+		n++
+		if s.compliant {
+			compliant++
+		}
+	}
+	if n == 0 {
+		return 0, false
+	}
+	return float64(compliant) / float64(n), true
+}
+
+// bandwidthRatio is the received throughput of stats over the expected
+// bandwidth of t.
+func bandwidthRatio(t *config.Target, stats *iperf.Result) float64 {
+	return throughput(stats.End.SumReceived.Bytes, stats.End.SumReceived.Seconds) * 8 / t.ExpectedBitsPerSecond
+}
+
+// collectSLA delivers the bandwidth ratio of stats, nil if the test failed,
+// and the compliance of the target, if it has an expected bandwidth.
+func (e *Exporter) collectSLA(ch chan<- prometheus.Metric, stats *iperf.Result) {
+	t := e.target
+	if t == nil || t.ExpectedBitsPerSecond == 0 {
+		return
+	}
+	if stats != nil {
+		ch <- prometheus.MustNewConstMetric(e.bandwidthRatio, prometheus.GaugeValue, bandwidthRatio(t, stats))
+	}
+	if ratio, ok := slaCompliance(t.Target, e.opts.port); ok {
+		ch <- prometheus.MustNewConstMetric(e.slaCompliance, prometheus.GaugeValue, ratio)
+	}
+}
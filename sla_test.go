@@ -0,0 +1,83 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/edgard/iperf3_exporter/internal/config"
+)
+
+func TestBandwidthRatio(t *testing.T) {
+	target := &config.Target{Target: "ratio.example.com", ExpectedBitsPerSecond: 100e6}
+	for _, tc := range []struct {
+		output string
+		want   float64
+	}{
+		{`{"end": {"sum_received": {"bytes": 62500000, "seconds": 5}}}`, 1},
+		{`{"end": {"sum_received": {"bytes": 31250000, "seconds": 5}}}`, 0.5},
+		{`{"end": {"sum_received": {"bytes": 125000000, "seconds": 5}}}`, 2},
+		{`{"end": {"sum_received": {"bytes": 62500000, "seconds": 0}}}`, 0},
+	} {
+		if got := bandwidthRatio(target, testResult(t, tc.output)); math.Abs(got-tc.want) > 1e-9 {
+			t.Errorf("%s: got %g, want %g", tc.output, got, tc.want)
+		}
+	}
+}
+
+func TestSLACompliance(t *testing.T) {
+	savedWindow, savedRatio := *slaWindow, *slaCompliantRatio
+	defer func() { *slaWindow, *slaCompliantRatio = savedWindow, savedRatio }()
+	*slaWindow, *slaCompliantRatio = time.Hour, 0.9
+
+	fast := `{"end": {"sum_received": {"bytes": 62500000, "seconds": 5}}}`
+	slow := `{"end": {"sum_received": {"bytes": 50000000, "seconds": 5}}}`
+	for _, tc := range []struct {
+		name  string
+		tests []string
+		want  float64
+		ok    bool
+	}{
+		{"untested", nil, 0, false},
+		{"compliant", []string{fast, fast}, 1, true},
+		{"below the compliant ratio", []string{fast, slow, slow, fast}, 0.5, true},
+		{"failed", []string{fast, ""}, 0.5, true},
+	} {
+		target := &config.Target{Target: tc.name + ".example.com", ExpectedBitsPerSecond: 100e6}
+		for _, output := range tc.tests {
+			if output == "" {
+				recordSLA(target, 5201, nil, errors.New("connection refused"))
+				continue
+			}
+			recordSLA(target, 5201, testResult(t, output), nil)
+		}
+		got, ok := slaCompliance(target.Target, 5201)
+		if ok != tc.ok || math.Abs(got-tc.want) > 1e-9 {
+			t.Errorf("%s: got %g, %t, want %g, %t", tc.name, got, ok, tc.want, tc.ok)
+		}
+		if _, ok := slaCompliance(target.Target, 5202); ok {
+			t.Errorf("%s: compliance recorded for another port", tc.name)
+		}
+	}
+
+	// Targets without an expected bandwidth are not recorded.
+	target := &config.Target{Target: "unexpected.example.com"}
+	recordSLA(target, 5201, testResult(t, fast), nil)
+	if _, ok := slaCompliance(target.Target, 5201); ok {
+		t.Error("compliance recorded for a target without an expected bandwidth")
+	}
+}
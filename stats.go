@@ -0,0 +1,110 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// persistedStats are the exporter-wide counters saved across restarts.
+type persistedStats struct {
+	Tests            float64 `json:"tests_total"`
+	Errors           float64 `json:"errors_total"`
+	TransferredBytes float64 `json:"transferred_bytes_total"`
+}
+
+// statsCounters returns the persisted counters keyed by their field.
+func statsCounters(s *persistedStats) map[*float64]prometheus.Counter {
+	return map[*float64]prometheus.Counter{
+		&s.Tests:            iperfTests,
+		&s.Errors:           iperfErrors,
+		&s.TransferredBytes: iperfTransferredBytes,
+	}
+}
+
+// loadStats adds the counters saved in file to the current counters. A missing
+// file is not an error.
+func loadStats(file string) error {
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	s := persistedStats{}
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	for v, c := range statsCounters(&s) {
+		if *v > 0 {
+			c.Add(*v)
+		}
+	}
+	return nil
+}
+
+// saveStats atomically writes the current counters to file.
+func saveStats(file string) error {
+	s := persistedStats{}
+	for v, c := range statsCounters(&s) {
+		m := &dto.Metric{}
+		if err := c.Write(m); err != nil {
+			return err
+		}
+		*v = m.GetCounter().GetValue()
+	}
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(file, b)
+}
+
+// writeFileAtomic writes b to file through a temporary file, so that readers
+// never see a partial file.
+func writeFileAtomic(file string, b []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// persistStats saves the counters to file every interval.
+func persistStats(file string, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := saveStats(file); err != nil {
+			slog.Error("Failed to save exporter statistics", "err", err)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sdNotify sends state, e.g. READY=1, to the service manager when the
+// exporter runs as a systemd service of Type=notify. It does nothing outside
+// of such a service.
+func sdNotify(state string) error {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return nil
+	}
+	// A name starting with @ is that of an abstract socket.
+	if name[0] == '@' {
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdListenFDsStart is the first file descriptor passed by systemd socket
+// activation.
+const sdListenFDsStart = 3
+
+// sdListener returns the listener passed by systemd socket activation under
+// name, set with FileDescriptorName= in the socket unit, or the only one
+// passed if none is named so. It returns nil without socket activation.
+func sdListener(name string) (net.Listener, error) {
+	if pid := os.Getenv("LISTEN_PID"); pid == "" || pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, errors.New("invalid LISTEN_FDS " + strconv.Quote(os.Getenv("LISTEN_FDS")))
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	// The variables are not meant for the processes the exporter starts.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	index := -1
+	for i := 0; i < n && i < len(names); i++ {
+		if names[i] == name {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		if n > 1 {
+			return nil, errors.New("none of the " + strconv.Itoa(n) + " sockets passed by systemd is named " + strconv.Quote(name))
+		}
+		index = 0
+	}
+	f := os.NewFile(uintptr(sdListenFDsStart+index), "LISTEN_FD_"+strconv.Itoa(sdListenFDsStart+index))
+	// FileListener duplicates the descriptor, so that the original one can
+	// be closed rather than leaked to the iperf3 processes.
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// sdWatchdogInterval returns the watchdog timeout of the service, zero if the
+// watchdog is disabled or meant for another process.
+func sdWatchdogInterval() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, errors.New("invalid WATCHDOG_USEC " + strconv.Quote(usec))
+	}
+	return time.Duration(n) * time.Microsecond, nil
+}
+
+// notifyReady tells systemd the exporter is ready once it listens on addr,
+// and then pets the watchdog, if enabled, as long as the exporter is healthy.
+func notifyReady(addr net.Addr) {
+	if err := sdNotify("READY=1\nSTATUS=Listening on " + addr.String()); err != nil {
+		slog.Warn("Failed to notify systemd", "err", err)
+		return
+	}
+	timeout, err := sdWatchdogInterval()
+	if err != nil {
+		slog.Warn("Not petting the systemd watchdog", "err", err)
+		return
+	}
+	if timeout == 0 {
+		return
+	}
+	// Petting twice per timeout leaves room for a slow check.
+	interval := timeout / 2
+	slog.Debug("Petting the systemd watchdog", "interval", interval)
+	for range time.Tick(interval) {
+		if err := checkHealth(addr, interval); err != nil {
+			slog.Warn("Not petting the systemd watchdog, the exporter is unhealthy", "err", err)
+			continue
+		}
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			slog.Warn("Failed to pet the systemd watchdog", "err", err)
+		}
+	}
+}
+
+// checkHealth checks, within timeout, that the exporter accepts connections
+// on addr, and that its own metrics can be gathered, which a deadlocked
+// collector prevents.
+func checkHealth(addr net.Addr, timeout time.Duration) error {
+	target := addr.String()
+	// The listener may be bound to every address.
+	if tcp, ok := addr.(*net.TCPAddr); ok && tcp.IP.IsUnspecified() {
+		target = net.JoinHostPort("localhost", strconv.Itoa(tcp.Port))
+	}
+	conn, err := net.DialTimeout(addr.Network(), target, timeout)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+
+	gathered := make(chan error, 1)
+	go func() {
+		_, err := prometheus.DefaultGatherer.Gather()
+		gathered <- err
+	}()
+	select {
+	case err := <-gathered:
+		return err
+	case <-time.After(timeout):
+		return errors.New("timeout gathering the exporter metrics")
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/edgard/iperf3_exporter/internal/config"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// apiTargets are the targets of the targets API.
+var apiTargets *targetStore
+
+// apiTarget is a target of the targets API. Authentication is only available
+// to the targets of the configuration file.
+type apiTarget struct {
+	Target     string            `json:"target"`
+	Port       int               `json:"port,omitempty"`
+	Ports      string            `json:"ports,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Notes      string            `json:"notes,omitempty"`
+	RunbookURL string            `json:"runbook_url,omitempty"`
+}
+
+// targetStore holds the targets added at runtime through the targets API,
+// optionally persisted to a file. It is a discoverer, so that its targets are
+// scheduled through /sd along with the others.
+type targetStore struct {
+	file string
+
+	mutex   sync.RWMutex
+	targets []config.Target
+}
+
+// newTargetStore returns a store persisted to file, if not empty, loading the
+// targets it already lists. A missing file is not an error.
+func newTargetStore(file string) (*targetStore, error) {
+	s := &targetStore{file: file}
+	if file == "" {
+		return s, nil
+	}
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var targets []config.Target
+	if err := yaml.UnmarshalStrict(b, &targets); err != nil {
+		return nil, err
+	}
+	c := &config.Config{Targets: targets}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	s.targets = c.Targets
+	return s, nil
+}
+
+// Targets implements discoverer.
+func (s *targetStore) Targets() []config.Target {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return append([]config.Target(nil), s.targets...)
+}
+
+// lookup returns the target of the store matching target and port, if any.
+func (s *targetStore) lookup(target string, port int) *config.Target {
+	return (&config.Config{Targets: s.Targets()}).LookupTarget(target, port)
+}
+
+// update replaces the targets of the store with fn applied to them, once they
+// are validated and persisted.
+func (s *targetStore) update(fn func([]config.Target) []config.Target) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c := &config.Config{Targets: fn(append([]config.Target(nil), s.targets...))}
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	if s.file != "" {
+		b, err := yaml.Marshal(c.Targets)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(s.file, b); err != nil {
+			return fmt.Errorf("failed to persist the targets: %s", err)
+		}
+	}
+	s.targets = c.Targets
+	return nil
+}
+
+// Add adds t, replacing the target of the same address and port.
+func (s *targetStore) Add(t config.Target) error {
+	return s.update(func(targets []config.Target) []config.Target {
+		for i, old := range targets {
+			if old.Target == t.Target && old.Port == t.Port {
+				targets[i] = t
+				return targets
+			}
+		}
+		return append(targets, t)
+	})
+}
+
+// Remove removes the target of the given address and port and reports whether
+// there was one.
+func (s *targetStore) Remove(target string, port int) (bool, error) {
+	found := false
+	err := s.update(func(targets []config.Target) []config.Target {
+		kept := targets[:0]
+		for _, t := range targets {
+			if t.Target == target && t.Port == port {
+				found = true
+				continue
+			}
+			kept = append(kept, t)
+		}
+		return kept
+	})
+	return found, err
+}
+
+// ServeHTTP serves the targets API: GET lists the targets, POST adds or
+// replaces the target of its JSON body, and DELETE removes the target of the
+// target and port parameters.
+func (s *targetStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var t apiTarget
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid target: %s", err), http.StatusBadRequest)
+			return
+		}
+		err := s.Add(config.Target{Target: t.Target, Port: t.Port, Ports: t.Ports, Labels: t.Labels, Notes: t.Notes, RunbookURL: t.RunbookURL})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid target: %s", err), http.StatusBadRequest)
+			return
+		}
+		slog.Info("Added target through the targets API", "target", t.Target)
+	case http.MethodDelete:
+		target := r.URL.Query().Get("target")
+		port := 0
+		if v := r.URL.Query().Get("port"); v != "" {
+			var err error
+			if port, err = strconv.Atoi(v); err != nil {
+				http.Error(w, fmt.Sprintf("'port' parameter must be an integer: %s", err), http.StatusBadRequest)
+				return
+			}
+		}
+		found, err := s.Remove(target, port)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "Unknown target", http.StatusNotFound)
+			return
+		}
+		slog.Info("Removed target through the targets API", "target", target)
+	default:
+		http.Error(w, "Only GET, POST and DELETE requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	targets := []apiTarget{}
+	for _, t := range s.Targets() {
+		targets = append(targets, apiTarget{Target: t.Target, Port: t.Port, Ports: t.Ports, Labels: t.Labels, Notes: t.Notes, RunbookURL: t.RunbookURL})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(targets); err != nil {
+		slog.Warn("Failed to write to HTTP client", "err", err)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/edgard/iperf3_exporter/internal/cache"
+	"github.com/edgard/iperf3_exporter/internal/config"
+	"github.com/edgard/iperf3_exporter/internal/iperf"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// webhookTimeout bounds the threshold webhook calls, which run in the
+	// background of the probes.
+	webhookTimeout = 10 * time.Second
+
+	// thresholdStateIdle is how long a breach is remembered once its probe
+	// is no longer run.
+	thresholdStateIdle = 24 * time.Hour
+)
+
+var webhookErrors = prometheus.NewCounter(prometheus.CounterOpts{Name: prometheus.BuildFQName(namespace, "exporter", "threshold_webhook_errors_total"), Help: "Errors calling the threshold webhooks."})
+
+type thresholdKey struct {
+	probe     cache.Key
+	threshold string
+}
+
+var (
+	// thresholdStates are the thresholds breached by the latest probes, with
+	// the time of these probes, so that only breaches and recoveries are
+	// notified rather than every scrape.
+	thresholdStatesMutex sync.Mutex
+	thresholdStates      = map[thresholdKey]time.Time{}
+	thresholdStatesSwept time.Time
+)
+
+// setThresholdState records whether the threshold of k is breached by a probe
+// at now, and returns whether it was, forgetting the breaches of the probes
+// idle for thresholdStateIdle.
+func setThresholdState(k thresholdKey, breached bool, now time.Time) (was bool) {
+	thresholdStatesMutex.Lock()
+	defer thresholdStatesMutex.Unlock()
+
+	if now.Sub(thresholdStatesSwept) > thresholdStateIdle {
+		for k, t := range thresholdStates {
+			if now.Sub(t) > thresholdStateIdle {
+				delete(thresholdStates, k)
+			}
+		}
+		thresholdStatesSwept = now
+	}
+
+	_, was = thresholdStates[k]
+	if breached {
+		thresholdStates[k] = now
+	} else {
+		delete(thresholdStates, k)
+	}
+	return was
+}
+
+// thresholdEvent is the body POSTed to the threshold webhooks.
+type thresholdEvent struct {
+	Status    string    `json:"status"`
+	Target    string    `json:"target"`
+	Port      int       `json:"port"`
+	Module    string    `json:"module,omitempty"`
+	Threshold string    `json:"threshold"`
+	Limit     float64   `json:"limit"`
+	Value     float64   `json:"value"`
+	Time      time.Time `json:"time"`
+}
+
+// collectThresholds delivers whether the probe breached the thresholds of its
+// module, the throughput of stats and the loss of ping, either of them nil if
+// unknown.
+func (e *Exporter) collectThresholds(ch chan<- prometheus.Metric, stats *iperf.Result, ping *pingResult) {
+	t := e.module.Thresholds
+	if t.MinBitsPerSecond > 0 && stats != nil {
+		v := throughput(stats.End.SumReceived.Bytes, stats.End.SumReceived.Seconds) * 8
+		e.collectThreshold(ch, "min_bits_per_second", v < t.MinBitsPerSecond, t.MinBitsPerSecond, v)
+	}
+	if t.MaxLoss > 0 && ping != nil {
+		v := ping.loss()
+		e.collectThreshold(ch, "max_loss", v > t.MaxLoss, t.MaxLoss, v)
+	}
+}
+
+func (e *Exporter) collectThreshold(ch chan<- prometheus.Metric, name string, breached bool, limit float64, value float64) {
+	ch <- prometheus.MustNewConstMetric(e.thresholdBreached, prometheus.GaugeValue, boolToFloat(breached), name)
+
+	was := setThresholdState(thresholdKey{e.key, name}, breached, time.Now())
+	if breached == was {
+		return
+	}
+
+	status := "resolved"
+	if breached {
+		status = "breached"
+		e.logger.Warn("Threshold breached", "threshold", name, "limit", limit, "value", value)
+	}
+	if e.module.Thresholds.WebhookURL == "" {
+		return
+	}
+	ev := thresholdEvent{
+		Status:    status,
+		Target:    config.RedactTarget(e.opts.target),
+		Port:      e.opts.port,
+		Module:    e.key.Module,
+		Threshold: name,
+		Limit:     limit,
+		Value:     value,
+		Time:      time.Now(),
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+		defer cancel()
+		if err := postThresholdEvent(ctx, e.module.Thresholds.WebhookURL, e.module.Thresholds.WebhookToken, ev); err != nil {
+			webhookErrors.Inc()
+			slog.Error("Failed to call the threshold webhook", "err", err)
+		}
+	}()
+}
+
+func postThresholdEvent(ctx context.Context, url string, token string, ev thresholdEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/edgard/iperf3_exporter/internal/cache"
+)
+
+func TestSetThresholdState(t *testing.T) {
+	start := time.Now()
+	a := thresholdKey{cache.Key{Target: "a.example.com", Port: 5201}, "min_bits_per_second"}
+	b := thresholdKey{cache.Key{Target: "b.example.com", Port: 5201}, "min_bits_per_second"}
+	for _, tc := range []struct {
+		k        thresholdKey
+		after    time.Duration
+		breached bool
+		was      bool
+	}{
+		{a, 0, false, false},
+		{a, time.Minute, true, false},
+		{a, 2 * time.Minute, true, true},
+		{b, 2 * time.Minute, true, false},
+		{a, 3 * time.Minute, false, true},
+		{a, 4 * time.Minute, false, false},
+		// The breach of b is forgotten once its probe is idle.
+		{a, 2*time.Minute + thresholdStateIdle + time.Second, true, false},
+		{b, 2*time.Minute + thresholdStateIdle + time.Second, true, false},
+	} {
+		if was := setThresholdState(tc.k, tc.breached, start.Add(tc.after)); was != tc.was {
+			t.Errorf("%s after %s: got was %t, want %t", tc.k.probe.Target, tc.after, was, tc.was)
+		}
+	}
+
+	thresholdStatesMutex.Lock()
+	defer thresholdStatesMutex.Unlock()
+	if len(thresholdStates) != 2 {
+		t.Errorf("got %d threshold states, want the 2 breached", len(thresholdStates))
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	topologyChanges = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prometheus.BuildFQName(namespace, "exporter", "topology_changes_total"),
+			Help: "Topology change signals received, which dropped the cached results of the affected targets.",
+		},
+		[]string{"source"},
+	)
+	topologyChangeTime = prometheus.NewGauge(prometheus.GaugeOpts{Name: prometheus.BuildFQName(namespace, "exporter", "last_topology_change_timestamp_seconds"), Help: "Time of the last topology change signal."})
+)
+
+// topologyChanged drops the cached results and failure backoffs of targets,
+// or of every target if there are none, so that the next scrapes run fresh
+// tests rather than serving results from before the change.
+func topologyChanged(source string, targets []string) int {
+	topologyChanges.WithLabelValues(source).Inc()
+	topologyChangeTime.Set(float64(time.Now().UnixNano()) / 1e9)
+	if len(targets) == 0 {
+		n := probeCache.Invalidate("")
+		probeBackoff.Reset("")
+		slog.Info("Topology changed, flushed the result cache", "source", source, "results", n)
+		return n
+	}
+	n := 0
+	for _, t := range targets {
+		n += probeCache.Invalidate(t)
+		probeBackoff.Reset(t)
+	}
+	slog.Info("Topology changed, dropped the cached results of the targets", "source", source, "targets", len(targets), "results", n)
+	return n
+}
+
+// affectedTargets returns the targets of the query and the configured targets
+// matching its label_<name> parameters, which must all match. ok is false when
+// a selector matches no target, which must not flush the whole cache.
+func affectedTargets(r *http.Request) (targets []string, ok bool) {
+	q := r.URL.Query()
+	targets = append(targets, q["target"]...)
+	selector := map[string]string{}
+	for k, v := range q {
+		if strings.HasPrefix(k, "label_") && len(v) > 0 {
+			selector[strings.TrimPrefix(k, "label_")] = v[0]
+		}
+	}
+	if len(selector) == 0 {
+		return targets, true
+	}
+	for _, t := range sc.Get().Targets {
+		matches := true
+		for k, v := range selector {
+			if t.Labels[k] != v {
+				matches = false
+			}
+		}
+		if matches {
+			targets = append(targets, t.Target)
+		}
+	}
+	return targets, len(targets) > 0
+}
+
+// topologyChangeHandler receives topology change signals, e.g. from the
+// failover tooling, for the target parameters and the configured targets
+// matching the label_<name> parameters, or for every target without any.
+func topologyChangeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	n := 0
+	if targets, ok := affectedTargets(r); ok {
+		n = topologyChanged("http", targets)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]int{"removed": n}); err != nil {
+		slog.Warn("Failed to write to HTTP client", "err", err)
+	}
+}
+
+// watchTopologyFile signals a topology change whenever file is modified, for
+// the targets it lists one per line, or for every target if it lists none.
+// The file is polled every interval.
+func watchTopologyFile(file string, interval time.Duration) {
+	var last time.Time
+	if fi, err := os.Stat(file); err == nil {
+		last = fi.ModTime()
+	}
+	for range time.Tick(interval) {
+		fi, err := os.Stat(file)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				slog.Error("Error checking the topology signal file", "err", err)
+			}
+			continue
+		}
+		if !fi.ModTime().After(last) {
+			continue
+		}
+		last = fi.ModTime()
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			slog.Error("Error reading the topology signal file", "err", err)
+			continue
+		}
+		var targets []string
+		s := bufio.NewScanner(bytes.NewReader(b))
+		for s.Scan() {
+			if t := strings.TrimSpace(s.Text()); t != "" && !strings.HasPrefix(t, "#") {
+				targets = append(targets, t)
+			}
+		}
+		topologyChanged("file", targets)
+	}
+}
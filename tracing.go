@@ -0,0 +1,100 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/edgard/iperf3_exporter/internal/iperf"
+	"github.com/prometheus/common/version"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer starts the spans of the probes. Until setupTracing installs a tracer
+// provider, its spans are not recorded.
+var tracer = otel.Tracer("github.com/edgard/iperf3_exporter")
+
+// tracingEnabled reports whether the environment asks for the spans to be
+// exported, following the OpenTelemetry SDK environment variables.
+func tracingEnabled() bool {
+	switch os.Getenv("OTEL_TRACES_EXPORTER") {
+	case "otlp":
+		return true
+	case "none":
+		return false
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// setupTracing exports the spans to an OTLP/HTTP collector when tracing is
+// enabled. The collector, headers, service name and resource attributes are
+// those of the standard OTEL_* environment variables. It returns the function
+// flushing the pending spans on shutdown.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	// The trace context of the scrape request is followed even when the
+	// spans of the exporter are not recorded.
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if !tracingEnabled() {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exp, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// The environment overrides the service name set here.
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceNameKey.String("iperf3_exporter"), semconv.ServiceVersionKey.String(version.Version)),
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.AlwaysSample())),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// endSpan ends span, marking it as failed with err, if any.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// resultAttributes returns the span attributes summing up a test result.
+func resultAttributes(stats *iperf.Result) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.Float64("iperf3.sent_bytes", stats.End.SumSent.Bytes),
+		attribute.Float64("iperf3.received_bytes", stats.End.SumReceived.Bytes),
+		attribute.Float64("iperf3.received_seconds", stats.End.SumReceived.Seconds),
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// toolkitLogger passes the key-value records of the exporter toolkit to the
+// exporter log.
+type toolkitLogger struct{}
+
+func (toolkitLogger) Log(keyvals ...interface{}) error {
+	var msg string
+	level := slog.LevelInfo
+	var attrs []interface{}
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		k := fmt.Sprint(keyvals[i])
+		switch k {
+		case "msg":
+			msg = fmt.Sprint(keyvals[i+1])
+		case "level":
+			level.UnmarshalText([]byte(fmt.Sprint(keyvals[i+1])))
+		default:
+			attrs = append(attrs, k, keyvals[i+1])
+		}
+	}
+	slog.Log(context.Background(), level, msg, attrs...)
+	return nil
+}